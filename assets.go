@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/tdewolff/minify/v2"
+	"github.com/tdewolff/minify/v2/css"
+	"github.com/tdewolff/minify/v2/js"
+)
+
+// ASSET_MANIFEST is the file in the assets directory that maps logical asset
+// names (common.css) to fingerprinted names (common.0123456789.css).
+const ASSET_MANIFEST = "manifest.json"
+
+var assetMediaTypes = map[string]string{
+	".css": "text/css",
+	".js":  "text/javascript",
+}
+
+// compileAsset returns the contents of a CSS or JavaScript asset, taken from
+// the first skin that has it. CSS is compiled from SCSS. The error satisfies
+// os.IsNotExist if no skin has this asset.
+func (b *Blog) compileAsset(name string) ([]byte, error) {
+	if name == JS_BUNDLE {
+		return b.bundleJS()
+	}
+
+	b.loadSkin()
+	ext := path.Ext(name)
+	for i, skin := range b.skins {
+		dir := path.Join(b.BlogPath, "skins", skin)
+		switch ext {
+		case ".js":
+			data, err := ioutil.ReadFile(path.Join(dir, name))
+			if os.IsNotExist(err) {
+				continue
+			}
+			return data, err
+
+		case ".css":
+			scssPath := path.Join(dir, strings.TrimSuffix(name, ext)+".scss")
+			if _, err := os.Stat(scssPath); os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			// Imports are resolved in this skin and its parents.
+			var includePaths []string
+			for j := i; j < len(b.skins); j++ {
+				includePaths = append(includePaths, path.Join(b.BlogPath, "skins", b.skins[j]))
+			}
+
+			start := time.Now()
+			data, err := compileSCSS(scssPath, includePaths)
+			if err == nil {
+				observeSince(metricSCSSCompile, start)
+			}
+			return data, err
+
+		default:
+			return nil, os.ErrNotExist
+		}
+	}
+	return nil, os.ErrNotExist
+}
+
+// writeAsset stores an asset and its precompressed versions (gzip, brotli)
+// in the webroot. Files are written to a temporary file first and then
+// renamed, so concurrent requests never see a partially written file. The
+// uncompressed file is written last, as its existence means the asset is
+// complete. Nothing is written if the asset didn't change, so its modification
+// time stays the same.
+func writeAsset(outpath string, data []byte) {
+	if old, err := ioutil.ReadFile(outpath); err == nil && bytes.Equal(old, data) {
+		return
+	}
+	for _, coding := range encodings {
+		writeFileAtomic(outpath+encodingExtensions[coding], compress(coding, data, true))
+	}
+	writeFileAtomic(outpath, data)
+}
+
+func writeFileAtomic(p string, data []byte) {
+	f, err := ioutil.TempFile(path.Dir(p), "."+path.Base(p)+".tmp")
+	checkError(err, "could not create temporary file")
+	_, err = f.Write(data)
+	checkError(err, "could not write temporary file")
+	checkError(f.Chmod(0644), "could not chmod temporary file")
+	checkError(f.Sync(), "could not sync data to temporary file")
+	checkError(f.Close(), "could not close temporary file")
+	checkError(os.Rename(f.Name(), p), "could not rename temporary file")
+}
+
+// assetManifest is the manifest written by build-assets. It isn't changed
+// after it's loaded, as it's shared between requests.
+type assetManifest struct {
+	names         map[string]string // logical name -> fingerprinted name
+	fingerprinted map[string]bool   // set of content-hashed asset names
+	modified      time.Time         // of the manifest file
+}
+
+// assetManifest returns the manifest written by build-assets, which is empty
+// if there is none. It is reloaded when the file changes.
+func (b *Blog) assetManifest() *assetManifest {
+	p := path.Join(b.WebRoot, b.AssetsPrefix, ASSET_MANIFEST)
+	st, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		b.manifestLock.Lock()
+		b.manifest = nil
+		b.manifestLock.Unlock()
+		return &assetManifest{}
+	}
+	checkError(err, "could not stat asset manifest")
+
+	b.manifestLock.RLock()
+	m := b.manifest
+	b.manifestLock.RUnlock()
+	if m != nil && st.ModTime().Equal(m.modified) {
+		return m
+	}
+
+	buf, err := ioutil.ReadFile(p)
+	checkError(err, "could not read asset manifest")
+	m = &assetManifest{modified: st.ModTime()}
+	checkError(json.Unmarshal(buf, &m.names), "could not parse asset manifest")
+	m.fingerprinted = make(map[string]bool, len(m.names))
+	for _, hashed := range m.names {
+		m.fingerprinted[hashed] = true
+	}
+
+	b.manifestLock.Lock()
+	b.manifest = m
+	b.manifestLock.Unlock()
+	return m
+}
+
+// assetURL returns the URL path of an asset, using the fingerprinted name if
+// it has been built with build-assets.
+func (b *Blog) assetURL(name string) string {
+	if hashed, ok := b.assetManifest().names[name]; ok {
+		name = hashed
+	}
+	return b.URLPrefix + b.AssetsPrefix + "/" + name
+}
+
+// isFingerprintedAsset returns true if this is the content-hashed name of an
+// asset, which means it can be cached forever.
+func (b *Blog) isFingerprintedAsset(name string) bool {
+	return b.assetManifest().fingerprinted[name]
+}
+
+// buildAssets compiles and minifies all CSS and JavaScript of the skin ahead
+// of time, and writes them with their logical and with content-hashed names.
+func (b *Blog) buildAssets() {
+	b.loadSkin()
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, name := range append(append([]string{"common.css", "common.js"}, b.extraCSS...), b.extraJS...) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if b.BundleJS {
+		names = append(names, JS_BUNDLE)
+	}
+
+	dir := path.Join(b.WebRoot, b.AssetsPrefix)
+	checkError(os.MkdirAll(dir, 0777), "could not create assets directory")
+
+	m := minify.New()
+	m.AddFunc("text/css", css.Minify)
+	m.AddFunc("text/javascript", js.Minify)
+
+	manifest := make(map[string]string)
+	for _, name := range names {
+		ext := path.Ext(name)
+		mediaType, ok := assetMediaTypes[ext]
+		if !ok {
+			fmt.Println("skipping:", name)
+			continue
+		}
+
+		data, err := b.compileAsset(name)
+		if os.IsNotExist(err) {
+			fmt.Println("not found:", name)
+			continue
+		}
+		checkError(err, "could not compile "+name)
+
+		data, err = m.Bytes(mediaType, data)
+		checkError(err, "could not minify "+name)
+
+		sum := sha256.Sum256(data)
+		hashed := strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:5]) + ext
+
+		writeAsset(path.Join(dir, name), data)
+		writeAsset(path.Join(dir, hashed), data)
+		manifest[name] = hashed
+		fmt.Printf("built: %s -> %s\n", name, hashed)
+	}
+
+	out, err := json.MarshalIndent(manifest, "", "\t")
+	checkError(err, "could not serialize asset manifest")
+	manifestPath := path.Join(dir, ASSET_MANIFEST)
+	if old, err := ioutil.ReadFile(manifestPath); err != nil || !bytes.Equal(old, out) {
+		writeFileAtomic(manifestPath, out)
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"net/http/fcgi"
 	"os"
 	"path"
+	"strconv"
+	"sync"
 	"time"
 
 	"database/sql"
@@ -19,6 +21,7 @@ import (
 	"github.com/gorilla/csrf"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
+	"github.com/yuin/goldmark"
 )
 
 type Blog struct {
@@ -27,11 +30,36 @@ type Blog struct {
 	extraCSS     []string
 	extraJS      []string
 	icons        []SkinIcon
-	skins        []string // list of [skin, parent skins...]
+	skinCSP      map[string][]string // CSP additions from all skins
+	skins        []string            // list of [skin, parent skins...]
+	skinVersion  string              // versions of all skins, for entity tags
 	db           *sql.DB
 	router       http.Handler // request router including middleware (CSRF protection etc.)
 	mux          *mux.Router  // underlying request router
 	sessionStore *south.Store
+	cache        *pageCache // rendered public pages
+	postURL      *permalink // parsed permalink
+	tree         *pageTree  // static pages (lazy load)
+	treeLock     sync.Mutex
+	menus        *navMenus // navigation menus (lazy load)
+	menusLock    sync.Mutex
+
+	templates    map[string]*parsedTemplate // parsed templates by name
+	templateLock sync.Mutex
+
+	hooksRunning sync.WaitGroup // hook deliveries in progress
+	cgi          bool           // serving a single request, see deliver
+
+	md               goldmark.Markdown // Markdown converter (lazy load)
+	markdownOnce     sync.Once
+	mdFeed           goldmark.Markdown // Markdown converter for the feed (lazy load)
+	feedMarkdownOnce sync.Once
+
+	dotPath string // dot program for diagrams (lazy load)
+	dotOnce sync.Once
+
+	manifest     *assetManifest // asset manifest from build-assets (lazy load)
+	manifestLock sync.RWMutex
 }
 
 type SkinPage struct {
@@ -40,11 +68,13 @@ type SkinPage struct {
 }
 
 type SkinJson struct {
+	Version  string              `json:"version"`
 	Parent   string              `json:"parent"`
 	Pages    map[string]SkinPage `json:"pages"`
 	ExtraCSS []string            `json:"extraCSS"`
 	ExtraJS  []string            `json:"extraJS"`
 	Icons    []SkinIcon          `json:"icons"`
+	CSP      map[string][]string `json:"csp"`
 }
 
 type SkinIcon struct {
@@ -73,39 +103,76 @@ func NewBlog(root string) *Blog {
 	}
 	b.db = db
 
+	b.postURL, err = parsePermalink(b.Permalink)
+	checkError(err, "invalid permalink in config")
+
+	b.cache = newPageCache()
+	b.templates = make(map[string]*parsedTemplate)
+
 	b.mux = mux.NewRouter()
 	sub := b.mux
 	if b.URLPrefix != "" {
 		sub = b.mux.PathPrefix(b.URLPrefix).Subrouter()
 	}
 
-	sub.HandleFunc("/", BlogIndexHandler).Name("index")
-	sub.HandleFunc("/{year:[0-9]{4}}/{month:0[0-9]|1[0-2]}/{name:[a-z0-9]+(?:-[a-z0-9]+)*}", PageViewHandler)
+	sub.HandleFunc("/", b.cached(BlogIndexHandler)).Name("index")
 	sub.HandleFunc("/admin/", AdminHandler).Name("admin")
 	admin, _ := sub.Get("admin").URLPath()
 	sub.Handle("/admin", http.RedirectHandler(admin.Path, http.StatusMovedPermanently))
-	sub.HandleFunc("/admin/edit/new{id:post|page}", PageEditHandler)
-	sub.HandleFunc("/admin/edit/{id:[1-9][0-9]*}", PageEditHandler)
-	sub.HandleFunc("/admin/edit/{id:[1-9][0-9]*}/preview", PagePreviewHandler)
-	sub.HandleFunc("/archive/", ArchiveHandler).Name("archive")
-	sub.HandleFunc("/feed.xml", FeedHandler).Name("feed")
+	sub.HandleFunc("/admin/edit/new{id:post|page}", PageEditHandler).Name("new")
+	sub.HandleFunc("/admin/edit/{id:[1-9][0-9]*}", PageEditHandler).Name("edit")
+	sub.HandleFunc("/admin/edit/{id:[1-9][0-9]*}/preview", PagePreviewHandler).Name("preview")
+	sub.HandleFunc("/admin/cache", CacheHandler).Name("cache")
+	sub.HandleFunc("/admin/hooks", HooksHandler).Name("hooks")
+	sub.HandleFunc("/admin/linkcheck", LinkCheckHandler).Name("linkcheck")
+	sub.HandleFunc("/admin/redirects", RedirectsHandler).Name("redirects")
+	sub.HandleFunc("/admin/menu", MenuHandler).Name("menu")
+	sub.HandleFunc("/admin/menus", MenusHandler).Name("menus")
+	sub.HandleFunc("/admin/series", SeriesAdminHandler).Name("seriesadmin")
+	sub.HandleFunc("/admin/series/{id:[1-9][0-9]*}", SeriesEditHandler).Name("editseries")
+	sub.HandleFunc("/archive/", b.cached(ArchiveHandler)).Name("archive")
+	sub.HandleFunc("/series/{name:[a-z0-9]+(?:-[a-z0-9]+)*}", b.cached(SeriesViewHandler)).Name("series")
+	sub.HandleFunc("/feed.xml", b.cached(FeedHandler)).Name("feed")
+	sub.HandleFunc("/sitemap.xml", b.cached(SitemapHandler)).Name("sitemap")
 	archive, _ := sub.Get("archive").URLPath()
 	sub.Handle("/archive", http.RedirectHandler(archive.Path, http.StatusMovedPermanently))
-	sub.HandleFunc("/assets/{name}", AssetHandler)
-	sub.HandleFunc("/{name:[a-z0-9]+(?:-[a-z0-9]+)*}", PageViewHandler)
-	sub.HandleFunc("/{page:.*}", NotFound) // when no route matches: 404 error
+	sub.HandleFunc("/assets/{name}", AssetHandler).Name("asset")
+	sub.HandleFunc("/healthz", HealthHandler).Name("healthz")
+	sub.HandleFunc("/readyz", ReadyHandler).Name("readyz")
+	if b.MetricsEnabled && b.MetricsAddr == "" && b.MetricsUser != "" {
+		// Metrics on the public router need authentication (see checkConfig).
+		sub.Handle("/metrics", b.metricsHandler()).Name("metrics")
+	}
+	// Posts and pages come after all fixed routes, as a permalink pattern
+	// like /{name}/ would match /admin/ and /archive/ too.
+	sub.HandleFunc(b.postURL.route(), b.cached(PageViewHandler)).Name("post")
+	sub.HandleFunc("/{parents:(?:[a-z0-9]+(?:-[a-z0-9]+)*/)*}{name:[a-z0-9]+(?:-[a-z0-9]+)*}", b.cached(PageViewHandler)).Name("page")
+	sub.HandleFunc("/{page:.*}", NotFound).Name("notfound") // when no route matches: 404 error
 
-	b.router = csrf.Protect(b.CSRFKey, csrf.Secure(b.Secure))(b.mux)
+	b.mux.Use(metricsMiddleware)
+
+	b.router = b.logHandler(b.securityHandler(csrf.Protect(b.CSRFKey, csrf.Secure(b.Secure))(b.mux)))
 
 	return &b
 }
 
 func (b *Blog) serveCGI() {
+	b.startLogging()
+	b.redirectPermalinks()
+	b.cgi = true
 	err := cgi.Serve(b.router)
 	checkError(err, "failed to serve CGI")
+	// The process exits after the request, so hooks must finish first. Every
+	// request makes one attempt of deliveries that are due for a retry.
+	b.retryDeliveries()
+	b.hooksRunning.Wait()
 }
 
 func (b *Blog) serveFastCGI() {
+	b.startLogging()
+	b.redirectPermalinks()
+	b.retryDeliveries()
+	b.serveMetrics()
 	err := os.Remove(b.FastCGISocketPath)
 	if !os.IsNotExist(err) {
 		checkWarning(err, "could not remove existing socket file")
@@ -117,6 +184,10 @@ func (b *Blog) serveFastCGI() {
 }
 
 func (b *Blog) serveHTTP(addr string) {
+	b.startLogging()
+	b.redirectPermalinks()
+	b.retryDeliveries()
+	b.serveMetrics()
 	err := http.ListenAndServe(addr, b.router)
 	checkError(err, "could not bind to HTTP server address")
 }
@@ -148,7 +219,17 @@ func (b *Blog) SessionStore() *south.Store {
 	return b.sessionStore
 }
 
+// GetTemplate returns a parsed template. Templates are parsed once, and
+// parsed again when one of the files changed.
 func (b *Blog) GetTemplate(name string) *template.Template {
+	modified := b.GetTemplateModified(name)
+
+	b.templateLock.Lock()
+	defer b.templateLock.Unlock()
+	if t, ok := b.templates[name]; ok && t.modified.Equal(modified) {
+		return t.tpl
+	}
+
 	tplData := b.getTemplateData(name)
 
 	tpl := template.New(tplData.name)
@@ -157,6 +238,7 @@ func (b *Blog) GetTemplate(name string) *template.Template {
 	_, err := tpl.ParseFiles(tplData.files...)
 	checkError(err, "failed to parse template")
 
+	b.templates[name] = &parsedTemplate{tpl: tpl, modified: modified}
 	return tpl
 }
 
@@ -171,7 +253,7 @@ func (b *Blog) GetTemplateModified(name string) time.Time {
 		t = lastTime(t, st.ModTime())
 	}
 
-	return t
+	return lastTime(t, b.shortcodesModified())
 }
 
 // loadSkin reads info about templates if it hasn't been loaded
@@ -180,6 +262,7 @@ func (b *Blog) loadSkin() {
 		return
 	}
 	b.skinPages = make(map[string]SkinPage)
+	b.skinCSP = make(map[string][]string)
 
 	skin := b.Skin
 	for skin != "" {
@@ -194,6 +277,17 @@ func (b *Blog) loadSkin() {
 		err = json.Unmarshal(buf, &skinJson)
 		checkError(err, "failed to parse skin configuration file")
 
+		// Skins without a version are versioned by the modification time of
+		// their configuration file.
+		version := skinJson.Version
+		if version == "" {
+			st, err := f.Stat()
+			checkError(err, "failed to stat skin configuration file")
+			version = strconv.FormatInt(st.ModTime().Unix(), 10)
+		}
+		b.skinVersion += skin + "@" + version + " "
+		f.Close()
+
 		for name, page := range skinJson.Pages {
 			if _, ok := b.skinPages[name]; !ok {
 				page.skin = skin
@@ -208,6 +302,10 @@ func (b *Blog) loadSkin() {
 			b.extraJS = append(b.extraJS, js)
 		}
 
+		for directive, sources := range skinJson.CSP {
+			b.skinCSP[directive] = append(b.skinCSP[directive], sources...)
+		}
+
 		if skinJson.Icons != nil {
 			b.icons = skinJson.Icons
 		}
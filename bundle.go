@@ -0,0 +1,141 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/evanw/esbuild/pkg/api"
+)
+
+// JS_BUNDLE is the logical asset name of common.js plus all extraJS scripts,
+// bundled into one file.
+const JS_BUNDLE = "bundle.js"
+
+// bundleJS bundles common.js and the extraJS scripts of all skins into one
+// file. The scripts are concatenated, so their top-level functions and
+// variables are visible to each other, like the globals of separate scripts.
+// ES module imports are resolved like SCSS imports: in the skin of the
+// importing file first, and then in its parent skins. Imports in the scripts
+// themselves are resolved from the root of the skins, as the scripts are part
+// of the bundle. In development mode the output isn't minified and contains
+// an inline source map.
+func (b *Blog) bundleJS() ([]byte, error) {
+	b.loadSkin()
+
+	var entry strings.Builder
+	for _, name := range append([]string{"common.js"}, b.extraJS...) {
+		p, err := b.resolveSkinFile(name, "")
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&entry, "// %s\n%s\n", name, data)
+	}
+
+	options := api.BuildOptions{
+		Stdin: &api.StdinOptions{
+			Contents:   entry.String(),
+			ResolveDir: path.Join(b.BlogPath, "skins", b.skins[0]),
+			Sourcefile: JS_BUNDLE,
+			Loader:     api.LoaderJS,
+		},
+		AbsWorkingDir:     path.Join(b.BlogPath, "skins"),
+		Outfile:           JS_BUNDLE,
+		Bundle:            true,
+		Write:             false,
+		Format:            api.FormatIIFE,
+		Target:            api.ES2017,
+		MinifyWhitespace:  !b.Dev,
+		MinifyIdentifiers: !b.Dev,
+		MinifySyntax:      !b.Dev,
+		LogLevel:          api.LogLevelSilent,
+		Plugins:           []api.Plugin{b.skinResolverPlugin()},
+	}
+	if b.Dev {
+		options.Sourcemap = api.SourceMapInline
+		options.SourcesContent = api.SourcesContentInclude
+	}
+
+	result := api.Build(options)
+	if len(result.Errors) != 0 {
+		var msgs []string
+		for _, msg := range result.Errors {
+			if msg.Location != nil {
+				msgs = append(msgs, fmt.Sprintf("%s:%d:%d: %s", msg.Location.File, msg.Location.Line, msg.Location.Column+1, msg.Text))
+			} else {
+				msgs = append(msgs, msg.Text)
+			}
+		}
+		return nil, errors.New(strings.Join(msgs, "\n"))
+	}
+	for _, file := range result.OutputFiles {
+		if path.Base(file.Path) == JS_BUNDLE {
+			return file.Contents, nil
+		}
+	}
+	return nil, errors.New("bundler did not produce " + JS_BUNDLE)
+}
+
+// skinResolverPlugin resolves all imports in the skin directories.
+func (b *Blog) skinResolverPlugin() api.Plugin {
+	return api.Plugin{
+		Name: "skins",
+		Setup: func(build api.PluginBuild) {
+			build.OnResolve(api.OnResolveOptions{Filter: ".*"}, func(args api.OnResolveArgs) (api.OnResolveResult, error) {
+				p, err := b.resolveSkinFile(args.Path, args.Importer)
+				if err != nil {
+					return api.OnResolveResult{}, err
+				}
+				return api.OnResolveResult{Path: p}, nil
+			})
+		},
+	}
+}
+
+// resolveSkinFile finds the file for an import. Relative imports (./x.js)
+// are relative to the importing file, other imports are relative to the skin
+// root. The skin of the importer is searched first, then its parents.
+func (b *Blog) resolveSkinFile(spec, importer string) (string, error) {
+	skinsDir := path.Join(b.BlogPath, "skins")
+
+	// Find the skin and the directory (inside the skin) of the importer.
+	start, dir := 0, ""
+	if rel, err := filepath.Rel(skinsDir, importer); err == nil && !strings.HasPrefix(rel, "..") {
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		for i, skin := range b.skins {
+			if skin == parts[0] && len(parts) == 2 {
+				start, dir = i, path.Dir(parts[1])
+			}
+		}
+	}
+
+	name := spec
+	if strings.HasPrefix(spec, "./") || strings.HasPrefix(spec, "../") {
+		name = path.Join(dir, spec)
+	}
+	name = path.Clean(name)
+	if path.IsAbs(name) || strings.HasPrefix(name, "..") {
+		return "", fmt.Errorf("import %q is outside the skin directory", spec)
+	}
+
+	candidates := []string{name}
+	if path.Ext(name) == "" {
+		candidates = append(candidates, name+".js", name+".mjs")
+	}
+	for _, skin := range b.skins[start:] {
+		for _, candidate := range candidates {
+			p := path.Join(skinsDir, skin, candidate)
+			if st, err := os.Stat(p); err == nil && !st.IsDir() {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("could not find %q in skins %s", spec, strings.Join(b.skins[start:], ", "))
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// pageCache stores the rendered output of public pages in memory, gzip
+// compressed, keyed by skin and URL path. The whole cache is cleared when a
+// page that is visible to the public changes. An entry is dropped when its
+// templates or the asset manifest changed since it was rendered.
+//
+// Pages with a CSP nonce are stored uncompressed, split at the nonce, as every
+// response needs a new nonce. They're compressed for every response.
+//
+// Like the metrics, the cache is kept per process, so it has no effect in
+// CGI mode.
+type pageCache struct {
+	lock          sync.Mutex
+	entries       map[string]*cacheEntry
+	generation    uint64 // incremented on every invalidation
+	hits          uint64
+	misses        uint64
+	stale         uint64 // entries dropped because a template changed
+	invalidations uint64
+	lastCleared   time.Time
+}
+
+type cacheEntry struct {
+	body             []byte   // gzip compressed, for pages without a CSP nonce
+	parts            [][]byte // for pages with a CSP nonce: the page split at the nonce
+	size             int      // uncompressed size
+	contentType      string
+	cacheControl     string
+	etag             string
+	lastModified     time.Time
+	tpl              string // template name, if rendered from a template
+	templateModified time.Time
+	manifestModified time.Time
+	created          time.Time
+	hits             uint64
+}
+
+// cacheSlot is stored in the request context by a cached handler, so the
+// response can be added to the cache once it is rendered.
+type cacheSlot struct {
+	key        string
+	generation uint64
+}
+
+type cacheSlotKey struct{}
+
+// parsedTemplate is a template in the template cache.
+type parsedTemplate struct {
+	tpl      *template.Template
+	modified time.Time
+	paired   bool // shortcode templates: whether it has a closing tag
+}
+
+func newPageCache() *pageCache {
+	return &pageCache{entries: make(map[string]*cacheEntry)}
+}
+
+// invalidate clears the whole cache. Responses that are being rendered while
+// the cache is invalidated won't be stored.
+func (c *pageCache) invalidate() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = make(map[string]*cacheEntry)
+	c.generation++
+	c.invalidations++
+	c.lastCleared = time.Now()
+}
+
+// get returns a valid entry for the key, or nil.
+func (c *pageCache) get(key string) *cacheEntry {
+	c.lock.Lock()
+	e := c.entries[key]
+	c.lock.Unlock()
+
+	// Check the templates outside the lock, as it needs to stat files.
+	if e != nil && !e.valid() {
+		c.lock.Lock()
+		if c.entries[key] == e {
+			delete(c.entries, key)
+			c.stale++
+		}
+		c.lock.Unlock()
+		e = nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e == nil {
+		c.misses++
+		metricPageCache.WithLabelValues("miss").Inc()
+		return nil
+	}
+	c.hits++
+	e.hits++
+	metricPageCache.WithLabelValues("hit").Inc()
+	return e
+}
+
+// store adds a response to the cache, unless the cache has been invalidated
+// since the request started.
+func (c *pageCache) store(slot *cacheSlot, e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if slot.generation != c.generation {
+		return
+	}
+	c.entries[slot.key] = e
+}
+
+// valid returns false when the templates or the asset manifest of the entry
+// changed.
+func (e *cacheEntry) valid() bool {
+	if e.tpl != "" && !blog.GetTemplateModified(e.tpl).Equal(e.templateModified) {
+		return false
+	}
+	return blog.assetManifest().modified.Equal(e.manifestModified)
+}
+
+// cached wraps a public handler with the page cache. A cached response is
+// served without running the handler (and thus without querying the
+// database).
+func (b *Blog) cached(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !b.PageCache || (r.Method != "GET" && r.Method != "HEAD") {
+			handler(w, r)
+			return
+		}
+
+		key := b.Skin + ":" + r.URL.Path
+		if e := b.cache.get(key); e != nil {
+			e.serve(w, r)
+			return
+		}
+
+		b.cache.lock.Lock()
+		slot := &cacheSlot{key, b.cache.generation}
+		b.cache.lock.Unlock()
+		handler(w, r.WithContext(context.WithValue(r.Context(), cacheSlotKey{}, slot)))
+	}
+}
+
+// storeCached adds a rendered response to the page cache, if the request
+// came through a cached handler.
+func storeCached(r *http.Request, e *cacheEntry, body []byte) {
+	slot, ok := r.Context().Value(cacheSlotKey{}).(*cacheSlot)
+	if !ok {
+		return
+	}
+	if nonce := cspNonce(r); nonce != "" && bytes.Contains(body, []byte(nonce)) {
+		e.parts = bytes.Split(body, []byte(nonce))
+	} else {
+		e.body = compress("gzip", body, true)
+	}
+	e.size = len(body)
+	e.created = time.Now()
+	if e.tpl != "" {
+		e.templateModified = blog.GetTemplateModified(e.tpl)
+	}
+	e.manifestModified = blog.assetManifest().modified
+	blog.cache.store(slot, e)
+}
+
+// serve writes a cached response, with the same headers as the original.
+func (e *cacheEntry) serve(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", e.cacheControl)
+	h.Set("ETag", e.etag)
+	addVary(h, "Accept-Encoding")
+
+	if notModified(r, e.etag, e.lastModified) {
+		h.Del("Content-Security-Policy")
+		w.WriteHeader(304) // Not Modified
+		return
+	}
+
+	h.Set("Content-Type", e.contentType)
+	h.Set("Last-Modified", httpLastModified(e.lastModified))
+	var body []byte
+	if e.parts != nil {
+		// The nonce of this response, as set in its Content-Security-Policy
+		// header.
+		body = writeEncoded(w, r, bytes.Join(e.parts, []byte(cspNonce(r))))
+	} else {
+		body = e.body
+		if negotiateEncoding(r, []string{"gzip"}) == "gzip" {
+			h.Set("Content-Encoding", "gzip")
+		} else {
+			gz, err := gzip.NewReader(bytes.NewReader(body))
+			checkError(err, "could not read cached page")
+			body, err = ioutil.ReadAll(gz)
+			checkError(err, "could not decompress cached page")
+		}
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
+
+// storedSize returns the size of the entry in memory.
+func (e *cacheEntry) storedSize() int {
+	size := len(e.body)
+	for _, part := range e.parts {
+		size += len(part)
+	}
+	return size
+}
+
+// CacheEntryStats describes one cache entry on the stats page.
+type CacheEntryStats struct {
+	Key        string
+	Size       int
+	StoredSize int // compressed, unless the page has a CSP nonce
+	Hits       uint64
+	Created    time.Time
+}
+
+// CacheStats is a snapshot of the cache counters for the stats page.
+type CacheStats struct {
+	Enabled       bool
+	Entries       []CacheEntryStats
+	Size          int
+	StoredSize    int
+	Hits          uint64
+	Misses        uint64
+	Stale         uint64
+	Invalidations uint64
+	LastCleared   time.Time
+	Templates     []string
+}
+
+func (c *pageCache) stats() *CacheStats {
+	c.lock.Lock()
+	s := &CacheStats{
+		Enabled:       blog.PageCache,
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Stale:         c.stale,
+		Invalidations: c.invalidations,
+		LastCleared:   c.lastCleared,
+	}
+	for key, e := range c.entries {
+		s.Entries = append(s.Entries, CacheEntryStats{key, e.size, e.storedSize(), e.hits, e.created})
+		s.Size += e.size
+		s.StoredSize += e.storedSize()
+	}
+	c.lock.Unlock()
+	sort.Slice(s.Entries, func(i, j int) bool {
+		return s.Entries[i].Key < s.Entries[j].Key
+	})
+
+	blog.templateLock.Lock()
+	for name := range blog.templates {
+		s.Templates = append(s.Templates, name)
+	}
+	blog.templateLock.Unlock()
+	sort.Strings(s.Templates)
+	return s
+}
+
+// HitRatio returns the percentage of cache lookups that were a hit.
+func (s *CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses) * 100
+}
+
+// CacheHandler shows the cache statistics, and clears the cache on request.
+func CacheHandler(w http.ResponseWriter, r *http.Request) {
+	res := NewAuthenticatedResponse(w, r)
+	if res == nil {
+		return
+	}
+
+	if r.Method == "POST" {
+		if r.PostFormValue("clear") != "" {
+			blog.cache.invalidate()
+			blog.templateLock.Lock()
+			blog.templates = make(map[string]*parsedTemplate)
+			blog.templateLock.Unlock()
+		}
+		w.Header().Set("Location", r.URL.String())
+		w.WriteHeader(303)
+		return
+	}
+
+	res.tpl = "cache"
+	res.data["title"] = "Cache"
+	res.data["stats"] = blog.cache.stats()
+	res.Output(w, r, time.Time{})
+}
@@ -30,19 +30,101 @@ func init() {
 	// loop: http://code.google.com/p/go/issues/detail?id=1817
 	// (This works as intended and is not a bug in the compiler.)
 	cmds := map[string]Command{
-		"fcgi":    Command{commandFastCGI, 0, "Run FastCGI server"},
-		"http":    Command{commandHTTP, 1, "Run HTTP server\nUsage: http <host>:<port>"},
-		"help":    Command{commandList, 0, "List all available commands"},
-		"install": Command{commandInstall, 0, "Install blog"},
-		"import":  Command{commandImportDB, 1, "Import stored data from folder - overwrites existing data!"},
-		"export":  Command{commandExportDB, 1, "Export stored data to folder - overwrites existing data!"},
-		"adduser": Command{commandAddUser, 2, "Add user to the database.\nUsage: adduser <email> <fullname>"},
-		"keygen":  Command{commandKeygen, 0, "Create (or overwrite) session key."},
-		"secure":  Command{commandSecure, 1, "Toggle security setting (on, off)"},
+		"fcgi":          Command{commandFastCGI, 0, "Run FastCGI server"},
+		"http":          Command{commandHTTP, 1, "Run HTTP server\nUsage: http <host>:<port>"},
+		"https":         Command{commandHTTPS, 1, "Run HTTPS server (using tls-cert/tls-key or ACME)\nUsage: https <host>:<port>"},
+		"help":          Command{commandList, 0, "List all available commands"},
+		"install":       Command{commandInstall, 0, "Install blog"},
+		"import":        Command{commandImportDB, 1, "Import stored data from folder - overwrites existing data!"},
+		"export":        Command{commandExportDB, 1, "Export stored data to folder - overwrites existing data!"},
+		"adduser":       Command{commandAddUser, 2, "Add user to the database.\nUsage: adduser <email> <fullname>"},
+		"keygen":        Command{commandKeygen, 0, "Create (or overwrite) session key."},
+		"secure":        Command{commandSecure, 1, "Toggle security setting (on, off)"},
+		"check":         Command{commandCheck, 0, "Check config, database, skin and webroot; exits non-zero on failure"},
+		"build-assets":  Command{commandBuildAssets, 0, "Compile, minify and fingerprint all skin CSS/JS into the webroot"},
+		"generate":      Command{commandGenerate, 1, "Generate a static copy of all public pages and assets (only writes what changed)\nUsage: generate <outdir>"},
+		"highlight-css": Command{commandHighlightCSS, 1, "Print the stylesheet for highlighted code in a chroma style, for use in a skin\nUsage: highlight-css <style>"},
+		"linkcheck":     Command{commandLinkCheck, 1, "Check links, images and footnotes in all pages; exits non-zero on problems\nUsage: linkcheck <internal|all> (all also requests external links)"},
 	}
 	commands = cmds
 }
 
+type dbColumn struct {
+	name     string
+	datatype string
+}
+
+// The structure of the SQL tables.
+var dbTables = map[string][]dbColumn{
+	"pages": {
+		{"id", "INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL"},
+		{"text", "TEXT DEFAULT ''"},
+		{"name", "TEXT DEFAULT ''"}, // unique for posts, and for pages with the same parent
+		{"title", "TEXT DEFAULT ''"},
+		{"type", "INTEGER DEFAULT 0"},
+		{"summary", "TEXT DEFAULT ''"},
+		{"created", "INTEGER DEFAULT 0"},
+		{"published", "INTEGER DEFAULT 0"},
+		{"modified", "INTEGER DEFAULT 0"},
+		{"author", "INTEGER DEFAULT 0"},
+		{"toc", "INTEGER DEFAULT 0"},
+		{"parent", "INTEGER DEFAULT 0"},
+		{"position", "INTEGER DEFAULT 0"},
+		{"hidden", "INTEGER DEFAULT 0"},
+		{"series", "INTEGER DEFAULT 0"},
+	},
+	"users": {
+		{"id", "INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL"},
+		{"email", "TEXT UNIQUE"},
+		{"passwordHash", "TEXT"},
+		{"fullname", "VARCHAR DEFAULT ''"},
+	},
+	"redirects": {
+		{"id", "INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL"},
+		{"path", "TEXT UNIQUE DEFAULT ''"},
+		{"page", "INTEGER DEFAULT 0"},
+		{"target", "TEXT DEFAULT ''"},
+		{"created", "INTEGER DEFAULT 0"},
+	},
+	"menu_items": {
+		{"id", "INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL"},
+		{"menu", "TEXT DEFAULT ''"},
+		{"position", "INTEGER DEFAULT 0"},
+		{"page", "INTEGER DEFAULT 0"},
+		{"target", "TEXT DEFAULT ''"},
+		{"title", "TEXT DEFAULT ''"},
+		{"modified", "INTEGER DEFAULT 0"},
+	},
+	"series": {
+		{"id", "INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL"},
+		{"name", "TEXT UNIQUE DEFAULT ''"},
+		{"title", "TEXT DEFAULT ''"},
+		{"description", "TEXT DEFAULT ''"},
+		{"created", "INTEGER DEFAULT 0"},
+		{"modified", "INTEGER DEFAULT 0"},
+	},
+	"post_links": {
+		{"page", "INTEGER UNIQUE DEFAULT 0"},
+		{"previous", "INTEGER DEFAULT 0"},
+		{"next", "INTEGER DEFAULT 0"},
+		{"related", "TEXT DEFAULT ''"},
+		{"modified", "INTEGER DEFAULT 0"},
+	},
+	"hook_deliveries": {
+		{"id", "INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL"},
+		{"hook", "TEXT DEFAULT ''"},
+		{"event", "TEXT DEFAULT ''"},
+		{"page", "INTEGER DEFAULT 0"},
+		{"title", "TEXT DEFAULT ''"},
+		{"payload", "TEXT DEFAULT ''"},
+		{"status", "TEXT DEFAULT ''"},
+		{"attempts", "INTEGER DEFAULT 0"},
+		{"error", "TEXT DEFAULT ''"},
+		{"created", "INTEGER DEFAULT 0"},
+		{"updated", "INTEGER DEFAULT 0"},
+	},
+}
+
 func commandFastCGI(_ []string) {
 	blog.serveFastCGI()
 }
@@ -51,6 +133,10 @@ func commandHTTP(args []string) {
 	blog.serveHTTP(args[0])
 }
 
+func commandHTTPS(args []string) {
+	blog.serveHTTPS(args[0])
+}
+
 func commandList(_ []string) {
 	fmt.Println("Available commands:")
 	names := make([]string, 0, len(commands))
@@ -64,32 +150,16 @@ func commandList(_ []string) {
 	}
 }
 
-func commandInstall(_ []string) {
-	// The structure of the SQL table.
-	tables := map[string][]struct {
-		name     string
-		datatype string
-	}{
-		"pages": {
-			{"id", "INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL"},
-			{"text", "TEXT DEFAULT ''"},
-			{"name", "TEXT UNIQUE DEFAULT ''"},
-			{"title", "TEXT DEFAULT ''"},
-			{"type", "INTEGER DEFAULT 0"},
-			{"summary", "TEXT DEFAULT ''"},
-			{"created", "INTEGER DEFAULT 0"},
-			{"published", "INTEGER DEFAULT 0"},
-			{"modified", "INTEGER DEFAULT 0"},
-			{"author", "INTEGER DEFAULT 0"},
-		},
-		"users": {
-			{"id", "INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL"},
-			{"email", "TEXT UNIQUE"},
-			{"passwordHash", "TEXT"},
-			{"fullname", "VARCHAR DEFAULT ''"},
-		},
+// createTableSql returns the SQL statement to create a table.
+func createTableSql(name string, columns []dbColumn) string {
+	var columnsSql []string
+	for _, column := range columns {
+		columnsSql = append(columnsSql, column.name+" "+column.datatype)
 	}
+	return "CREATE TABLE " + name + " (" + strings.Join(columnsSql, ", ") + ")"
+}
 
+func commandInstall(_ []string) {
 	// Queries that must be executed after the tables have been installed.
 	// None of these queries should have any effect when they're run multiple
 	// times.
@@ -123,17 +193,11 @@ func commandInstall(_ []string) {
 	}
 
 	// Insert all missing tables, and update outdated tables.
-	for name, columns := range tables {
+	for name, columns := range dbTables {
 		if !tablesInDB[name] {
 			// Table does not exist, add it now.
-			var columnsSql []string
-			for _, column := range columns {
-				columnsSql = append(columnsSql, column.name+" "+column.datatype)
-			}
-
-			createTableSql := "CREATE TABLE " + name + " (" + strings.Join(columnsSql, ", ") + ")"
 			fmt.Println("Creating table:", name)
-			_, err := blog.db.Exec(createTableSql)
+			_, err := blog.db.Exec(createTableSql(name, columns))
 			checkError(err, "could not create table '"+name+"'")
 
 			continue
@@ -162,6 +226,35 @@ func commandInstall(_ []string) {
 		}
 	}
 
+	// Page names used to be unique, but pages only need a name that's unique
+	// between pages with the same parent. SQLite can't drop a constraint, so
+	// the table is copied.
+	var pagesSql string
+	err = blog.db.QueryRow("SELECT sql FROM sqlite_master WHERE type='table' AND name='pages'").Scan(&pagesSql)
+	checkError(err, "could not fetch structure of table 'pages'")
+	if strings.Contains(pagesSql, "name TEXT UNIQUE") {
+		fmt.Println("Removing unique constraint from table 'pages': name")
+		var columns []string
+		for _, column := range dbTables["pages"] {
+			columns = append(columns, column.name)
+		}
+		columnList := strings.Join(columns, ", ")
+		tx, err := blog.db.Begin()
+		checkError(err, "could not start transaction")
+		for _, query := range []string{
+			createTableSql("pages_new", dbTables["pages"]),
+			"INSERT INTO pages_new (" + columnList + ") SELECT " + columnList + " FROM pages",
+			// Keep the ids of deleted pages from being used again.
+			"UPDATE sqlite_sequence SET seq=(SELECT seq FROM sqlite_sequence WHERE name='pages') WHERE name='pages_new'",
+			"DROP TABLE pages",
+			"ALTER TABLE pages_new RENAME TO pages",
+		} {
+			_, err := tx.Exec(query)
+			checkError(err, "could not copy table 'pages' (SQL: "+query+")")
+		}
+		checkError(tx.Commit(), "could not copy table 'pages'")
+	}
+
 	// Apply all fixups. These may be needed after updates.
 	for _, fixup := range fixups {
 		result, err := blog.db.Exec(fixup.sql)
@@ -174,6 +267,9 @@ func commandInstall(_ []string) {
 		}
 	}
 
+	blog.redirectPermalinks()
+	blog.updatePostLinks(true)
+
 	// Generate public/private key pair if it does not yet exist.
 	if len(blog.SessionKey) != south.KeySize {
 		fmt.Println("Generating session sign key")
@@ -396,6 +492,42 @@ func commandSecure(args []string) {
 	blog.Config.Update()
 }
 
+func commandCheck(_ []string) {
+	ds := blog.checkDiagnostics()
+	fmt.Print(ds.String())
+	if ds.Failed() {
+		os.Exit(1)
+	}
+}
+
+func commandBuildAssets(_ []string) {
+	blog.buildAssets()
+}
+
+func commandGenerate(args []string) {
+	blog.generate(args[0])
+}
+
+func commandHighlightCSS(args []string) {
+	css, err := highlightCSS(args[0])
+	checkError(err, "could not create stylesheet")
+	os.Stdout.Write(css)
+}
+
+func commandLinkCheck(args []string) {
+	if args[0] != "internal" && args[0] != "all" {
+		fmt.Fprintln(os.Stderr, "Usage: linkcheck <internal|all>")
+		os.Exit(1)
+	}
+	problems := blog.checkLinks(args[0] == "all")
+	for _, p := range problems {
+		fmt.Printf("%s: %s %s: %s\n", p.Page.Url(), p.Kind, p.Target, p.Problem)
+	}
+	if len(problems) != 0 {
+		os.Exit(1)
+	}
+}
+
 func (b *Blog) handleCLI() {
 	if len(os.Args) == 0 {
 		panic("os.Args should have at least one element")
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings supported for responses, in order of preference. The empty
+// string is the identity coding (no compression).
+var encodings = []string{"br", "gzip"}
+
+// encodingExtensions are the file extensions of precompressed assets.
+var encodingExtensions = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// negotiateEncoding returns the best content coding out of available that the
+// client accepts according to Accept-Encoding, or "" for identity.
+// See https://tools.ietf.org/html/rfc7231#section-5.3.4
+func negotiateEncoding(r *http.Request, available []string) string {
+	header := strings.Join(r.Header.Values("Accept-Encoding"), ",")
+	if strings.TrimSpace(header) == "" {
+		return ""
+	}
+
+	qvalues := make(map[string]float64)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = v
+				}
+			}
+		}
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		qvalues[coding] = q
+	}
+
+	qvalue := func(coding string) float64 {
+		if q, ok := qvalues[coding]; ok {
+			return q
+		}
+		if q, ok := qvalues["*"]; ok {
+			return q
+		}
+		return 0
+	}
+
+	// Identity is acceptable unless excluded. When the client doesn't list
+	// it (or *), it's only used when none of the listed codings is available.
+	// Compression is preferred over identity with the same qvalue, and
+	// earlier codings in available over later ones.
+	best, bestQ := "", math.SmallestNonzeroFloat64
+	_, listed := qvalues["identity"]
+	if _, ok := qvalues["*"]; listed || ok {
+		bestQ = qvalue("identity")
+	}
+	for _, coding := range available {
+		if q := qvalue(coding); q > 0 && (q > bestQ || q == bestQ && best == "") {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// compress encodes data using the given content coding. Dynamic responses
+// use a moderate compression level to keep them fast, precompressed files
+// (best is true) use the best compression.
+func compress(coding string, data []byte, best bool) []byte {
+	var buf bytes.Buffer
+	switch coding {
+	case "":
+		return data
+	case "gzip":
+		level := gzip.DefaultCompression
+		if best {
+			level = gzip.BestCompression
+		}
+		gz, err := gzip.NewWriterLevel(&buf, level)
+		checkError(err, "could not create gzip writer")
+		_, err = gz.Write(data)
+		checkError(err, "could not gzip response")
+		checkError(gz.Close(), "could not gzip response")
+	case "br":
+		level := 5
+		if best {
+			level = brotli.BestCompression
+		}
+		br := brotli.NewWriterLevel(&buf, level)
+		_, err := br.Write(data)
+		checkError(err, "could not brotli compress response")
+		checkError(br.Close(), "could not brotli compress response")
+	default:
+		raiseError("unknown content coding " + coding)
+	}
+	return buf.Bytes()
+}
+
+// writeEncoded compresses a response body as negotiated with the client, sets
+// the Content-Encoding and Content-Length headers and returns the body to
+// send.
+func writeEncoded(w http.ResponseWriter, r *http.Request, data []byte) []byte {
+	h := w.Header()
+	coding := negotiateEncoding(r, encodings)
+	data = compress(coding, data, false)
+	if coding != "" {
+		h.Set("Content-Encoding", coding)
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	return data
+}
+
+// addVary adds a header name to the Vary header, if it isn't there already.
+func addVary(h http.Header, name string) {
+	for _, value := range h.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
@@ -13,6 +13,8 @@ const CONFIG_PATH = "/etc/blog.json"
 const DB_PATH = "/data/blog.sqlite3"
 const IMPORT_PATH = "github.com/aykevl/blog"
 const FCGI_PATH = "/.blog-fcgi.sock"
+const ACME_CACHE_PATH = "/data/acme"
+const DIAGRAM_CACHE_PATH = "/data/diagrams"
 
 type Config struct {
 	// non-configuration variables
@@ -27,22 +29,58 @@ type Config struct {
 
 type ConfigData struct {
 	// configuration variables
-	Skin               string `json:"skin"`                    // skin, default is "base"
-	SiteTitle          string `json:"title"`                   // blog title, default is "Blog"
-	Logo               string `json:"logo"`                    // Logo in the top-left of the page, default is "/assets/logo.png"
-	WebRoot            string `json:"webroot"`                 // like "/var/www"
-	BlogPath           string `json:"blogpath"`                // full path of source directory
-	URLPrefix          string `json:"urlprefix"`               // for example "/blog", may be empty (default)
-	AssetsPrefix       string `json:"assets"`                  // Assets root, default is "/assets"
-	Origin             string `json:"origin"`                  // start of URL, for example "http://example.com"
-	Secure             bool   `json:"secure"`                  // all requests go over a secure connection
-	HSTSMaxAge         int    `json:"hsts-max-age"`            // HTTP Strict Transport Security max-age (in seconds, 0 to disable)
-	HSTSIncludeSubs    bool   `json:"hsts-include-subdomains"` // add includeSubDomains
-	DatabaseType       string `json:"database-type"`           // for example "sqlite3"
-	DatabaseConnection string `json:"database-connect"`        // for example path to sqlite3 file
-	SessionKey         []byte `json:"sessionkey"`              // 32-byte random base64-encoded key used to sign session cookies
-	CSRFKey            []byte `json:"csrfkey"`                 // 32-byte token for Gorilla CSRF
-	FastCGISocketPath  string `json:"fcgi-path"`               // FastCGI socket path
+	Skin               string              `json:"skin"`                    // skin, default is "base"
+	SiteTitle          string              `json:"title"`                   // blog title, default is "Blog"
+	Logo               string              `json:"logo"`                    // Logo in the top-left of the page, default is "/assets/logo.png"
+	WebRoot            string              `json:"webroot"`                 // like "/var/www"
+	BlogPath           string              `json:"blogpath"`                // full path of source directory
+	URLPrefix          string              `json:"urlprefix"`               // for example "/blog", may be empty (default)
+	AssetsPrefix       string              `json:"assets"`                  // Assets root, default is "/assets"
+	Origin             string              `json:"origin"`                  // start of URL, for example "http://example.com"
+	Secure             bool                `json:"secure"`                  // all requests go over a secure connection
+	HSTSMaxAge         int                 `json:"hsts-max-age"`            // HTTP Strict Transport Security max-age (in seconds, 0 to disable)
+	HSTSIncludeSubs    bool                `json:"hsts-include-subdomains"` // add includeSubDomains
+	DatabaseType       string              `json:"database-type"`           // for example "sqlite3"
+	DatabaseConnection string              `json:"database-connect"`        // for example path to sqlite3 file
+	SessionKey         []byte              `json:"sessionkey"`              // 32-byte random base64-encoded key used to sign session cookies
+	CSRFKey            []byte              `json:"csrfkey"`                 // 32-byte token for Gorilla CSRF
+	FastCGISocketPath  string              `json:"fcgi-path"`               // FastCGI socket path
+	TLSCertFile        string              `json:"tls-cert"`                // PEM certificate (chain) for the https command
+	TLSKeyFile         string              `json:"tls-key"`                 // PEM private key for the https command
+	HTTPRedirectAddr   string              `json:"http-redirect-addr"`      // address like ":80" to redirect HTTP to HTTPS, empty to disable
+	ACME               bool                `json:"acme"`                    // fetch certificates automatically using ACME (instead of tls-cert/tls-key)
+	ACMEDomains        []string            `json:"acme-domains"`            // domains to request certificates for, default is the origin host
+	ACMEEmail          string              `json:"acme-email"`              // contact address for the ACME account, may be empty
+	ACMEDirectory      string              `json:"acme-directory"`          // ACME directory URL, default is Let's Encrypt
+	ACMECAFile         string              `json:"acme-ca-file"`            // extra CA certificate to trust for the ACME directory (e.g. Pebble)
+	ACMECacheDir       string              `json:"acme-cache"`              // directory where certificates and keys are stored
+	CSPEnabled         bool                `json:"csp-enabled"`             // send a Content-Security-Policy header
+	CSP                map[string][]string `json:"csp"`                     // CSP directives and their sources, merged with the defaults
+	FrameAncestors     string              `json:"frame-ancestors"`         // CSP frame-ancestors (and X-Frame-Options), default "'none'"
+	NoSniff            bool                `json:"nosniff"`                 // send X-Content-Type-Options: nosniff
+	ReferrerPolicy     string              `json:"referrer-policy"`         // Referrer-Policy header, empty to disable
+	PermissionsPolicy  string              `json:"permissions-policy"`      // Permissions-Policy header, empty to disable
+	LogFormat          string              `json:"log-format"`              // "logfmt" (default) or "json"
+	LogLevel           string              `json:"log-level"`               // "debug", "info" (default), "warn" or "error"
+	LogFile            string              `json:"log-file"`                // file to append logs to, default is stderr
+	MetricsEnabled     bool                `json:"metrics"`                 // serve Prometheus metrics at /metrics
+	MetricsAddr        string              `json:"metrics-addr"`            // separate address like "127.0.0.1:9100" for /metrics, empty to use the blog router
+	MetricsUser        string              `json:"metrics-user"`            // HTTP basic auth user for /metrics, empty to disable auth (only with metrics-addr)
+	MetricsPassword    string              `json:"metrics-password"`        // HTTP basic auth password for /metrics
+	Dev                bool                `json:"dev"`                     // development mode: detailed errors in the browser, don't store compiled assets on errors
+	BundleJS           bool                `json:"bundle-js"`               // serve common.js and all extraJS as one minified bundle.js
+	PageCache          bool                `json:"page-cache"`              // cache rendered public pages in memory
+	Hooks              []HookConfig        `json:"hooks"`                   // commands or webhooks to run on page events (create, update, publish, unpublish, delete)
+	MarkdownExtensions []string            `json:"markdown-extensions"`     // table, autolink, footnote, strikethrough, tasklist, definition-list, typographer, heading-anchors, highlight, math, diagrams (math and diagrams are off by default, as they change how existing text is shown)
+	HighlightStyle     string              `json:"highlight-style"`         // chroma style for highlighted code in the feed (pages use the skin stylesheet)
+	GraphvizDot        string              `json:"graphviz-dot"`            // dot program for diagrams, the built-in layout is used if it isn't installed or this is empty
+	DiagramCache       string              `json:"diagram-cache"`           // directory where rendered diagrams are stored
+	Permalink          string              `json:"permalink"`               // URL of posts, like "/{year}/{month}/{name}" (default), "/posts/{name}" or "/{id}-{name}"
+	PermalinkActive    string              `json:"permalink-active"`        // permalink the current URLs were made with (set automatically, to redirect old URLs when permalink changes)
+	LinkCheckWorkers   int                 `json:"linkcheck-concurrency"`   // number of external links checked at the same time
+	LinkCheckTimeout   int                 `json:"linkcheck-timeout"`       // timeout for checking an external link in seconds
+	Menus              []string            `json:"menus"`                   // names of the navigation menus the skin shows, like "header" and "footer"
+	RelatedPosts       int                 `json:"related-posts"`           // number of related posts shown below a post, 0 to disable
 }
 
 func loadConfig(root string) *Config {
@@ -61,7 +99,35 @@ func loadConfig(root string) *Config {
 	c.DatabaseType = "sqlite3"
 	c.DatabaseConnection = root + DB_PATH
 	c.FastCGISocketPath = root + FCGI_PATH
-
+	c.ACMECacheDir = root + ACME_CACHE_PATH
+	c.CSPEnabled = true
+	c.CSP = map[string][]string{
+		"default-src": {"'self'"},
+		"script-src":  {"'self'"},
+		"style-src":   {"'self'"},
+		"img-src":     {"'self'", "data:", "https:"},
+		"object-src":  {"'none'"},
+		"base-uri":    {"'self'"},
+		"form-action": {"'self'"},
+	}
+	c.FrameAncestors = "'none'"
+	c.NoSniff = true
+	c.ReferrerPolicy = "strict-origin-when-cross-origin"
+	c.PermissionsPolicy = "camera=(), microphone=(), geolocation=()"
+	c.LogFormat = "logfmt"
+	c.LogLevel = "info"
+
+	c.PageCache = true
+	c.MarkdownExtensions = []string{"table", "autolink", "footnote", "highlight"}
+	c.HighlightStyle = "github"
+	c.GraphvizDot = "dot"
+	c.DiagramCache = root + DIAGRAM_CACHE_PATH
+	c.Permalink = DEFAULT_PERMALINK
+	c.PermalinkActive = DEFAULT_PERMALINK
+	c.LinkCheckWorkers = 4
+	c.LinkCheckTimeout = 10
+	c.Menus = []string{"header", "footer"}
+	c.RelatedPosts = 3
 	c.load(root)
 
 	c.OriginURL, err = url.Parse(c.Origin)
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Fenced code blocks tagged dot (or graphviz) are rendered as inline SVG
+// diagrams. The dot program of Graphviz is used when it is installed (see
+// graphviz-dot in the configuration), otherwise the graph is drawn by the
+// built-in layout engine in dotlayout.go.
+//
+// Rendered diagrams are stored in diagram-cache, by a hash of the renderer and
+// the source, so a page only runs dot when a diagram changed.
+
+// DIAGRAM_LAYOUT_VERSION is part of the cache key of diagrams drawn by the
+// built-in layout engine. Increment it when the output changes.
+const DIAGRAM_LAYOUT_VERSION = "1"
+
+var kindDiagram = ast.NewNodeKind("Diagram")
+
+type diagramBlock struct {
+	ast.BaseBlock
+	source []byte
+}
+
+func (n *diagramBlock) Kind() ast.NodeKind {
+	return kindDiagram
+}
+
+func (n *diagramBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, nil, nil)
+}
+
+// dotProgram returns the path of the dot program, or "" if it isn't
+// installed (lazy load).
+func (b *Blog) dotProgram() string {
+	b.dotOnce.Do(func() {
+		if b.GraphvizDot == "" {
+			return
+		}
+		p, err := exec.LookPath(b.GraphvizDot)
+		if err != nil {
+			if logger != nil {
+				logger.Info("dot not found, using the built-in diagram layout", "graphviz-dot", b.GraphvizDot)
+			}
+			return
+		}
+		b.dotPath = p
+	})
+	return b.dotPath
+}
+
+// renderDiagram returns the SVG for a DOT graph, from the cache if possible.
+func (b *Blog) renderDiagram(src []byte) ([]byte, error) {
+	dot := b.dotProgram()
+	renderer := "builtin " + DIAGRAM_LAYOUT_VERSION
+	if dot != "" {
+		renderer = "dot " + dot
+	}
+	hash := sha256.Sum256(append([]byte(renderer+"\x00"), src...))
+	key := hex.EncodeToString(hash[:])
+	cachePath := filepath.Join(b.DiagramCache, key+".svg")
+
+	if b.DiagramCache != "" {
+		if svg, err := ioutil.ReadFile(cachePath); err == nil {
+			metricDiagrams.WithLabelValues("cached").Inc()
+			return svg, nil
+		}
+	}
+
+	var svg []byte
+	var err error
+	if dot != "" {
+		svg, err = runDot(dot, src)
+	} else {
+		svg, err = layoutDot(string(src), key[:8])
+	}
+	if err != nil {
+		metricDiagrams.WithLabelValues("error").Inc()
+		return nil, err
+	}
+	metricDiagrams.WithLabelValues("rendered").Inc()
+
+	if b.DiagramCache != "" {
+		if err := os.MkdirAll(b.DiagramCache, 0777); err != nil {
+			checkWarning(err, "could not create diagram cache")
+		} else {
+			writeFileAtomic(cachePath, svg)
+		}
+	}
+	return svg, nil
+}
+
+// runDot renders a graph with the dot program. Only the <svg> element of the
+// output is returned, without the XML declaration and doctype.
+func runDot(dot string, src []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, dot, "-Tsvg")
+	cmd.Stdin = bytes.NewReader(src)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := bytes.TrimSpace(stderr.Bytes()); len(msg) != 0 {
+			return nil, errors.New(string(msg))
+		}
+		return nil, err
+	}
+	start := bytes.Index(out, []byte("<svg"))
+	if start < 0 {
+		return nil, errors.New("dot did not output SVG")
+	}
+	svg := append([]byte(`<svg class="diagram"`), out[start+len("<svg"):]...)
+	return svg, nil
+}
+
+type diagramTransformer struct{}
+
+// Transform replaces fenced code blocks tagged dot by diagrams.
+func (t *diagramTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	var blocks []*ast.FencedCodeBlock
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if code, ok := n.(*ast.FencedCodeBlock); ok && entering {
+			if lang := string(code.Language(source)); lang == "dot" || lang == "graphviz" {
+				blocks = append(blocks, code)
+			}
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, code := range blocks {
+		diagram := &diagramBlock{}
+		lines := code.Lines()
+		for i := 0; i < lines.Len(); i++ {
+			line := lines.At(i)
+			diagram.source = append(diagram.source, line.Value(source)...)
+		}
+		code.Parent().ReplaceChild(code.Parent(), code, diagram)
+	}
+}
+
+type diagramRenderer struct{}
+
+func (r *diagramRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindDiagram, r.render)
+}
+
+// render writes the diagram. Errors are shown above the source (like in the
+// preview), so they can be fixed by the author.
+func (r *diagramRenderer) render(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*diagramBlock)
+	svg, err := blog.renderDiagram(n.source)
+	if err != nil {
+		w.WriteString(`<p class="error">` + template.HTMLEscapeString("diagram: "+err.Error()) + "</p>\n")
+		w.WriteString("<pre><code>" + template.HTMLEscapeString(string(n.source)) + "</code></pre>\n")
+		return ast.WalkSkipChildren, nil
+	}
+	w.WriteString(`<div class="diagram">`)
+	w.Write(svg)
+	w.WriteString("</div>\n")
+	return ast.WalkSkipChildren, nil
+}
+
+// diagrams is the goldmark extension for diagrams.
+var diagrams = &diagramExtension{}
+
+type diagramExtension struct{}
+
+func (e *diagramExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(&diagramTransformer{}, 500)))
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(&diagramRenderer{}, 500)))
+}
@@ -0,0 +1,757 @@
+package main
+
+// A small layout engine for Graphviz DOT graphs, used to render diagrams when
+// the dot program isn't installed.
+//
+// It draws graphs in layers like dot does: cycles are broken by reversing
+// edges, nodes get a rank by the longest path from a source, edges spanning
+// more than one rank get virtual nodes, the nodes in each rank are ordered to
+// reduce crossings (barycenter heuristic) and then placed near their
+// neighbours. It supports rankdir, node labels, shapes (box, ellipse, circle,
+// diamond, point, plaintext), colors, the filled, dashed, dotted, bold,
+// rounded and invis styles, edge labels and dir. Clusters, ports, records and
+// HTML labels are not supported; their nodes are drawn as plain nodes.
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/awalterschulze/gographviz"
+)
+
+const (
+	dotFontSize  = 14
+	dotCharWidth = 7.5 // average width of a character at dotFontSize
+	dotLineSpace = 17
+	dotRankSep   = 40
+	dotNodeSep   = 20
+	dotMargin    = 4
+	dotLoopSize  = 24
+)
+
+type dotNode struct {
+	name    string
+	label   []string
+	shape   string
+	style   string
+	color   string
+	fill    string
+	font    string
+	w, h    float64 // size in the layout direction (swapped for LR)
+	x, y    float64 // center
+	rank    int
+	order   int
+	virtual bool
+	loops   int // number of edges to itself
+	in, out []*dotNode
+}
+
+type dotEdge struct {
+	label    []string
+	color    string
+	style    string
+	head     bool // arrow at the target
+	tail     bool // arrow at the source
+	path     []*dotNode
+	reversed bool // reversed to break a cycle
+	loop     bool
+	offset   float64 // to separate edges between the same nodes
+}
+
+var dotErrorRegexp = regexp.MustCompile(`^Error in S\d+: (.*?)\(\d+,.*\), Pos\(offset=\d+, line=(\d+), column=(\d+)\), (expected one of: .*?)\s*$`)
+
+// dotSyntaxError makes the errors of the DOT parser readable.
+func dotSyntaxError(err error) error {
+	m := dotErrorRegexp.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	return fmt.Errorf("syntax error at line %s, column %s: unexpected %s, %s", m[2], m[3], m[1], m[4])
+}
+
+// dotAttr returns an attribute without quotes and escapes.
+func dotAttr(attrs gographviz.Attrs, name string) string {
+	value, ok := attrs[gographviz.Attr(name)]
+	if !ok {
+		return ""
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+		value = strings.Replace(value, "\\\"", "\"", -1)
+		value = strings.Replace(value, "\\\n", "", -1) // line continuation
+	}
+	return value
+}
+
+// dotLabel splits a label in lines.
+func dotLabel(label string) []string {
+	label = strings.NewReplacer(`\l`, `\n`, `\r`, `\n`).Replace(label)
+	label = strings.TrimSuffix(label, `\n`)
+	return strings.Split(label, `\n`)
+}
+
+// dotColor returns a color that is safe to use in SVG, or def.
+func dotColor(color, def string) string {
+	if color == "" {
+		return def
+	}
+	for _, c := range color {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '#') {
+			return def
+		}
+	}
+	return color
+}
+
+func hasStyle(style, name string) bool {
+	for _, s := range strings.Split(style, ",") {
+		if strings.TrimSpace(s) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// layoutDot renders a DOT graph as SVG. id is used to make the ids in the
+// SVG unique on a page.
+func layoutDot(src, id string) ([]byte, error) {
+	g, err := gographviz.Read([]byte(src))
+	if err != nil {
+		return nil, dotSyntaxError(err)
+	}
+	if len(g.Nodes.Nodes) == 0 {
+		return nil, errors.New("graph has no nodes")
+	}
+	rankdir := strings.ToUpper(dotAttr(g.Attrs, "rankdir"))
+	horizontal := rankdir == "LR" || rankdir == "RL"
+
+	// Nodes
+	var nodes []*dotNode
+	byName := make(map[string]*dotNode)
+	for _, n := range g.Nodes.Nodes {
+		node := &dotNode{
+			name:  n.Name,
+			shape: strings.ToLower(dotAttr(n.Attrs, "shape")),
+			style: dotAttr(n.Attrs, "style"),
+			color: dotColor(dotAttr(n.Attrs, "color"), "black"),
+			font:  dotColor(dotAttr(n.Attrs, "fontcolor"), "black"),
+		}
+		label := dotAttr(n.Attrs, "label")
+		if _, ok := n.Attrs["label"]; !ok {
+			label = strings.Trim(n.Name, `"`)
+		}
+		node.label = dotLabel(label)
+		if hasStyle(node.style, "filled") {
+			node.fill = dotColor(dotAttr(n.Attrs, "fillcolor"), "")
+			if node.fill == "" {
+				node.fill = dotColor(dotAttr(n.Attrs, "color"), "lightgrey")
+			}
+		}
+		node.sizeFor(horizontal)
+		nodes = append(nodes, node)
+		byName[n.Name] = node
+	}
+
+	// Edges
+	var edges []*dotEdge
+	for _, e := range g.Edges.Edges {
+		src, dst := byName[e.Src], byName[e.Dst]
+		if src == nil || dst == nil {
+			continue // edges from or to subgraphs
+		}
+		edge := &dotEdge{
+			label: dotLabel(dotAttr(e.Attrs, "label")),
+			color: dotColor(dotAttr(e.Attrs, "color"), "black"),
+			style: dotAttr(e.Attrs, "style"),
+			head:  g.Directed,
+		}
+		if _, ok := e.Attrs["label"]; !ok {
+			edge.label = nil
+		}
+		switch dotAttr(e.Attrs, "dir") {
+		case "back":
+			edge.head, edge.tail = false, true
+		case "both":
+			edge.head, edge.tail = true, true
+		case "none":
+			edge.head = false
+		case "forward":
+			edge.head = true
+		}
+		if hasStyle(edge.style, "invis") {
+			continue
+		}
+		if src == dst {
+			edge.loop = true
+			edge.path = []*dotNode{src}
+			src.loops++
+		} else {
+			edge.path = []*dotNode{src, dst}
+		}
+		edges = append(edges, edge)
+	}
+
+	breakCycles(nodes, edges)
+	rankNodes(nodes, edges)
+	ranks := addVirtualNodes(nodes, edges)
+	separateEdges(edges)
+	orderRanks(ranks)
+	placeNodes(ranks)
+
+	// Size of the layout, in the layout direction.
+	var width, height float64
+	for _, rank := range ranks {
+		for _, n := range rank {
+			width = math.Max(width, n.x+n.w/2+float64(n.loops)*dotLoopSize)
+			height = math.Max(height, n.y+n.h/2)
+		}
+	}
+
+	// Transform to the final direction.
+	transform := func(x, y float64) (float64, float64) {
+		switch rankdir {
+		case "BT":
+			return x, height - y
+		case "LR":
+			return y, x
+		case "RL":
+			return height - y, x
+		}
+		return x, y
+	}
+	if horizontal {
+		width, height = height, width
+	}
+
+	return writeDotSVG(g, nodes, edges, transform, horizontal, width, height, id), nil
+}
+
+// sizeFor sets the size of a node from its label and shape.
+func (n *dotNode) sizeFor(horizontal bool) {
+	longest := 0
+	for _, line := range n.label {
+		if l := len([]rune(line)); l > longest {
+			longest = l
+		}
+	}
+	w := float64(longest)*dotCharWidth + 16
+	h := float64(len(n.label))*dotLineSpace + 10
+	switch n.shape {
+	case "point":
+		w, h = 8, 8
+	case "plaintext", "plain", "none":
+	case "circle", "doublecircle":
+		w = math.Max(w, h) * 1.2
+		h = w
+	case "diamond":
+		w, h = w*1.8, h*1.8
+	case "box", "rect", "rectangle", "square", "record", "mrecord", "note", "tab", "folder", "component":
+		w, h = math.Max(w, 54), math.Max(h, 36)
+	default: // ellipse
+		w, h = math.Max(w*1.3, 54), math.Max(h*1.3, 36)
+	}
+	if horizontal {
+		w, h = h, w
+	}
+	n.w, n.h = w, h
+}
+
+// breakCycles reverses edges that go back to a node that is being visited in
+// a depth-first search, so that the graph has no cycles.
+func breakCycles(nodes []*dotNode, edges []*dotEdge) {
+	out := make(map[*dotNode][]*dotEdge)
+	for _, e := range edges {
+		if !e.loop {
+			out[e.path[0]] = append(out[e.path[0]], e)
+		}
+	}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*dotNode]int)
+	var visit func(n *dotNode)
+	visit = func(n *dotNode) {
+		state[n] = visiting
+		for _, e := range out[n] {
+			dst := e.path[1]
+			switch state[dst] {
+			case visiting:
+				e.reversed = true
+				e.path[0], e.path[1] = e.path[1], e.path[0]
+			case unvisited:
+				visit(dst)
+			}
+		}
+		state[n] = visited
+	}
+	for _, n := range nodes {
+		if state[n] == unvisited {
+			visit(n)
+		}
+	}
+}
+
+// rankNodes gives every node the rank of the longest path from a source.
+func rankNodes(nodes []*dotNode, edges []*dotEdge) {
+	indegree := make(map[*dotNode]int)
+	out := make(map[*dotNode][]*dotNode)
+	for _, e := range edges {
+		if !e.loop {
+			indegree[e.path[1]]++
+			out[e.path[0]] = append(out[e.path[0]], e.path[1])
+		}
+	}
+	var queue []*dotNode
+	for _, n := range nodes {
+		if indegree[n] == 0 {
+			queue = append(queue, n)
+		}
+	}
+	for len(queue) != 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for _, dst := range out[n] {
+			if n.rank+1 > dst.rank {
+				dst.rank = n.rank + 1
+			}
+			indegree[dst]--
+			if indegree[dst] == 0 {
+				queue = append(queue, dst)
+			}
+		}
+	}
+}
+
+// addVirtualNodes splits edges that span more than one rank, and returns the
+// nodes per rank.
+func addVirtualNodes(nodes []*dotNode, edges []*dotEdge) [][]*dotNode {
+	var ranks [][]*dotNode
+	add := func(n *dotNode) {
+		for len(ranks) <= n.rank {
+			ranks = append(ranks, nil)
+		}
+		n.order = len(ranks[n.rank])
+		ranks[n.rank] = append(ranks[n.rank], n)
+	}
+	for _, n := range nodes {
+		add(n)
+	}
+	for _, e := range edges {
+		if e.loop {
+			continue
+		}
+		src, dst := e.path[0], e.path[1]
+		path := []*dotNode{src}
+		for rank := src.rank + 1; rank < dst.rank; rank++ {
+			v := &dotNode{virtual: true, rank: rank, w: dotNodeSep / 2}
+			add(v)
+			path = append(path, v)
+		}
+		path = append(path, dst)
+		for i := 0; i+1 < len(path); i++ {
+			path[i].out = append(path[i].out, path[i+1])
+			path[i+1].in = append(path[i+1].in, path[i])
+		}
+		e.path = path
+	}
+	return ranks
+}
+
+// separateEdges gives edges between the same two nodes (in either direction)
+// an offset, so they don't overlap.
+func separateEdges(edges []*dotEdge) {
+	groups := make(map[[2]*dotNode][]*dotEdge)
+	for _, e := range edges {
+		if len(e.path) == 2 {
+			key := [2]*dotNode{e.path[0], e.path[1]}
+			groups[key] = append(groups[key], e)
+		}
+	}
+	for _, group := range groups {
+		for i, e := range group {
+			e.offset = (float64(i) - float64(len(group)-1)/2) * 12
+		}
+	}
+}
+
+// crossings counts the edge crossings between rank and the next rank.
+func crossings(rank []*dotNode) int {
+	type pair struct{ a, b int }
+	var pairs []pair
+	for _, n := range rank {
+		for _, m := range n.out {
+			pairs = append(pairs, pair{n.order, m.order})
+		}
+	}
+	count := 0
+	for i := range pairs {
+		for j := i + 1; j < len(pairs); j++ {
+			if (pairs[i].a-pairs[j].a)*(pairs[i].b-pairs[j].b) < 0 {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func totalCrossings(ranks [][]*dotNode) int {
+	count := 0
+	for _, rank := range ranks {
+		count += crossings(rank)
+	}
+	return count
+}
+
+// orderRanks orders the nodes in each rank by the average position of their
+// neighbours (sweeping down and up), and keeps the order with the fewest
+// crossings.
+func orderRanks(ranks [][]*dotNode) {
+	save := func() [][]*dotNode {
+		saved := make([][]*dotNode, len(ranks))
+		for i, rank := range ranks {
+			saved[i] = append([]*dotNode(nil), rank...)
+		}
+		return saved
+	}
+	best, bestCrossings := save(), totalCrossings(ranks)
+
+	barycenter := func(n *dotNode, neighbours []*dotNode) float64 {
+		if len(neighbours) == 0 {
+			return float64(n.order)
+		}
+		sum := 0.0
+		for _, m := range neighbours {
+			sum += float64(m.order)
+		}
+		return sum / float64(len(neighbours))
+	}
+	sortRank := func(rank []*dotNode, down bool) {
+		weights := make(map[*dotNode]float64)
+		for _, n := range rank {
+			if down {
+				weights[n] = barycenter(n, n.in)
+			} else {
+				weights[n] = barycenter(n, n.out)
+			}
+		}
+		sort.SliceStable(rank, func(i, j int) bool {
+			return weights[rank[i]] < weights[rank[j]]
+		})
+		for i, n := range rank {
+			n.order = i
+		}
+	}
+
+	for iteration := 0; iteration < 12 && bestCrossings != 0; iteration++ {
+		if iteration%2 == 0 {
+			for i := 1; i < len(ranks); i++ {
+				sortRank(ranks[i], true)
+			}
+		} else {
+			for i := len(ranks) - 2; i >= 0; i-- {
+				sortRank(ranks[i], false)
+			}
+		}
+		if c := totalCrossings(ranks); c < bestCrossings {
+			best, bestCrossings = save(), c
+		}
+	}
+
+	for i := range ranks {
+		ranks[i] = best[i]
+		for j, n := range ranks[i] {
+			n.order = j
+		}
+	}
+}
+
+// placeNodes sets the coordinates of all nodes: ranks from top to bottom, and
+// nodes in a rank placed near the average position of their neighbours.
+func placeNodes(ranks [][]*dotNode) {
+	y := float64(dotMargin)
+	for _, rank := range ranks {
+		height := 0.0
+		for _, n := range rank {
+			height = math.Max(height, n.h)
+		}
+		x := float64(dotMargin)
+		for _, n := range rank {
+			n.y = y + height/2
+			n.x = x + n.w/2
+			x += n.w + dotNodeSep + float64(n.loops)*dotLoopSize
+		}
+		y += height + dotRankSep
+	}
+
+	separation := func(a, b *dotNode) float64 {
+		return a.w/2 + b.w/2 + dotNodeSep + float64(a.loops)*dotLoopSize
+	}
+	for iteration := 0; iteration < 8; iteration++ {
+		order := make([]int, len(ranks))
+		for i := range order {
+			order[i] = i
+		}
+		if iteration%2 == 1 {
+			for i, j := 0, len(order)-1; i < j; i, j = i+1, j-1 {
+				order[i], order[j] = order[j], order[i]
+			}
+		}
+		for _, r := range order {
+			rank := ranks[r]
+			pos := make([]float64, len(rank))
+			for i, n := range rank {
+				neighbours := append(append([]*dotNode(nil), n.in...), n.out...)
+				pos[i] = n.x
+				if len(neighbours) != 0 {
+					sum := 0.0
+					for _, m := range neighbours {
+						sum += m.x
+					}
+					pos[i] = sum / float64(len(neighbours))
+				}
+			}
+			for i := 1; i < len(rank); i++ {
+				pos[i] = math.Max(pos[i], pos[i-1]+separation(rank[i-1], rank[i]))
+			}
+			for i := len(rank) - 2; i >= 0; i-- {
+				pos[i] = math.Min(pos[i], pos[i+1]-separation(rank[i], rank[i+1]))
+			}
+			for i, n := range rank {
+				n.x = pos[i]
+			}
+		}
+	}
+
+	// Move everything to the left margin.
+	left := math.Inf(1)
+	for _, rank := range ranks {
+		for _, n := range rank {
+			left = math.Min(left, n.x-n.w/2)
+		}
+	}
+	for _, rank := range ranks {
+		for _, n := range rank {
+			n.x += float64(dotMargin) - left
+		}
+	}
+}
+
+// clip returns the point where the line from the center of n to (x, y)
+// crosses the border of n, in the layout direction.
+func (n *dotNode) clip(x, y float64) (float64, float64) {
+	if n.virtual {
+		return n.x, n.y
+	}
+	dx, dy := x-n.x, y-n.y
+	if dx == 0 && dy == 0 {
+		return n.x, n.y
+	}
+	rx, ry := n.w/2, n.h/2
+	var t float64
+	switch n.shape {
+	case "box", "rect", "rectangle", "square", "record", "mrecord", "note", "tab", "folder", "component", "plaintext", "plain", "none":
+		t = math.Min(rx/math.Abs(dx), ry/math.Abs(dy))
+	case "diamond":
+		t = 1 / (math.Abs(dx)/rx + math.Abs(dy)/ry)
+	default:
+		t = 1 / math.Sqrt(dx*dx/(rx*rx)+dy*dy/(ry*ry))
+	}
+	return n.x + dx*t, n.y + dy*t
+}
+
+type svgWriter struct {
+	strings.Builder
+}
+
+func (w *svgWriter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(w, format, args...)
+}
+
+func svgEscape(s string) string {
+	return template.HTMLEscapeString(s)
+}
+
+// strokeAttrs returns the SVG attributes for a DOT style.
+func strokeAttrs(style string) string {
+	attrs := ""
+	if hasStyle(style, "dashed") {
+		attrs += ` stroke-dasharray="5,2"`
+	}
+	if hasStyle(style, "dotted") {
+		attrs += ` stroke-dasharray="1,3"`
+	}
+	if hasStyle(style, "bold") {
+		attrs += ` stroke-width="2"`
+	}
+	return attrs
+}
+
+func writeDotSVG(g *gographviz.Graph, nodes []*dotNode, edges []*dotEdge, transform func(x, y float64) (float64, float64), horizontal bool, width, height float64, id string) []byte {
+	label := dotAttr(g.Attrs, "label")
+	var labelLines []string
+	if label != "" {
+		labelLines = dotLabel(label)
+	}
+	totalHeight := height + dotMargin + float64(len(labelLines))*dotLineSpace
+	totalWidth := width + dotMargin
+	for _, line := range labelLines {
+		totalWidth = math.Max(totalWidth, float64(len([]rune(line)))*dotCharWidth+2*dotMargin)
+	}
+
+	w := &svgWriter{}
+	// Only presentation attributes are used, no style attributes, so that the
+	// SVG works with the Content-Security-Policy.
+	w.printf(`<svg xmlns="http://www.w3.org/2000/svg" class="diagram" width="%.0f" height="%.0f" viewBox="0 0 %.0f %.0f" font-family="sans-serif" font-size="%d">`+"\n",
+		totalWidth, totalHeight, totalWidth, totalHeight, dotFontSize)
+
+	// One arrowhead marker per edge color.
+	markers := make(map[string]string)
+	var colors []string
+	for _, e := range edges {
+		if _, ok := markers[e.color]; !ok && (e.head || e.tail) {
+			markers[e.color] = fmt.Sprintf("arrow-%s-%d", id, len(markers))
+			colors = append(colors, e.color)
+		}
+	}
+	if len(colors) != 0 {
+		w.printf("<defs>")
+		for _, color := range colors {
+			w.printf(`<marker id="%s" viewBox="0 0 10 10" refX="9" refY="5" markerWidth="8" markerHeight="8" markerUnits="userSpaceOnUse" orient="auto-start-reverse"><path d="M0,0L10,5L0,10z" fill="%s"/></marker>`, markers[color], color)
+		}
+		w.printf("</defs>\n")
+	}
+
+	for _, e := range edges {
+		w.writeEdge(e, transform, horizontal, markers[e.color])
+	}
+	for _, n := range nodes {
+		w.writeNode(n, transform, horizontal)
+	}
+
+	for i, line := range labelLines {
+		w.printf(`<text x="%.1f" y="%.1f" text-anchor="middle" dominant-baseline="central">%s</text>`+"\n",
+			totalWidth/2, height+dotMargin+(float64(i)+0.5)*dotLineSpace, svgEscape(line))
+	}
+	w.printf("</svg>\n")
+	return []byte(w.String())
+}
+
+func (w *svgWriter) writeEdge(e *dotEdge, transform func(x, y float64) (float64, float64), horizontal bool, marker string) {
+	var d string
+	var labelX, labelY float64
+	if e.loop {
+		n := e.path[0]
+		x, y := transform(n.x, n.y)
+		rx, ry := n.w/2, n.h/2
+		if horizontal {
+			rx, ry = ry, rx
+		}
+		d = fmt.Sprintf("M%.1f,%.1fC%.1f,%.1f %.1f,%.1f %.1f,%.1f", x+rx*0.7, y-ry*0.7, x+rx+dotLoopSize, y-ry-8, x+rx+dotLoopSize, y+ry+8, x+rx*0.7, y+ry*0.7)
+		labelX, labelY = x+rx+dotLoopSize+2, y
+	} else {
+		path := e.path
+		// Points in the layout direction: the nodes, with the ends clipped at
+		// the border of the source and target node.
+		xs := make([]float64, len(path))
+		ys := make([]float64, len(path))
+		for i, n := range path {
+			xs[i], ys[i] = n.x, n.y
+		}
+		last := len(path) - 1
+		xs[0], ys[0] = path[0].clip(path[1].x, path[1].y)
+		xs[last], ys[last] = path[last].clip(path[last-1].x, path[last-1].y)
+		xs[0] += e.offset
+		xs[last] += e.offset
+
+		// Curves with tangents in the rank direction, like dot draws them.
+		var b strings.Builder
+		point := func(cmd string, x, y float64) {
+			x, y = transform(x, y)
+			fmt.Fprintf(&b, "%s%.1f,%.1f", cmd, x, y)
+		}
+		if e.reversed {
+			for i, j := 0, last; i < j; i, j = i+1, j-1 {
+				xs[i], xs[j] = xs[j], xs[i]
+				ys[i], ys[j] = ys[j], ys[i]
+			}
+		}
+		point("M", xs[0], ys[0])
+		for i := 1; i <= last; i++ {
+			mid := (ys[i-1] + ys[i]) / 2
+			point("C", xs[i-1], mid)
+			point(" ", xs[i], mid)
+			point(" ", xs[i], ys[i])
+		}
+		d = b.String()
+		mid := last / 2
+		labelX, labelY = transform((xs[mid]+xs[last-mid])/2, (ys[mid]+ys[last-mid])/2)
+		labelX += 4
+	}
+
+	w.printf(`<path d="%s" fill="none" stroke="%s"%s`, d, e.color, strokeAttrs(e.style))
+	if e.head && marker != "" {
+		w.printf(` marker-end="url(#%s)"`, marker)
+	}
+	if e.tail && marker != "" {
+		w.printf(` marker-start="url(#%s)"`, marker)
+	}
+	w.printf("/>\n")
+
+	for i, line := range e.label {
+		y := labelY + (float64(i)-float64(len(e.label)-1)/2)*dotLineSpace
+		w.printf(`<text x="%.1f" y="%.1f" dominant-baseline="central" font-size="%d">%s</text>`+"\n", labelX, y, dotFontSize-2, svgEscape(line))
+	}
+}
+
+func (w *svgWriter) writeNode(n *dotNode, transform func(x, y float64) (float64, float64), horizontal bool) {
+	if hasStyle(n.style, "invis") {
+		return
+	}
+	x, y := transform(n.x, n.y)
+	width, height := n.w, n.h
+	if horizontal {
+		width, height = height, width
+	}
+	fill := n.fill
+	if fill == "" {
+		fill = "none"
+	}
+	stroke := fmt.Sprintf(` fill="%s" stroke="%s"%s`, fill, n.color, strokeAttrs(n.style))
+
+	w.printf("<g><title>%s</title>", svgEscape(strings.Trim(n.name, `"`)))
+	switch n.shape {
+	case "plaintext", "plain", "none":
+		if n.fill != "" {
+			w.printf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`, x-width/2, y-height/2, width, height, n.fill)
+		}
+	case "box", "rect", "rectangle", "square", "record", "mrecord", "note", "tab", "folder", "component":
+		rounded := ""
+		if hasStyle(n.style, "rounded") || n.shape == "mrecord" {
+			rounded = ` rx="6"`
+		}
+		w.printf(`<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f"%s%s/>`, x-width/2, y-height/2, width, height, rounded, stroke)
+	case "diamond":
+		w.printf(`<polygon points="%.1f,%.1f %.1f,%.1f %.1f,%.1f %.1f,%.1f"%s/>`, x, y-height/2, x+width/2, y, x, y+height/2, x-width/2, y, stroke)
+	case "point":
+		w.printf(`<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s" stroke="%s"/>`, x, y, width/2, n.color, n.color)
+	case "doublecircle":
+		w.printf(`<circle cx="%.1f" cy="%.1f" r="%.1f"%s/>`, x, y, width/2, stroke)
+		w.printf(`<circle cx="%.1f" cy="%.1f" r="%.1f" fill="none" stroke="%s"/>`, x, y, width/2-4, n.color)
+	default:
+		w.printf(`<ellipse cx="%.1f" cy="%.1f" rx="%.1f" ry="%.1f"%s/>`, x, y, width/2, height/2, stroke)
+	}
+	if n.shape != "point" {
+		for i, line := range n.label {
+			ly := y + (float64(i)-float64(len(n.label)-1)/2)*dotLineSpace
+			w.printf(`<text x="%.1f" y="%.1f" text-anchor="middle" dominant-baseline="central" fill="%s">%s</text>`, x, ly, n.font, svgEscape(line))
+		}
+	}
+	w.printf("</g>\n")
+}
@@ -11,12 +11,19 @@ var error500Template *template.Template
 const error500TemplateText = "<h1>500 Internal Server Error</h1><p>{{.Reason}}: {{.Error}}</p>\n"
 
 func internalError(reason interface{}, err error, fatal bool) {
+	if logger != nil {
+		// Serving requests: use the structured log instead of printing.
+		logger.Error(fmt.Sprint(reason), "error", err, "fatal", fatal)
+	}
 	switch requestType() {
 	case REQUEST_TYPE_CGI:
 		fmt.Println("Status: 500")
-		fmt.Println("Content-Type: text/html; charset=utf-8\n")
+		fmt.Print("Content-Type: text/html; charset=utf-8\n\n")
 		error500Template.Execute(os.Stdout, map[string]interface{}{"Reason": reason, "Error": err})
 	case REQUEST_TYPE_CLI:
+		if logger != nil {
+			break
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s: %s\n", reason, err)
 		} else {
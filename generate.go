@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// GENERATE_STATE is the file in the output directory of the generate command
+// that lists all generated files with their entity tags, so the next run only
+// has to write what changed.
+const GENERATE_STATE = ".generated.json"
+
+// generate renders all public pages into outdir, at the same paths as their
+// routes, so the blog can be served by a plain static web server. URL paths
+// ending in a slash and paths without extension (like /docs/install) are
+// stored as index.html in a directory of that name, so pages can have
+// subpages. Most web servers redirect /docs/install to /docs/install/ then; to
+// serve the page at its own URL, try the index.html file first (nginx:
+// try_files $uri $uri/index.html =404).
+//
+// Generation is incremental: every page is requested with the ETag and the
+// modification time of the file that is already there, and only written when
+// the response isn't 304 Not Modified. Written files get the Last-Modified
+// time of the page. Files of pages that are no longer published are removed.
+func (b *Blog) generate(outdir string) {
+	statePath := filepath.Join(outdir, GENERATE_STATE)
+	state := make(map[string]string) // file -> ETag
+	if buf, err := ioutil.ReadFile(statePath); err == nil {
+		checkError(json.Unmarshal(buf, &state), "could not parse "+GENERATE_STATE)
+	} else if !os.IsNotExist(err) {
+		checkError(err, "could not read "+GENERATE_STATE)
+	}
+	checkError(os.MkdirAll(outdir, 0777), "could not create output directory")
+
+	// Assets are built first, into the webroot (with the asset manifest that
+	// the generated pages refer to), and copied from there.
+	b.buildAssets()
+	copied := copyChangedFiles(path.Join(b.WebRoot, b.AssetsPrefix), filepath.Join(outdir, filepath.FromSlash(b.URLPrefix+b.AssetsPrefix)))
+
+	var urls []string
+	for _, name := range []string{"index", "archive", "feed", "sitemap"} {
+		u, err := b.mux.Get(name).URLPath()
+		checkError(err, "could not build URL for route "+name)
+		urls = append(urls, u.Path)
+	}
+	for _, page := range PagesFromQuery(b, PAGE_TYPE_NONE, FETCH_TITLE, "published!=0", "ORDER BY published") {
+		urls = append(urls, b.URLPrefix+page.Url())
+	}
+	for _, series := range publicSeries(b) {
+		urls = append(urls, b.URLPrefix+series.Url())
+	}
+
+	// The web server should be configured to serve this file for missing
+	// pages (nginx: error_page 404 /404.html).
+	notFoundURL := b.URLPrefix + "/404.html"
+
+	// Remove pages that have been unpublished or renamed first, as a file
+	// may be in the way of the directory of a new page.
+	files := map[string]bool{generatedFile(notFoundURL): true}
+	for _, url := range urls {
+		files[generatedFile(url)] = true
+	}
+	var removed []string
+	for file := range state {
+		if !files[file] {
+			removed = append(removed, file)
+		}
+	}
+	sort.Strings(removed)
+	for _, file := range removed {
+		err := os.Remove(filepath.Join(outdir, filepath.FromSlash(file)))
+		if !os.IsNotExist(err) {
+			checkError(err, "could not remove "+file)
+		}
+		fmt.Println("removed:", file)
+	}
+
+	newState := make(map[string]string)
+	written, unchanged := 0, 0
+	generateURL := func(url string, status int) {
+		file := generatedFile(url)
+		p := filepath.Join(outdir, filepath.FromSlash(file))
+
+		r := httptest.NewRequest("GET", b.Origin+url, nil)
+		if st, err := os.Stat(p); err == nil {
+			if etag := state[file]; etag != "" {
+				r.Header.Set("If-None-Match", etag)
+			}
+			r.Header.Set("If-Modified-Since", httpLastModified(st.ModTime()))
+		}
+		w := httptest.NewRecorder()
+		b.mux.ServeHTTP(w, r)
+
+		if w.Code == http.StatusNotModified {
+			newState[file] = state[file]
+			unchanged++
+			return
+		}
+		if w.Code != status {
+			raiseError(fmt.Sprintf("could not generate %s: status %d", url, w.Code))
+		}
+
+		newState[file] = w.Header().Get("ETag")
+		if old, err := ioutil.ReadFile(p); err == nil && bytes.Equal(old, w.Body.Bytes()) {
+			// Pages without Last-Modified (like the 404 page) are always
+			// rendered, but only written when they changed.
+			unchanged++
+			return
+		}
+
+		checkError(os.MkdirAll(filepath.Dir(p), 0777), "could not create directory for "+file)
+		writeFileAtomic(p, w.Body.Bytes())
+		if lastModified, err := http.ParseTime(w.Header().Get("Last-Modified")); err == nil {
+			checkError(os.Chtimes(p, lastModified, lastModified), "could not set modification time of "+file)
+		}
+		written++
+		fmt.Println("generated:", file)
+	}
+
+	for _, url := range urls {
+		generateURL(url, http.StatusOK)
+	}
+	generateURL(notFoundURL, http.StatusNotFound)
+
+	buf, err := json.MarshalIndent(newState, "", "\t")
+	checkError(err, "could not serialize "+GENERATE_STATE)
+	writeFileAtomic(statePath, buf)
+
+	fmt.Printf("%d pages generated, %d unchanged, %d removed, %d assets copied\n", written, unchanged, len(removed), copied)
+}
+
+// generatedFile returns the file (relative to the output directory) that a
+// URL path is generated into.
+func generatedFile(url string) string {
+	file := strings.TrimPrefix(url, "/")
+	if file == "" || strings.HasSuffix(file, "/") {
+		return file + "index.html"
+	}
+	if path.Ext(file) == "" {
+		return file + "/index.html"
+	}
+	return file
+}
+
+// copyChangedFiles copies all files from src to dst that differ in size or
+// modification time, and returns the number of copied files. Hidden files are
+// skipped.
+func copyChangedFiles(src, dst string) int {
+	copied := 0
+	err := filepath.Walk(src, func(p string, st os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(st.Name(), ".") && p != src {
+			if st.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		out := filepath.Join(dst, rel)
+		if st.IsDir() {
+			return os.MkdirAll(out, 0777)
+		}
+		if outSt, err := os.Stat(out); err == nil && outSt.Size() == st.Size() && outSt.ModTime().Equal(st.ModTime()) {
+			return nil
+		}
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		writeFileAtomic(out, data)
+		copied++
+		return os.Chtimes(out, st.ModTime(), st.ModTime())
+	})
+	checkError(err, "could not copy assets")
+	return copied
+}
@@ -1,16 +1,37 @@
 module github.com/aykevl/blog
 
-go 1.19
+go 1.21
 
 require (
+	github.com/alecthomas/chroma/v2 v2.14.0
+	github.com/andybalholm/brotli v1.0.6
+	github.com/awalterschulze/gographviz v2.0.3+incompatible
 	github.com/aykevl/south v0.0.0-20150317135315-5a70d9e58bd4
+	github.com/evanw/esbuild v0.19.12
 	github.com/gorilla/csrf v1.7.1
 	github.com/gorilla/mux v1.7.1
 	github.com/gorilla/securecookie v1.1.1
 	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0
 	github.com/mattn/go-sqlite3 v1.14.17
-	github.com/russross/blackfriday v1.6.0
+	github.com/prometheus/client_golang v1.17.0
+	github.com/tdewolff/minify/v2 v2.12.9
+	github.com/yuin/goldmark v1.7.8
 	golang.org/x/crypto v0.11.0
 )
 
-require github.com/pkg/errors v0.9.1 // indirect
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dlclark/regexp2 v1.11.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
+	github.com/prometheus/client_model v0.4.1-0.20230718164431-9a2bf3000d16 // indirect
+	github.com/prometheus/common v0.44.0 // indirect
+	github.com/prometheus/procfs v0.11.1 // indirect
+	github.com/tdewolff/parse/v2 v2.6.8 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sys v0.11.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/aykevl/south"
+)
+
+// Diagnostic is the result of a single health check. Err is nil when the
+// check passed.
+type Diagnostic struct {
+	Name string
+	Err  error
+}
+
+type Diagnostics []Diagnostic
+
+// Failed returns true if any of the checks failed.
+func (ds Diagnostics) Failed() bool {
+	for _, d := range ds {
+		if d.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a line per check, like "database: ok".
+func (ds Diagnostics) String() string {
+	var lines []string
+	for _, d := range ds {
+		if d.Err != nil {
+			lines = append(lines, d.Name+": FAIL: "+d.Err.Error())
+		} else {
+			lines = append(lines, d.Name+": ok")
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// readinessChecks verifies that the blog can serve requests. None of these
+// checks exit the process on failure, unlike checkError.
+func (b *Blog) readinessChecks() Diagnostics {
+	return Diagnostics{
+		{"database", b.db.Ping()},
+		{"skin", b.checkSkin()},
+		{"webroot", b.checkWebRoot()},
+	}
+}
+
+// checkDiagnostics runs all checks for the check command: readiness, config
+// and database schema.
+func (b *Blog) checkDiagnostics() Diagnostics {
+	ds := Diagnostics{{"config", b.checkConfig()}}
+	ds = append(ds, b.readinessChecks()...)
+	ds = append(ds, Diagnostic{"schema", b.checkSchema()})
+	return ds
+}
+
+// checkSkin loads the skin configuration of the skin and all parents and
+// parses all templates.
+func (b *Blog) checkSkin() error {
+	pages := make(map[string]SkinPage)
+	seen := make(map[string]bool)
+	for skin := b.Skin; skin != ""; {
+		if seen[skin] {
+			return fmt.Errorf("skin %s: loop in parent skins", skin)
+		}
+		seen[skin] = true
+
+		buf, err := ioutil.ReadFile(path.Join(b.BlogPath, "skins", skin, "skin.json"))
+		if err != nil {
+			return err
+		}
+		skinJson := SkinJson{}
+		if err := json.Unmarshal(buf, &skinJson); err != nil {
+			return fmt.Errorf("skin %s: %s", skin, err)
+		}
+		for name, page := range skinJson.Pages {
+			if _, ok := pages[name]; !ok {
+				page.skin = skin
+				pages[name] = page
+			}
+		}
+		skin = skinJson.Parent
+	}
+
+	for name, page := range pages {
+		if len(page.Files) == 0 {
+			return fmt.Errorf("template %s has no files", name)
+		}
+		files := make([]string, len(page.Files))
+		for i, fn := range page.Files {
+			files[i] = path.Join(b.BlogPath, "skins", page.skin, fn)
+		}
+		_, err := template.New(page.Files[0]).Funcs(funcMap).ParseFiles(files...)
+		if err != nil {
+			return fmt.Errorf("template %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+// checkWebRoot verifies that generated assets can be written.
+func (b *Blog) checkWebRoot() error {
+	if b.WebRoot == "" {
+		return errors.New("webroot is not configured")
+	}
+	dir := path.Join(b.WebRoot, b.AssetsPrefix)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".blog-check-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkConfig validates the configuration file.
+func (b *Blog) checkConfig() error {
+	var problems []string
+	if b.OriginURL.Scheme == "" || b.OriginURL.Host == "" {
+		problems = append(problems, "origin must be an absolute URL")
+	}
+	if b.Secure && b.OriginURL.Scheme != "https" {
+		problems = append(problems, "secure is enabled but origin is not https")
+	}
+	if b.URLPrefix != "" && (!strings.HasPrefix(b.URLPrefix, "/") || strings.HasSuffix(b.URLPrefix, "/")) {
+		problems = append(problems, "urlprefix must start and not end with a slash")
+	}
+	if len(b.SessionKey) != south.KeySize {
+		problems = append(problems, "invalid sessionkey (run keygen)")
+	}
+	if len(b.CSRFKey) < 32 {
+		problems = append(problems, "invalid csrfkey (run keygen)")
+	}
+	if b.DatabaseType != "sqlite3" {
+		problems = append(problems, "unsupported database-type "+b.DatabaseType)
+	}
+	for _, fn := range []string{b.TLSCertFile, b.TLSKeyFile} {
+		if fn == "" {
+			continue
+		}
+		if _, err := os.Stat(fn); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	switch strings.ToLower(b.LogFormat) {
+	case "json", "logfmt", "text", "":
+	default:
+		problems = append(problems, "unknown log-format "+b.LogFormat)
+	}
+	if b.MetricsEnabled && b.MetricsAddr == "" && b.MetricsUser == "" {
+		problems = append(problems, "metrics on the blog router (no metrics-addr) need metrics-user and metrics-password, /metrics is not served")
+	}
+	if b.MetricsUser != "" && b.MetricsPassword == "" {
+		problems = append(problems, "metrics-user is set without metrics-password")
+	}
+	for _, name := range b.MarkdownExtensions {
+		if _, ok := markdownExtensions[name]; !ok {
+			problems = append(problems, "unknown markdown extension "+name+" (available: "+strings.Join(markdownExtensionNames(), ", ")+")")
+		}
+	}
+	if _, ok := styles.Registry[b.HighlightStyle]; !ok {
+		problems = append(problems, "unknown highlight-style "+b.HighlightStyle)
+	}
+	for _, hook := range b.Hooks {
+		if problem := hook.check(); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	if len(problems) != 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// checkSchema verifies that all tables and columns created by the install
+// command exist, which means the database is up to date with this version.
+func (b *Blog) checkSchema() error {
+	var missing []string
+	for table, columns := range dbTables {
+		rows, err := b.db.Query("SELECT * FROM " + table + " LIMIT 0")
+		if err != nil {
+			missing = append(missing, "table "+table)
+			continue
+		}
+		names, err := rows.Columns()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+		inDB := make(map[string]bool, len(names))
+		for _, name := range names {
+			inDB[name] = true
+		}
+		for _, column := range columns {
+			if !inDB[column.name] {
+				missing = append(missing, "column "+table+"."+column.name)
+			}
+		}
+	}
+
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return errors.New("missing " + strings.Join(missing, ", ") + " (run install)")
+	}
+	return nil
+}
+
+// Status returns a line per check with only its status, like
+// "database: FAIL", without the errors.
+func (ds Diagnostics) Status() string {
+	var lines []string
+	for _, d := range ds {
+		if d.Err != nil {
+			lines = append(lines, d.Name+": FAIL")
+		} else {
+			lines = append(lines, d.Name+": ok")
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// outputDiagnostics sends the status of the checks. Errors may contain file
+// paths and SQL errors, so they're logged instead (the check command shows
+// them too).
+func outputDiagnostics(w http.ResponseWriter, r *http.Request, ds Diagnostics) {
+	h := w.Header()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Cache-Control", "no-store")
+	if ds.Failed() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if logger != nil {
+		for _, d := range ds {
+			if d.Err != nil {
+				logger.Warn("health check failed", "check", d.Name, "path", r.URL.Path, "error", d.Err)
+			}
+		}
+	}
+	w.Write([]byte(ds.Status()))
+}
+
+// HealthHandler is a liveness check: it only checks the database connection.
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	outputDiagnostics(w, r, Diagnostics{{"database", blog.db.Ping()}})
+}
+
+// ReadyHandler checks whether the blog is ready to serve requests.
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	outputDiagnostics(w, r, blog.readinessChecks())
+}
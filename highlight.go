@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/util"
+)
+
+// Fenced code blocks are highlighted by the language in their info string.
+// Options follow the language, separated by spaces:
+//
+//	```go linenos hl=2,4-5 start=10
+//
+// linenos adds line numbers, hl highlights lines (by their line number, so
+// they take start into account) and start is the number of the first line.
+// Unknown languages are shown without highlighting.
+//
+// Pages are rendered with CSS classes (like <span class="k">), so skins can
+// ship a theme stylesheet; the highlight-css command writes one for any chroma
+// style. The feed is rendered with inline styles of highlight-style instead,
+// as feed readers don't load the stylesheets of the blog.
+
+// codeOptions are the options in the info string of a fenced code block.
+type codeOptions struct {
+	lineNumbers bool
+	highlight   [][2]int
+	start       int
+}
+
+// parseCodeOptions parses the options after the language in the info string.
+// Hugo style names (linenostart, hl_lines) are accepted as well, so pages can
+// be moved between both.
+func parseCodeOptions(fields []string) (*codeOptions, error) {
+	opts := &codeOptions{start: 1}
+	for _, field := range fields {
+		key, value := field, ""
+		if i := strings.IndexByte(field, '='); i >= 0 {
+			key, value = field[:i], strings.Trim(field[i+1:], `"'`)
+		}
+		switch key {
+		case "linenos":
+			opts.lineNumbers = value == "" || value == "true" || value == "table" || value == "inline"
+		case "start", "linenostart":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid start line " + strconv.Quote(value))
+			}
+			opts.start = n
+		case "hl", "hl_lines":
+			for _, r := range strings.FieldsFunc(value, func(c rune) bool { return c == ',' || c == ' ' }) {
+				from, to := r, r
+				if i := strings.IndexByte(r, '-'); i >= 0 {
+					from, to = r[:i], r[i+1:]
+				}
+				a, err1 := strconv.Atoi(from)
+				b, err2 := strconv.Atoi(to)
+				if err1 != nil || err2 != nil || a > b {
+					return nil, errors.New("invalid line range " + strconv.Quote(r))
+				}
+				opts.highlight = append(opts.highlight, [2]int{a, b})
+			}
+		default:
+			return nil, errors.New("unknown option " + strconv.Quote(key))
+		}
+	}
+	return opts, nil
+}
+
+// highlightCode writes code as highlighted HTML. With classes false, the
+// colors of style are set in style attributes.
+func highlightCode(buf *bytes.Buffer, code, language string, opts *codeOptions, classes bool, style string) error {
+	lexer := lexers.Get(language)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, code)
+	if err != nil {
+		return err
+	}
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(classes),
+		chromahtml.TabWidth(4),
+		chromahtml.WithLineNumbers(opts.lineNumbers),
+		chromahtml.LineNumbersInTable(true), // so copying the code doesn't copy the numbers
+		chromahtml.BaseLineNumber(opts.start),
+		chromahtml.HighlightLines(opts.highlight),
+	)
+	return formatter.Format(buf, highlightStyle(style), iterator)
+}
+
+// highlightStyle returns the chroma style with this name, or the default style.
+func highlightStyle(name string) *chroma.Style {
+	if style, ok := styles.Registry[name]; ok {
+		return style
+	}
+	return styles.Fallback
+}
+
+// highlightCSS returns the stylesheet for the classes of highlighted code in
+// a chroma style.
+func highlightCSS(name string) ([]byte, error) {
+	if _, ok := styles.Registry[name]; !ok {
+		return nil, errors.New("unknown style " + name + " (available: " + strings.Join(styles.Names(), ", ") + ")")
+	}
+	var buf bytes.Buffer
+	formatter := chromahtml.New(chromahtml.WithClasses(true))
+	if err := formatter.WriteCSS(&buf, highlightStyle(name)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type highlightRenderer struct {
+	inline bool // inline styles instead of classes
+}
+
+func (r *highlightRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindFencedCodeBlock, r.render)
+}
+
+// render highlights a fenced code block. Errors in the info string are shown
+// above the code (like in the preview), so they can be fixed by the author.
+func (r *highlightRenderer) render(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.FencedCodeBlock)
+
+	var fields []string
+	if n.Info != nil {
+		fields = strings.Fields(string(n.Info.Segment.Value(source)))
+	}
+	language := ""
+	if len(fields) != 0 {
+		language, fields = strings.ToLower(fields[0]), fields[1:]
+	}
+	// Also accept the options in braces: ```go {linenos=true hl_lines=2}
+	if len(fields) != 0 {
+		fields[0] = strings.TrimPrefix(fields[0], "{")
+		fields[len(fields)-1] = strings.TrimSuffix(fields[len(fields)-1], "}")
+		if fields[0] == "" {
+			fields = fields[1:]
+		}
+		if len(fields) != 0 && fields[len(fields)-1] == "" {
+			fields = fields[:len(fields)-1]
+		}
+	}
+
+	var code bytes.Buffer
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		code.Write(line.Value(source))
+	}
+
+	var buf bytes.Buffer
+	opts, err := parseCodeOptions(fields)
+	if err == nil {
+		err = highlightCode(&buf, code.String(), language, opts, !r.inline, blog.HighlightStyle)
+	}
+	if err != nil {
+		msg := template.HTMLEscapeString(fmt.Sprintf("code block %s: %s", strings.Join(append([]string{language}, fields...), " "), err))
+		w.WriteString(`<p class="error">` + msg + "</p>\n")
+		w.WriteString("<pre><code>" + template.HTMLEscapeString(code.String()) + "</code></pre>\n")
+		return ast.WalkSkipChildren, nil
+	}
+	w.Write(buf.Bytes())
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		w.WriteByte('\n')
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// highlighting is the goldmark extension for syntax highlighting with CSS
+// classes, feedHighlighting uses inline styles.
+var highlighting = &highlightExtension{}
+var feedHighlighting = &highlightExtension{inline: true}
+
+type highlightExtension struct {
+	inline bool
+}
+
+func (e *highlightExtension) Extend(m goldmark.Markdown) {
+	// The default renderer has priority 1000, lower values take precedence.
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(&highlightRenderer{e.inline}, 200)))
+}
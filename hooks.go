@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page events that hooks can subscribe to.
+const (
+	EVENT_CREATE    = "create"
+	EVENT_UPDATE    = "update"
+	EVENT_PUBLISH   = "publish"
+	EVENT_UNPUBLISH = "unpublish"
+	EVENT_DELETE    = "delete"
+)
+
+var eventNames = []string{EVENT_CREATE, EVENT_UPDATE, EVENT_PUBLISH, EVENT_UNPUBLISH, EVENT_DELETE}
+
+// Status of a hook delivery.
+const (
+	DELIVERY_PENDING = "pending"
+	DELIVERY_OK      = "ok"
+	DELIVERY_FAILED  = "failed"
+)
+
+// HookConfig is a hook in the configuration file. A hook is either a local
+// command, which gets the event as JSON on stdin, or a webhook, which gets the
+// event as JSON in a POST request.
+type HookConfig struct {
+	Name    string   `json:"name"`    // shown in the admin interface, default is the command or URL
+	Events  []string `json:"events"`  // events to fire on, empty for all events
+	Command []string `json:"command"` // program and its arguments
+	URL     string   `json:"url"`     // webhook URL
+	Secret  string   `json:"secret"`  // key for the HMAC-SHA256 signature of webhooks, sent in X-Blog-Signature
+	Retries int      `json:"retries"` // number of retries after a failure, default 3, -1 to disable
+	Timeout int      `json:"timeout"` // timeout of an attempt in seconds, default 10
+}
+
+// Label returns the name of the hook, which identifies it in deliveries.
+func (h *HookConfig) Label() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if h.URL != "" {
+		return h.URL
+	}
+	return strings.Join(h.Command, " ")
+}
+
+// wants returns true if the hook subscribes to this event.
+func (h *HookConfig) wants(event string) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns a description of what's wrong with this hook, or "".
+func (h *HookConfig) check() string {
+	if (h.URL == "") == (len(h.Command) == 0) {
+		return "hook " + h.Label() + ": needs either a url or a command"
+	}
+	if h.URL != "" && !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://") {
+		return "hook " + h.Label() + ": url must be http or https"
+	}
+	for _, e := range h.Events {
+		known := false
+		for _, name := range eventNames {
+			known = known || e == name
+		}
+		if !known {
+			return "hook " + h.Label() + ": unknown event " + e
+		}
+	}
+	return ""
+}
+
+// pageEvent is the JSON sent to hooks.
+type pageEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Site  string    `json:"site"`
+	Page  eventPage `json:"page"`
+}
+
+type eventPage struct {
+	Id        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Title     string     `json:"title"`
+	URL       string     `json:"url,omitempty"` // only when published
+	Summary   string     `json:"summary"`
+	Text      string     `json:"text"`
+	Author    string     `json:"author"`
+	Created   *time.Time `json:"created,omitempty"`
+	Published *time.Time `json:"published,omitempty"`
+	Modified  *time.Time `json:"modified,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// fireEvent sends a page event to all hooks that subscribe to it. Every
+// delivery is recorded in the database and runs in the background.
+func (b *Blog) fireEvent(event string, p *Page) {
+	var hooks []*HookConfig
+	for i := range b.Hooks {
+		if b.Hooks[i].wants(event) {
+			hooks = append(hooks, &b.Hooks[i])
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+
+	e := pageEvent{
+		Event: event,
+		Time:  time.Now(),
+		Site:  b.Origin + b.URLPrefix,
+		Page: eventPage{
+			Id:        p.Id,
+			Name:      p.Name,
+			Type:      p.Typename(),
+			Title:     p.Title,
+			Summary:   p.Summary,
+			Text:      p.Text,
+			Author:    p.Author().Name(),
+			Created:   optionalTime(p.Created),
+			Published: optionalTime(p.Published),
+			Modified:  optionalTime(p.Modified),
+		},
+	}
+	if !p.Published.IsZero() {
+		e.Page.URL = b.Origin + b.URLPrefix + p.Url()
+	}
+	payload, err := json.Marshal(e)
+	checkError(err, "could not serialize event")
+
+	now := exportTime(time.Now())
+	for _, hook := range hooks {
+		result, err := b.db.Exec("INSERT INTO hook_deliveries (hook, event, page, title, payload, status, attempts, error, created, updated) VALUES (?, ?, ?, ?, ?, ?, 0, '', ?, ?)",
+			hook.Label(), event, p.Id, p.Title, string(payload), DELIVERY_PENDING, now, now)
+		checkError(err, "could not insert hook delivery")
+		id, err := result.LastInsertId()
+		checkError(err, "could not get last inserted ID")
+
+		b.hooksRunning.Add(1)
+		go b.deliver(id, hook, event, payload, 0)
+	}
+}
+
+// deliver runs a hook until it succeeds or all retries failed, with an
+// exponential backoff between attempts. It records the result of every attempt
+// in the database.
+//
+// A CGI process exits after its request, so it makes one attempt and leaves
+// the delivery pending. The next request after the backoff makes the next
+// attempt, and a server continues the pending deliveries when it starts (see
+// retryDeliveries).
+func (b *Blog) deliver(id int64, hook *HookConfig, event string, payload []byte, attempts int) {
+	defer b.hooksRunning.Done()
+
+	retries := hook.Retries
+	if retries == 0 {
+		retries = 3
+	}
+
+	for attempt := attempts + 1; ; attempt++ {
+		retry, err := hook.run(id, event, payload, hook.attemptTimeout())
+
+		status, msg := DELIVERY_OK, ""
+		if err != nil {
+			status, msg = DELIVERY_FAILED, err.Error()
+			if retry && attempt <= retries {
+				status = DELIVERY_PENDING
+			}
+		}
+		_, dbErr := b.db.Exec("UPDATE hook_deliveries SET status=?, attempts=attempts+1, error=?, updated=? WHERE id=?",
+			status, msg, exportTime(time.Now()), id)
+		if dbErr != nil && logger != nil {
+			// Not checkWarning: in CGI mode that would write an error page
+			// into the response.
+			logger.Warn("could not update hook delivery", "delivery", id, "error", dbErr)
+		}
+
+		if status != DELIVERY_PENDING {
+			metricHookDeliveries.WithLabelValues(status).Inc()
+			if err != nil && logger != nil {
+				logger.Warn("hook delivery failed", "hook", hook.Label(), "event", event, "delivery", id, "attempts", attempt, "error", err)
+			}
+			return
+		}
+		if b.cgi {
+			return
+		}
+		time.Sleep(retryDelay(attempt))
+	}
+}
+
+// attemptTimeout returns the timeout of a delivery attempt.
+func (h *HookConfig) attemptTimeout() time.Duration {
+	if h.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(h.Timeout) * time.Second
+}
+
+// retryDelay returns how long to wait before the next attempt of a delivery.
+func retryDelay(attempts int) time.Duration {
+	return time.Second << uint(attempts-1)
+}
+
+// retryDeliveries makes the next attempt of pending deliveries, in the
+// background. It runs after every CGI request, and when a server starts to
+// continue the deliveries of the previous process. A delivery is claimed by
+// updating it, so concurrent CGI processes don't deliver it twice.
+//
+// Deliveries without a finished attempt are picked up too, once their first
+// attempt has surely ended: the process that made it may have exited first.
+func (b *Blog) retryDeliveries() {
+	rows, err := b.db.Query("SELECT id, hook, event, payload, attempts, updated FROM hook_deliveries WHERE status=?", DELIVERY_PENDING)
+	checkError(err, "could not fetch pending hook deliveries")
+	type pending struct {
+		id                   int64
+		hook, event, payload string
+		attempts             int
+		updated              int64
+	}
+	var deliveries []pending
+	for rows.Next() {
+		var d pending
+		err := rows.Scan(&d.id, &d.hook, &d.event, &d.payload, &d.attempts, &d.updated)
+		checkError(err, "could not scan hook delivery")
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+
+	for _, d := range deliveries {
+		hook := b.hook(d.hook)
+		status := DELIVERY_PENDING
+		var wait time.Duration
+		if hook == nil {
+			status = DELIVERY_FAILED
+		} else if d.attempts == 0 {
+			wait = 2*hook.attemptTimeout() - time.Since(importTime(d.updated))
+		} else {
+			wait = retryDelay(d.attempts) - time.Since(importTime(d.updated))
+		}
+		if wait > 0 && b.cgi {
+			continue // not due yet, a later request makes the attempt
+		}
+		result, err := b.db.Exec("UPDATE hook_deliveries SET status=?, updated=? WHERE id=? AND status=? AND updated=?",
+			status, exportTime(time.Now()), d.id, DELIVERY_PENDING, d.updated)
+		checkError(err, "could not update hook delivery")
+		if n, err := result.RowsAffected(); err != nil || n == 0 || hook == nil {
+			continue // claimed by another process, or the hook was removed
+		}
+		b.hooksRunning.Add(1)
+		go func(d pending) {
+			time.Sleep(wait)
+			b.deliver(d.id, hook, d.event, []byte(d.payload), d.attempts)
+		}(d)
+	}
+}
+
+// hook returns the configured hook with this label, or nil.
+func (b *Blog) hook(label string) *HookConfig {
+	for i := range b.Hooks {
+		if b.Hooks[i].Label() == label {
+			return &b.Hooks[i]
+		}
+	}
+	return nil
+}
+
+// run makes a single delivery attempt. It returns whether a failed attempt
+// should be retried.
+func (h *HookConfig) run(id int64, event string, payload []byte, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if len(h.Command) != 0 {
+		cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Env = append(os.Environ(), "BLOG_EVENT="+event, "BLOG_DELIVERY="+strconv.FormatInt(id, 10))
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			if len(out) > 500 {
+				out = out[:500]
+			}
+			return true, fmt.Errorf("%s: %s", err, bytes.TrimSpace(out))
+		}
+		return false, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "blog-hooks")
+	req.Header.Set("X-Blog-Event", event)
+	req.Header.Set("X-Blog-Delivery", strconv.FormatInt(id, 10))
+	if h.Secret != "" {
+		req.Header.Set("X-Blog-Signature", "sha256="+signPayload(h.Secret, payload))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// Server errors and rate limiting are often temporary, other client
+	// errors won't be fixed by trying again.
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, errors.New("webhook returned " + resp.Status)
+}
+
+// signPayload returns the hex-encoded HMAC-SHA256 of the payload. Receivers
+// should compare it in constant time with the X-Blog-Signature header.
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HookDelivery is a delivery of an event to a hook, shown in the admin
+// interface.
+type HookDelivery struct {
+	Id       int64
+	Hook     string
+	Event    string
+	PageId   int64
+	Title    string
+	Status   string
+	Attempts int
+	Error    string
+	Created  time.Time
+	Updated  time.Time
+}
+
+// HookDeliveries returns the most recent deliveries.
+func (b *Blog) HookDeliveries(limit int) []*HookDelivery {
+	rows, err := b.db.Query("SELECT id, hook, event, page, title, status, attempts, error, created, updated FROM hook_deliveries ORDER BY id DESC LIMIT ?", limit)
+	checkError(err, "could not fetch hook deliveries")
+	defer rows.Close()
+
+	var deliveries []*HookDelivery
+	for rows.Next() {
+		d := &HookDelivery{}
+		var created, updated int64
+		err := rows.Scan(&d.Id, &d.Hook, &d.Event, &d.PageId, &d.Title, &d.Status, &d.Attempts, &d.Error, &created, &updated)
+		checkError(err, "could not scan hook delivery")
+		d.Created = importTime(created)
+		d.Updated = importTime(updated)
+		deliveries = append(deliveries, d)
+	}
+	return deliveries
+}
+
+// redeliver runs a failed delivery again, if the hook still exists.
+func (b *Blog) redeliver(id int64) error {
+	var name, event, payload string
+	row := b.db.QueryRow("SELECT hook, event, payload FROM hook_deliveries WHERE id=?", id)
+	if err := row.Scan(&name, &event, &payload); err != nil {
+		return err
+	}
+	hook := b.hook(name)
+	if hook == nil {
+		return errors.New("hook " + name + " is not configured anymore")
+	}
+	_, err := b.db.Exec("UPDATE hook_deliveries SET status=?, updated=? WHERE id=?", DELIVERY_PENDING, exportTime(time.Now()), id)
+	checkError(err, "could not update hook delivery")
+	b.hooksRunning.Add(1)
+	go b.deliver(id, hook, event, []byte(payload), 0)
+	return nil
+}
+
+// HooksHandler shows the configured hooks and the status of recent
+// deliveries.
+func HooksHandler(w http.ResponseWriter, r *http.Request) {
+	res := NewAuthenticatedResponse(w, r)
+	if res == nil {
+		return
+	}
+
+	if r.Method == "POST" {
+		id, err := strconv.ParseInt(r.PostFormValue("retry"), 10, 64)
+		if err == nil {
+			err = blog.redeliver(id)
+		}
+		if err != nil {
+			res.data["retryError"] = err.Error()
+		} else {
+			w.Header().Set("Location", r.URL.String())
+			w.WriteHeader(303)
+			return
+		}
+	}
+
+	res.tpl = "hooks"
+	res.data["title"] = "Hooks"
+	res.data["hooks"] = blog.Hooks
+	res.data["deliveries"] = blog.HookDeliveries(50)
+	res.Output(w, r, time.Time{})
+}
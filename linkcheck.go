@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/text"
+)
+
+// The link checker finds links in pages that don't lead anywhere: internal
+// links to pages that don't exist (for example because they were renamed),
+// links to headings that don't exist, local images that are missing and
+// footnotes without a definition. External links are only checked on
+// request, as that's slow and depends on other sites.
+
+// LinkProblem is a broken link in a page.
+type LinkProblem struct {
+	Page    *Page
+	Kind    string // "link", "image", "footnote" or "external"
+	Target  string // the destination as written in the page
+	Problem string
+}
+
+// linkRef is a link or image in the Markdown of a page.
+type linkRef struct {
+	page   *Page
+	image  bool
+	target string
+}
+
+var footnoteRefPattern = regexp.MustCompile(`\[\^([^\]\s]+)\]`)
+
+// pageLinks returns all links and images in a page, and the labels of
+// footnote references that have no definition.
+func pageLinks(page *Page) (links []linkRef, footnotes []string) {
+	source := []byte(page.Text)
+	doc := blog.markdown().Parser().Parse(text.NewReader(source))
+
+	// Text of the current block, to find footnote references that weren't
+	// parsed as footnotes. Those are split over multiple text nodes.
+	var blockText bytes.Buffer
+	flush := func() {
+		for _, m := range footnoteRefPattern.FindAllStringSubmatch(blockText.String(), -1) {
+			footnotes = append(footnotes, m[1])
+		}
+		blockText.Reset()
+	}
+
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if n.Type() == ast.TypeBlock {
+			flush()
+		}
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			links = append(links, linkRef{page, false, string(n.Destination)})
+		case *ast.Image:
+			links = append(links, linkRef{page, true, string(n.Destination)})
+		case *ast.AutoLink:
+			if n.AutoLinkType == ast.AutoLinkURL {
+				links = append(links, linkRef{page, false, string(n.URL(source))})
+			}
+		case *ast.Text:
+			blockText.Write(n.Segment.Value(source))
+		case *ast.CodeSpan, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+	flush()
+	return
+}
+
+// headingIDsOf returns the ids of all headings in a page.
+func headingIDsOf(page *Page) map[string]bool {
+	ids := make(map[string]bool)
+	var add func(entries []*TOCEntry)
+	add = func(entries []*TOCEntry) {
+		for _, entry := range entries {
+			ids[entry.ID] = true
+			add(entry.Children)
+		}
+	}
+	add(tableOfContents(blog.markdown(), []byte(page.Text)))
+	return ids
+}
+
+// linkChecker checks links against the pages and routes of the blog.
+type linkChecker struct {
+	b     *Blog
+	pages map[int64]*Page  // all pages and posts, with their text
+	posts map[string]*Page // by name
+	ids   map[*Page]map[string]bool
+}
+
+// checkLinks checks the links in all pages, and external links too when
+// external is true.
+func (b *Blog) checkLinks(external bool) []*LinkProblem {
+	pages := PagesFromQuery(b, PAGE_TYPE_NONE, FETCH_ALL, "", "ORDER BY id")
+	c := &linkChecker{
+		b:     b,
+		pages: make(map[int64]*Page),
+		posts: make(map[string]*Page),
+		ids:   make(map[*Page]map[string]bool),
+	}
+	for _, page := range pages {
+		c.pages[page.Id] = page
+		if page.Type == PAGE_TYPE_POST {
+			c.posts[page.Name] = page
+		}
+	}
+
+	var problems []*LinkProblem
+	var externalLinks []linkRef
+	for _, page := range pages {
+		links, footnotes := pageLinks(page)
+		for _, label := range footnotes {
+			problems = append(problems, &LinkProblem{page, "footnote", "[^" + label + "]", "footnote is not defined"})
+		}
+		for _, link := range links {
+			u, err := url.Parse(link.target)
+			if err != nil {
+				problems = append(problems, c.problem(link, "invalid URL"))
+				continue
+			}
+			if u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https" {
+				continue // mailto: etc.
+			}
+			if u.Host != "" && u.Host != b.OriginURL.Host {
+				externalLinks = append(externalLinks, link)
+				continue
+			}
+			if problem := c.checkInternal(link, u); problem != "" {
+				problems = append(problems, c.problem(link, problem))
+			}
+		}
+	}
+
+	if external {
+		problems = append(problems, b.checkExternalLinks(externalLinks)...)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Page.Id < problems[j].Page.Id
+	})
+	return problems
+}
+
+func (c *linkChecker) problem(link linkRef, problem string) *LinkProblem {
+	kind := "link"
+	if link.image {
+		kind = "image"
+	}
+	return &LinkProblem{link.page, kind, link.target, problem}
+}
+
+// checkInternal returns the problem of a link within the blog, or "" when
+// the link is fine.
+func (c *linkChecker) checkInternal(link linkRef, u *url.URL) string {
+	if u.Path == "" {
+		// A link within the page, like #section.
+		return c.checkFragment(link.page, u.Fragment)
+	}
+
+	base := &url.URL{Path: c.b.URLPrefix + link.page.Url()}
+	target := base.ResolveReference(u)
+	if !strings.HasPrefix(target.Path, c.b.URLPrefix+"/") {
+		return "outside of the blog"
+	}
+
+	// Static files, like images, are served from the webroot.
+	local := strings.TrimPrefix(target.Path, c.b.URLPrefix)
+	if c.b.WebRoot != "" {
+		if st, err := os.Stat(filepath.Join(c.b.WebRoot, filepath.FromSlash(path.Clean(local)))); err == nil && !st.IsDir() {
+			return ""
+		}
+	}
+	if link.image {
+		return "image does not exist"
+	}
+
+	var match mux.RouteMatch
+	req, err := http.NewRequest("GET", target.Path, nil)
+	if err != nil || !c.b.mux.Match(req, &match) || match.Route == nil {
+		return "page does not exist"
+	}
+
+	var page *Page
+	switch match.Route.GetName() {
+	case "notfound":
+	case "page", "post":
+		if _, ok := match.Vars["parents"]; !ok {
+			page = c.posts[match.Vars["name"]]
+		}
+		if page == nil {
+			// Static pages are found by their path, like in PageViewHandler.
+			names := strings.Split(strings.TrimPrefix(target.Path, c.b.URLPrefix+"/"), "/")
+			if p := c.b.pageTree().lookup(names); p != nil {
+				page = c.pages[p.Id]
+			}
+		}
+	default:
+		return ""
+	}
+	if page == nil || !page.Published.IsZero() && c.b.URLPrefix+page.Url() != target.Path {
+		// Links to old URLs work, but it's better to link to the page itself.
+		if to := c.b.redirectFor(local); to != "" {
+			return "redirects to " + to
+		}
+		if page != nil {
+			return "page is at " + page.Url()
+		}
+		return "page does not exist"
+	}
+	if page.Published.IsZero() && !link.page.Published.IsZero() {
+		return "page is not published"
+	}
+	return c.checkFragment(page, target.Fragment)
+}
+
+// checkFragment checks that a page has a heading with this id.
+func (c *linkChecker) checkFragment(page *Page, fragment string) string {
+	// Footnote ids (#fn:1) are generated, and an empty fragment is the top.
+	if fragment == "" || strings.HasPrefix(fragment, "fn:") || strings.HasPrefix(fragment, "fnref:") {
+		return ""
+	}
+	if c.ids[page] == nil {
+		c.ids[page] = headingIDsOf(page)
+	}
+	if !c.ids[page][fragment] {
+		return "no heading with id " + strconv.Quote(fragment)
+	}
+	return ""
+}
+
+// checkExternalLinks requests all external links, a few at the same time
+// (linkcheck-concurrency). Every URL is only requested once.
+func (b *Blog) checkExternalLinks(links []linkRef) []*LinkProblem {
+	byURL := make(map[string][]linkRef)
+	var urls []string
+	for _, link := range links {
+		if byURL[link.target] == nil {
+			urls = append(urls, link.target)
+		}
+		byURL[link.target] = append(byURL[link.target], link)
+	}
+
+	client := &http.Client{Timeout: time.Duration(b.LinkCheckTimeout) * time.Second}
+	if b.LinkCheckTimeout <= 0 {
+		client.Timeout = 10 * time.Second
+	}
+	workers := b.LinkCheckWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	results := make(map[string]string)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range queue {
+				problem := checkExternalLink(client, u)
+				lock.Lock()
+				results[u] = problem
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, u := range urls {
+		queue <- u
+	}
+	close(queue)
+	wg.Wait()
+
+	var problems []*LinkProblem
+	for _, u := range urls {
+		if results[u] == "" {
+			continue
+		}
+		for _, link := range byURL[u] {
+			problems = append(problems, &LinkProblem{link.page, "external", link.target, results[u]})
+		}
+	}
+	return problems
+}
+
+// checkExternalLink requests a URL, and returns the problem or "". Some
+// servers don't support HEAD requests, so it falls back to GET.
+func checkExternalLink(client *http.Client, u string) string {
+	resp, err := client.Head(u)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		resp, err = client.Get(u)
+	}
+	if err, ok := err.(*url.Error); ok {
+		return err.Err.Error() // without the method and URL
+	} else if err != nil {
+		return err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return resp.Status
+	}
+	return ""
+}
+
+// LinkCheckHandler shows the broken links in all pages.
+func LinkCheckHandler(w http.ResponseWriter, r *http.Request) {
+	res := NewAuthenticatedResponse(w, r)
+	if res == nil {
+		return
+	}
+
+	external := r.FormValue("external") != ""
+	res.tpl = "linkcheck"
+	res.data["title"] = "Link check"
+	res.data["external"] = external
+	res.data["problems"] = blog.checkLinks(external)
+	res.Output(w, r, time.Time{})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// logger is the structured application logger. It is only set while serving
+// requests, CLI commands keep printing plain messages.
+var logger *slog.Logger
+
+type requestInfoKey struct{}
+
+// requestInfo is stored in the request context by logHandler, so handlers can
+// add information to the access log.
+type requestInfo struct {
+	id   string
+	user string
+}
+
+// statusResponseWriter records the status code and number of bytes written.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(buf)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// startLogging creates the structured logger as configured. Logs are written
+// to stderr by default, which works in CGI mode too (stdout is the response).
+func (b *Blog) startLogging() {
+	out := os.Stderr
+	if b.LogFile != "" {
+		f, err := os.OpenFile(b.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		checkError(err, "could not open log file")
+		out = f
+	}
+
+	var level slog.Level
+	err := level.UnmarshalText([]byte(b.LogLevel))
+	checkError(err, "could not parse log level")
+
+	options := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(b.LogFormat) {
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(out, options))
+	case "logfmt", "text", "":
+		logger = slog.New(slog.NewTextHandler(out, options))
+	default:
+		raiseError("unknown log format: " + b.LogFormat)
+	}
+}
+
+// logHandler writes an access log line for every request and assigns a
+// request ID (reusing X-Request-ID when a front-end server sets one).
+func (b *Blog) logHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if logger == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		info := &requestInfo{id: r.Header.Get("X-Request-ID")}
+		if info.id == "" {
+			info.id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", info.id)
+
+		lw := &statusResponseWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		h.ServeHTTP(lw, r)
+
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if lw.status >= 500 {
+			level = slog.LevelError
+		}
+		logger.LogAttrs(r.Context(), level, "request",
+			slog.String("request_id", info.id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", lw.status),
+			slog.Int64("bytes", lw.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("user", info.user),
+			slog.String("remote", r.RemoteAddr))
+	})
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	checkError(err, "could not generate request ID")
+	return hex.EncodeToString(buf)
+}
+
+// setRequestUser records the authenticated user for the access log.
+func setRequestUser(r *http.Request, user *User) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.user = user.email
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// markdownExtensions are the optional Markdown extensions, by the name used
+// in markdown-extensions in the configuration. Any goldmark extension can be
+// added here.
+var markdownExtensions = map[string]goldmark.Extender{
+	"table":           extension.Table,
+	"autolink":        extension.Linkify,
+	"footnote":        extension.Footnote,
+	"strikethrough":   extension.Strikethrough,
+	"tasklist":        extension.TaskList,
+	"definition-list": extension.DefinitionList,
+	"typographer":     extension.Typographer,
+	"heading-anchors": headingAnchors,
+	"highlight":       highlighting,
+	"math":            texMath,
+	"diagrams":        diagrams,
+}
+
+// markdownExtensionNames returns the names of all optional extensions.
+func markdownExtensionNames() []string {
+	names := make([]string, 0, len(markdownExtensions))
+	for name := range markdownExtensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// markdown returns the Markdown converter with the configured extensions
+// (lazy load). Shortcodes and heading ids are always enabled.
+func (b *Blog) markdown() goldmark.Markdown {
+	b.markdownOnce.Do(func() {
+		b.md = b.newMarkdown(false)
+	})
+	return b.md
+}
+
+// feedMarkdown returns the Markdown converter for the feed (lazy load). It
+// only differs in the syntax highlighting, which uses inline styles.
+func (b *Blog) feedMarkdown() goldmark.Markdown {
+	b.feedMarkdownOnce.Do(func() {
+		b.mdFeed = b.newMarkdown(true)
+	})
+	return b.mdFeed
+}
+
+func (b *Blog) newMarkdown(feed bool) goldmark.Markdown {
+	extensions := []goldmark.Extender{shortcodes, headingIDs}
+	for _, name := range b.MarkdownExtensions {
+		ext, ok := markdownExtensions[name]
+		if !ok {
+			raiseError("unknown markdown extension " + name)
+		}
+		if feed && ext == highlighting {
+			ext = feedHighlighting
+		}
+		extensions = append(extensions, ext)
+	}
+	return goldmark.New(
+		goldmark.WithExtensions(extensions...),
+		goldmark.WithRendererOptions(
+			html.WithXHTML(),
+			// Pages are written by trusted authors, who may use HTML.
+			html.WithUnsafe(),
+		),
+	)
+}
+
+// headingAnchors adds a link to the id of every heading, so readers can link
+// to a section.
+var headingAnchors = &headingAnchorsExtension{}
+
+type headingAnchorsExtension struct{}
+
+func (e *headingAnchorsExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(e, 1000)))
+}
+
+// Transform appends <a class="anchor" href="#id">¶</a> to all headings.
+func (e *headingAnchorsExtension) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		if id, ok := heading.AttributeString("id"); ok {
+			link := ast.NewLink()
+			link.Destination = append([]byte("#"), id.([]byte)...)
+			link.SetAttributeString("class", []byte("anchor"))
+			link.AppendChild(link, ast.NewString([]byte("¶")))
+			heading.AppendChild(heading, link)
+		}
+		return ast.WalkSkipChildren, nil
+	})
+}
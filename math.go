@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Math is written in TeX between dollar signs: $x^2$ for inline math, and
+// $$\sum_i x_i$$ for display math. Display math can also be a block, from a
+// line starting with $$ to a line ending with $$. It is converted to MathML
+// while rendering (see mathml.go), so it needs no JavaScript and works in the
+// feed.
+//
+// So that amounts like $5 aren't mistaken for math, an opening $ must be
+// followed by a non-space, and a closing $ must follow a non-space and must
+// not be followed by a digit. The first $ after the opening one must be the
+// closing one. A literal dollar sign can be written as \$.
+
+var kindMathBlock = ast.NewNodeKind("MathBlock")
+var kindMathInline = ast.NewNodeKind("MathInline")
+
+type mathBlock struct {
+	ast.BaseBlock
+	tex  []byte
+	open bool // waiting for the closing $$
+}
+
+func (n *mathBlock) Kind() ast.NodeKind {
+	return kindMathBlock
+}
+
+// IsRaw returns true, as the content is TeX and not Markdown.
+func (n *mathBlock) IsRaw() bool {
+	return true
+}
+
+func (n *mathBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"TeX": string(n.tex)}, nil)
+}
+
+type mathInline struct {
+	ast.BaseInline
+	tex     []byte
+	display bool // written as $$...$$
+}
+
+func (n *mathInline) Kind() ast.NodeKind {
+	return kindMathInline
+}
+
+func (n *mathInline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"TeX": string(n.tex)}, nil)
+}
+
+type mathBlockParser struct{}
+
+func (p *mathBlockParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+func (p *mathBlockParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	trimmed := util.TrimRightSpace(util.TrimLeftSpace(line))
+	if !bytes.HasPrefix(trimmed, []byte("$$")) {
+		return nil, parser.NoChildren
+	}
+	rest := trimmed[2:]
+	end := bytes.Index(rest, []byte("$$"))
+	if end >= 0 && end != len(rest)-2 {
+		// Display math inside a paragraph: $$x$$ and more text.
+		return nil, parser.NoChildren
+	}
+
+	node := &mathBlock{open: end < 0}
+	if end >= 0 {
+		node.tex = append(node.tex, rest[:end]...)
+	} else {
+		node.tex = append(node.tex, rest...)
+		node.tex = append(node.tex, '\n')
+	}
+	reader.Advance(lineLength(line, segment))
+	return node, parser.NoChildren
+}
+
+func (p *mathBlockParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	n := node.(*mathBlock)
+	if !n.open {
+		return parser.Close
+	}
+	line, segment := reader.PeekLine()
+	if line == nil {
+		return parser.Close
+	}
+
+	trimmed := util.TrimRightSpace(line)
+	if bytes.HasSuffix(trimmed, []byte("$$")) {
+		n.tex = append(n.tex, trimmed[:len(trimmed)-2]...)
+		n.open = false
+		reader.Advance(lineLength(line, segment))
+		return parser.Close
+	}
+	n.tex = append(n.tex, line...)
+	reader.Advance(lineLength(line, segment))
+	return parser.Continue | parser.NoChildren
+}
+
+func (p *mathBlockParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {
+}
+
+func (p *mathBlockParser) CanInterruptParagraph() bool {
+	return true
+}
+
+func (p *mathBlockParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+type mathInlineParser struct{}
+
+func (p *mathInlineParser) Trigger() []byte {
+	return []byte{'$'}
+}
+
+// findMathEnd returns the index of the closing delimiter in line, or -1.
+func findMathEnd(line []byte, start int, delim string) int {
+	for i := start; i < len(line); i++ {
+		switch {
+		case line[i] == '\\':
+			i++ // escaped character, like \$
+		case bytes.HasPrefix(line[i:], []byte(delim)):
+			return i
+		}
+	}
+	return -1
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func (p *mathInlineParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	if bytes.HasPrefix(line, []byte("$$")) {
+		end := findMathEnd(line, 2, "$$")
+		if end < 0 {
+			return nil
+		}
+		block.Advance(end + 2)
+		return &mathInline{tex: line[2:end], display: true}
+	}
+
+	if len(line) < 2 || isSpace(line[1]) {
+		return nil
+	}
+	end := findMathEnd(line, 1, "$")
+	if end < 0 || isSpace(line[end-1]) || end+1 < len(line) && line[end+1] >= '0' && line[end+1] <= '9' {
+		return nil
+	}
+	block.Advance(end + 1)
+	return &mathInline{tex: line[1:end]}
+}
+
+type mathRenderer struct{}
+
+func (r *mathRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindMathBlock, r.render)
+	reg.Register(kindMathInline, r.render)
+}
+
+// render converts the math to MathML. Errors are shown in the page (like in
+// the preview), so they can be fixed by the author.
+func (r *mathRenderer) render(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	var tex []byte
+	var err error
+	block, display := false, false
+	switch n := node.(type) {
+	case *mathBlock:
+		tex, block, display = n.tex, true, true
+		if n.open {
+			err = &mathError{len(tex), "missing closing $$"}
+		}
+	case *mathInline:
+		tex, display = n.tex, n.display
+	}
+
+	var mathml string
+	if err == nil {
+		mathml, err = texToMathML(string(tex), display)
+	}
+	if err != nil {
+		msg := template.HTMLEscapeString("math: " + err.Error() + ": " + string(bytes.TrimSpace(tex)))
+		if block {
+			w.WriteString(`<p class="error">` + msg + "</p>\n")
+		} else {
+			w.WriteString(`<span class="error">` + msg + "</span>")
+		}
+		return ast.WalkSkipChildren, nil
+	}
+
+	if block {
+		w.WriteString(`<div class="math">` + mathml + "</div>\n")
+	} else {
+		w.WriteString(mathml)
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// texMath is the goldmark extension for TeX math.
+var texMath = &mathExtension{}
+
+type mathExtension struct{}
+
+func (e *mathExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithBlockParsers(util.Prioritized(&mathBlockParser{}, 750)),
+		parser.WithInlineParsers(util.Prioritized(&mathInlineParser{}, 150)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(&mathRenderer{}, 500)))
+}
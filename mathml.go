@@ -0,0 +1,725 @@
+package main
+
+// A small TeX to MathML converter, so that math can be rendered without
+// JavaScript (and in feed readers).
+//
+// It supports the commonly used subset of TeX math: letters, numbers and
+// operators, sub- and superscripts (and primes), groups, Greek letters and
+// symbols, \frac, \binom, \sqrt, accents, fonts (\mathbf, \mathbb, \mathcal,
+// ...), \text, \operatorname, function names, big operators with limits,
+// \left...\right and \big delimiters, spacing, and the matrix, cases and
+// aligned environments. Unknown commands are reported as errors.
+
+import (
+	"fmt"
+	"html/template"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// mathError is a syntax error with the position in the TeX source.
+type mathError struct {
+	Pos int
+	Msg string
+}
+
+func (e *mathError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos+1)
+}
+
+var mathGreek = map[string]string{
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ",
+	"varepsilon": "ε", "zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ",
+	"iota": "ι", "kappa": "κ", "lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ",
+	"pi": "π", "varpi": "ϖ", "rho": "ρ", "varrho": "ϱ", "sigma": "σ",
+	"varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ", "varphi": "φ",
+	"chi": "χ", "psi": "ψ", "omega": "ω",
+}
+
+// mathSymbols are identifiers that are set upright.
+var mathSymbols = map[string]string{
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ",
+	"Pi": "Π", "Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ",
+	"Omega": "Ω", "infty": "∞", "partial": "∂", "nabla": "∇", "ell": "ℓ",
+	"hbar": "ℏ", "emptyset": "∅", "varnothing": "∅", "aleph": "ℵ", "Re": "ℜ",
+	"Im": "ℑ", "wp": "℘", "imath": "ı", "jmath": "ȷ",
+}
+
+var mathOperators = map[string]string{
+	"pm": "±", "mp": "∓", "times": "×", "div": "÷", "cdot": "⋅", "ast": "∗",
+	"star": "⋆", "circ": "∘", "bullet": "∙", "oplus": "⊕", "ominus": "⊖",
+	"otimes": "⊗", "oslash": "⊘", "odot": "⊙", "cup": "∪", "cap": "∩",
+	"setminus": "∖", "wedge": "∧", "land": "∧", "vee": "∨", "lor": "∨",
+	"neg": "¬", "lnot": "¬",
+	"le": "≤", "leq": "≤", "ge": "≥", "geq": "≥", "ne": "≠", "neq": "≠",
+	"leqslant": "⩽", "geqslant": "⩾", "ll": "≪", "gg": "≫", "approx": "≈",
+	"sim": "∼", "simeq": "≃", "cong": "≅", "equiv": "≡", "propto": "∝",
+	"prec": "≺", "succ": "≻", "preceq": "⪯", "succeq": "⪰", "subset": "⊂",
+	"supset": "⊃", "subseteq": "⊆", "supseteq": "⊇", "subsetneq": "⊊",
+	"in": "∈", "notin": "∉", "ni": "∋", "mid": "∣", "parallel": "∥",
+	"perp": "⊥", "vdash": "⊢", "models": "⊨", "doteq": "≐",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←",
+	"leftrightarrow": "↔", "Rightarrow": "⇒", "Leftarrow": "⇐",
+	"Leftrightarrow": "⇔", "implies": "⟹", "impliedby": "⟸", "iff": "⟺",
+	"mapsto": "↦", "longrightarrow": "⟶", "longleftarrow": "⟵",
+	"uparrow": "↑", "downarrow": "↓", "hookrightarrow": "↪",
+	"forall": "∀", "exists": "∃", "nexists": "∄", "therefore": "∴",
+	"because": "∵", "ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮",
+	"ddots": "⋱", "colon": ":", "prime": "′", "angle": "∠",
+	"triangle": "△", "top": "⊤", "bot": "⊥", "dagger": "†", "ddagger": "‡",
+}
+
+// mathDelimiters are the delimiter commands that can be used with \left,
+// \right and \big, besides ( ) [ ] | / and . (no delimiter).
+var mathDelimiters = map[string]string{
+	"{": "{", "}": "}", "|": "‖", "langle": "⟨", "rangle": "⟩",
+	"lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉", "vert": "|",
+	"Vert": "‖", "lvert": "|", "rvert": "|", "lVert": "‖", "rVert": "‖",
+	"backslash": "∖", "uparrow": "↑", "downarrow": "↓",
+}
+
+// mathBigOperators are set larger. The value is whether the limits are
+// placed below and above in display math (instead of as scripts).
+var mathBigOperators = map[string]struct {
+	char   string
+	limits bool
+}{
+	"sum": {"∑", true}, "prod": {"∏", true}, "coprod": {"∐", true},
+	"bigcup": {"⋃", true}, "bigcap": {"⋂", true}, "bigoplus": {"⨁", true},
+	"bigotimes": {"⨂", true}, "bigvee": {"⋁", true}, "bigwedge": {"⋀", true},
+	"int": {"∫", false}, "iint": {"∬", false}, "iiint": {"∭", false},
+	"oint": {"∮", false},
+}
+
+// mathFunctions are function names that are set upright. The value is whether
+// they take limits in display math.
+var mathFunctions = map[string]bool{
+	"sin": false, "cos": false, "tan": false, "cot": false, "sec": false,
+	"csc": false, "arcsin": false, "arccos": false, "arctan": false,
+	"sinh": false, "cosh": false, "tanh": false, "log": false, "ln": false,
+	"lg": false, "exp": false, "dim": false, "ker": false, "deg": false,
+	"hom": false, "arg": false, "det": true, "gcd": true, "lim": true,
+	"liminf": true, "limsup": true, "max": true, "min": true, "sup": true,
+	"inf": true, "Pr": true,
+}
+
+var mathAccents = map[string]struct {
+	char  string
+	under bool
+}{
+	"hat": {"^", false}, "widehat": {"^", false}, "bar": {"¯", false},
+	"overline": {"‾", false}, "vec": {"→", false}, "tilde": {"˜", false},
+	"widetilde": {"˜", false}, "dot": {"˙", false}, "ddot": {"¨", false},
+	"check": {"ˇ", false}, "breve": {"˘", false}, "acute": {"´", false},
+	"grave": {"`", false}, "overbrace": {"⏞", false},
+	"underline": {"_", true}, "underbrace": {"⏟", true},
+}
+
+var mathSpaces = map[string]string{
+	",": "0.1667em", ":": "0.2222em", ">": "0.2222em", ";": "0.2778em",
+	" ": "0.25em", "!": "-0.1667em", "quad": "1em", "qquad": "2em",
+}
+
+// mathFonts are the font commands, by the variant they set.
+var mathFonts = map[string]string{
+	"mathrm": "normal", "mathit": "italic", "mathbf": "bold",
+	"boldsymbol": "bold", "mathbb": "bb", "mathcal": "cal", "mathscr": "cal",
+	"mathfrak": "frak", "mathsf": "sf", "mathtt": "tt",
+}
+
+// mathAlphabets are the start of A, a and 0 in the Mathematical Alphanumeric
+// Symbols block, per variant (0 if the variant has no digits).
+var mathAlphabets = map[string][3]rune{
+	"bold":   {0x1D400, 0x1D41A, 0x1D7CE},
+	"italic": {0x1D434, 0x1D44E, 0},
+	"bb":     {0x1D538, 0x1D552, 0x1D7D8},
+	"cal":    {0x1D49C, 0x1D4B6, 0},
+	"frak":   {0x1D504, 0x1D51E, 0},
+	"sf":     {0x1D5A0, 0x1D5BA, 0x1D7E2},
+	"tt":     {0x1D670, 0x1D68A, 0x1D7F6},
+}
+
+// mathAlphabetHoles are letters that were already in Unicode before the
+// Mathematical Alphanumeric Symbols block, which has holes at their place.
+var mathAlphabetHoles = map[string]map[rune]rune{
+	"italic": {'h': 'ℎ'},
+	"bb":     {'C': 'ℂ', 'H': 'ℍ', 'N': 'ℕ', 'P': 'ℙ', 'Q': 'ℚ', 'R': 'ℝ', 'Z': 'ℤ'},
+	"cal":    {'B': 'ℬ', 'E': 'ℰ', 'F': 'ℱ', 'H': 'ℋ', 'I': 'ℐ', 'L': 'ℒ', 'M': 'ℳ', 'R': 'ℛ', 'e': 'ℯ', 'g': 'ℊ', 'o': 'ℴ'},
+	"frak":   {'C': 'ℭ', 'H': 'ℌ', 'I': 'ℑ', 'R': 'ℜ', 'Z': 'ℨ'},
+}
+
+// mathVariantChar returns the character c in a variant. It returns c itself
+// if the variant has no such character.
+func mathVariantChar(variant string, c rune) rune {
+	if hole, ok := mathAlphabetHoles[variant][c]; ok {
+		return hole
+	}
+	start, ok := mathAlphabets[variant]
+	switch {
+	case !ok:
+		return c
+	case c >= 'A' && c <= 'Z':
+		return start[0] + c - 'A'
+	case c >= 'a' && c <= 'z':
+		return start[1] + c - 'a'
+	case c >= '0' && c <= '9' && start[2] != 0:
+		return start[2] + c - '0'
+	}
+	return c
+}
+
+// mathEnvironments are the supported environments: the delimiters around it
+// and the alignment of the columns.
+var mathEnvironments = map[string]struct {
+	open, close string
+	align       string
+}{
+	"matrix":   {"", "", ""},
+	"pmatrix":  {"(", ")", ""},
+	"bmatrix":  {"[", "]", ""},
+	"Bmatrix":  {"{", "}", ""},
+	"vmatrix":  {"|", "|", ""},
+	"Vmatrix":  {"‖", "‖", ""},
+	"array":    {"", "", ""},
+	"cases":    {"{", "", "left left"},
+	"aligned":  {"", "", "right left"},
+	"align":    {"", "", "right left"},
+	"align*":   {"", "", "right left"},
+	"gathered": {"", "", ""},
+	"split":    {"", "", "right left"},
+}
+
+type texParser struct {
+	src     string
+	pos     int
+	display bool
+	variant string // font for letters and digits set by \mathbf etc.
+	err     *mathError
+}
+
+// texToMathML converts TeX math to a MathML <math> element. The TeX source is
+// included as annotation, so it can be copied.
+func texToMathML(src string, display bool) (string, error) {
+	p := &texParser{src: src, display: display}
+	items := p.parseList()
+	if p.err == nil && p.pos < len(p.src) {
+		p.fail("unexpected " + p.stopToken())
+	}
+	if p.err != nil {
+		return "", p.err
+	}
+
+	var buf strings.Builder
+	buf.WriteString(`<math xmlns="http://www.w3.org/1998/Math/MathML"`)
+	if display {
+		buf.WriteString(` display="block"`)
+	}
+	buf.WriteString("><semantics><mrow>")
+	buf.WriteString(strings.Join(items, ""))
+	buf.WriteString(`</mrow><annotation encoding="application/x-tex">`)
+	buf.WriteString(template.HTMLEscapeString(strings.TrimSpace(src)))
+	buf.WriteString("</annotation></semantics></math>")
+	return buf.String(), nil
+}
+
+// fail records the first error. All parse functions return early when there
+// is an error.
+func (p *texParser) fail(msg string) {
+	if p.err == nil {
+		p.err = &mathError{p.pos, msg}
+	}
+}
+
+func (p *texParser) skipSpace() {
+	for p.pos < len(p.src) && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\n' || p.src[p.pos] == '\r') {
+		p.pos++
+	}
+}
+
+// peekCommand returns the name of the command at the current position, or ""
+// if there is none.
+func (p *texParser) peekCommand() string {
+	if p.pos >= len(p.src) || p.src[p.pos] != '\\' {
+		return ""
+	}
+	i := p.pos + 1
+	for i < len(p.src) && (p.src[i] >= 'a' && p.src[i] <= 'z' || p.src[i] >= 'A' && p.src[i] <= 'Z') {
+		i++
+	}
+	if i == p.pos+1 && i < len(p.src) {
+		i++ // single character command like \, or \{
+	}
+	return p.src[p.pos+1 : i]
+}
+
+func (p *texParser) readCommand() string {
+	name := p.peekCommand()
+	p.pos += 1 + len(name)
+	return name
+}
+
+// stopToken returns the token that ended a list: }, &, \\, \right or \end.
+func (p *texParser) stopToken() string {
+	if p.src[p.pos] == '\\' {
+		return `\` + p.peekCommand()
+	}
+	return p.src[p.pos : p.pos+1]
+}
+
+// parseList parses items up to the end of the source or a token that ends a
+// list. The caller checks whether that token is allowed there.
+func (p *texParser) parseList() []string {
+	var items []string
+	for p.err == nil {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			break
+		}
+		c := p.src[p.pos]
+		if c == '}' || c == '&' {
+			break
+		}
+		if cmd := p.peekCommand(); cmd == `\` || cmd == "right" || cmd == "end" {
+			break
+		}
+		items = append(items, p.parseScripts())
+	}
+	return items
+}
+
+// parseScripts parses an atom with its subscript, superscript and primes.
+func (p *texParser) parseScripts() string {
+	base, limits := p.parseAtom()
+	var sub, sup, primes string
+	hasSub, hasSup := false, false
+	for p.err == nil {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			break
+		}
+		c := p.src[p.pos]
+		if c == '\'' {
+			p.pos++
+			primes += "′"
+			continue
+		}
+		if c != '^' && c != '_' {
+			break
+		}
+		if c == '^' && hasSup || c == '_' && hasSub {
+			p.fail(map[byte]string{'^': "double superscript", '_': "double subscript"}[c])
+			break
+		}
+		p.pos++
+		if c == '^' {
+			sup, hasSup = p.parseArg(), true
+		} else {
+			sub, hasSub = p.parseArg(), true
+		}
+	}
+	if p.err != nil {
+		return ""
+	}
+	if primes != "" {
+		if hasSup {
+			sup = "<mrow><mo>" + primes + "</mo>" + sup + "</mrow>"
+		} else {
+			sup, hasSup = "<mo>"+primes+"</mo>", true
+		}
+	}
+
+	under, over, both := "msub", "msup", "msubsup"
+	if limits && p.display {
+		under, over, both = "munder", "mover", "munderover"
+	}
+	switch {
+	case hasSub && hasSup:
+		return "<" + both + ">" + base + sub + sup + "</" + both + ">"
+	case hasSub:
+		return "<" + under + ">" + base + sub + "</" + under + ">"
+	case hasSup:
+		return "<" + over + ">" + base + sup + "</" + over + ">"
+	}
+	return base
+}
+
+// parseArg parses the argument of a command or script: a group, or a single
+// token.
+func (p *texParser) parseArg() string {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		p.fail("missing argument")
+		return ""
+	}
+	c := p.src[p.pos]
+	switch {
+	case c == '{':
+		return p.parseGroup()
+	case c >= '0' && c <= '9':
+		p.pos++
+		return "<mn>" + p.applyVariant(string(c)) + "</mn>"
+	case c == '}' || c == '&' || c == '^' || c == '_':
+		p.fail("missing argument")
+		return ""
+	}
+	atom, _ := p.parseAtom()
+	return atom
+}
+
+// parseGroup parses {...} as a single element.
+func (p *texParser) parseGroup() string {
+	p.pos++ // {
+	items := p.parseList()
+	if p.err != nil {
+		return ""
+	}
+	if p.pos >= len(p.src) || p.src[p.pos] != '}' {
+		if p.pos < len(p.src) {
+			p.fail("unexpected " + p.stopToken())
+		} else {
+			p.fail("missing }")
+		}
+		return ""
+	}
+	p.pos++
+	if len(items) == 1 {
+		return items[0]
+	}
+	return "<mrow>" + strings.Join(items, "") + "</mrow>"
+}
+
+// readText reads a {...} argument as raw text, for \text and the like.
+func (p *texParser) readText() string {
+	p.skipSpace()
+	if p.pos >= len(p.src) || p.src[p.pos] != '{' {
+		p.fail("missing {")
+		return ""
+	}
+	depth := 0
+	for i := p.pos; i < len(p.src); i++ {
+		switch p.src[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				text := p.src[p.pos+1 : i]
+				p.pos = i + 1
+				return text
+			}
+		}
+	}
+	p.fail("missing }")
+	return ""
+}
+
+// applyVariant returns the escaped text in the current font.
+func (p *texParser) applyVariant(s string) string {
+	if p.variant != "" {
+		s = strings.Map(func(c rune) rune {
+			return mathVariantChar(p.variant, c)
+		}, s)
+	}
+	return template.HTMLEscapeString(s)
+}
+
+func (p *texParser) identifier(s string) string {
+	if p.variant == "normal" {
+		return `<mi mathvariant="normal">` + template.HTMLEscapeString(s) + "</mi>"
+	}
+	return "<mi>" + p.applyVariant(s) + "</mi>"
+}
+
+func operator(s string) string {
+	return "<mo>" + template.HTMLEscapeString(s) + "</mo>"
+}
+
+// parseAtom parses a single element. limits is true for operators that take
+// their scripts below and above in display math.
+func (p *texParser) parseAtom() (atom string, limits bool) {
+	c := p.src[p.pos]
+	switch {
+	case c == '{':
+		return p.parseGroup(), false
+	case c == '^' || c == '_':
+		return "<mrow></mrow>", false // script without base
+	case c >= '0' && c <= '9' || c == '.' && p.pos+1 < len(p.src) && p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9':
+		start := p.pos
+		for p.pos < len(p.src) && (p.src[p.pos] >= '0' && p.src[p.pos] <= '9' || p.src[p.pos] == '.') {
+			p.pos++
+		}
+		return "<mn>" + p.applyVariant(p.src[start:p.pos]) + "</mn>", false
+	case c == '\\':
+		return p.parseCommand()
+	case c == '~':
+		p.pos++
+		return "<mtext> </mtext>", false
+	case c == '\'':
+		p.pos++
+		return operator("′"), false
+	case c == '-':
+		p.pos++
+		return operator("−"), false
+	case c == '*':
+		p.pos++
+		return operator("∗"), false
+	case c == '(' || c == ')' || c == '[' || c == ']' || c == '|':
+		p.pos++
+		return `<mo stretchy="false">` + string(c) + "</mo>", false
+	}
+
+	r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+	p.pos += size
+	if unicode.IsLetter(r) {
+		return p.identifier(string(r)), false
+	}
+	return operator(string(r)), false
+}
+
+func (p *texParser) parseCommand() (string, bool) {
+	start := p.pos
+	name := p.readCommand()
+	if name == "" {
+		p.fail("missing command name")
+		return "", false
+	}
+
+	if s, ok := mathGreek[name]; ok {
+		return p.identifier(s), false
+	}
+	if s, ok := mathSymbols[name]; ok {
+		return `<mi mathvariant="normal">` + s + "</mi>", false
+	}
+	if s, ok := mathOperators[name]; ok {
+		return operator(s), false
+	}
+	if op, ok := mathBigOperators[name]; ok {
+		return `<mo largeop="true" movablelimits="false">` + op.char + "</mo>", op.limits
+	}
+	if limits, ok := mathFunctions[name]; ok {
+		text := name
+		if name == "liminf" || name == "limsup" {
+			text = name[:3] + " " + name[3:]
+		}
+		return "<mi>" + text + "</mi>", limits
+	}
+	if width, ok := mathSpaces[name]; ok {
+		return `<mspace width="` + width + `"/>`, false
+	}
+	if variant, ok := mathFonts[name]; ok {
+		saved := p.variant
+		p.variant = variant
+		arg := p.parseArg()
+		p.variant = saved
+		return arg, false
+	}
+	if accent, ok := mathAccents[name]; ok {
+		base := p.parseArg()
+		if accent.under {
+			return `<munder accentunder="true">` + base + `<mo stretchy="true">` + template.HTMLEscapeString(accent.char) + "</mo></munder>", false
+		}
+		return `<mover accent="true">` + base + `<mo stretchy="true">` + template.HTMLEscapeString(accent.char) + "</mo></mover>", false
+	}
+
+	switch name {
+	case "{", "}", "|", "#", "%", "&", "$", "_":
+		if name == "|" {
+			name = "‖"
+		}
+		return operator(name), false
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num := p.parseArg()
+		den := p.parseArg()
+		return "<mfrac>" + num + den + "</mfrac>", false
+	case "binom":
+		n := p.parseArg()
+		k := p.parseArg()
+		return `<mrow><mo>(</mo><mfrac linethickness="0">` + n + k + `</mfrac><mo>)</mo></mrow>`, false
+	case "sqrt":
+		p.skipSpace()
+		index := ""
+		if p.pos < len(p.src) && p.src[p.pos] == '[' {
+			end := strings.IndexByte(p.src[p.pos:], ']')
+			if end < 0 {
+				p.fail("missing ]")
+				return "", false
+			}
+			sub := &texParser{src: p.src[p.pos+1 : p.pos+end], display: p.display}
+			items := sub.parseList()
+			if sub.err == nil && sub.pos < len(sub.src) {
+				sub.fail("unexpected " + sub.stopToken())
+			}
+			if sub.err != nil {
+				p.err = &mathError{p.pos + 1 + sub.err.Pos, sub.err.Msg}
+				return "", false
+			}
+			index = "<mrow>" + strings.Join(items, "") + "</mrow>"
+			p.pos += end + 1
+		}
+		arg := p.parseArg()
+		if index != "" {
+			return "<mroot>" + arg + index + "</mroot>", false
+		}
+		return "<msqrt>" + arg + "</msqrt>", false
+	case "text", "textrm", "textnormal", "mbox", "textit", "textbf":
+		text := p.readText()
+		variant := ""
+		switch name {
+		case "textit":
+			variant = ` mathvariant="italic"`
+		case "textbf":
+			variant = ` mathvariant="bold"`
+		}
+		return "<mtext" + variant + ">" + template.HTMLEscapeString(text) + "</mtext>", false
+	case "operatorname":
+		return "<mi>" + template.HTMLEscapeString(p.readText()) + "</mi>", false
+	case "left":
+		open := p.readDelimiter()
+		items := p.parseList()
+		if p.err != nil {
+			return "", false
+		}
+		if p.peekCommand() != "right" {
+			p.pos = start
+			p.fail(`\left without \right`)
+			return "", false
+		}
+		p.readCommand()
+		close := p.readDelimiter()
+		return "<mrow>" + fence(open) + strings.Join(items, "") + fence(close) + "</mrow>", false
+	case "right":
+		p.pos = start
+		p.fail(`\right without \left`)
+		return "", false
+	case "big", "Big", "bigg", "Bigg", "bigl", "Bigl", "biggl", "Biggl", "bigr", "Bigr", "biggr", "Biggr", "bigm", "Bigm":
+		size := map[string]string{"big": "1.2em", "Big": "1.8em", "bigg": "2.4em", "Bigg": "3em"}[strings.TrimRight(name, "lrm")]
+		delim := p.readDelimiter()
+		return `<mo stretchy="true" symmetric="true" minsize="` + size + `" maxsize="` + size + `">` + template.HTMLEscapeString(delim) + "</mo>", false
+	case "begin":
+		return p.parseEnvironment(start), false
+	case "end":
+		p.pos = start
+		p.fail(`\end without \begin`)
+		return "", false
+	}
+	p.pos = start
+	p.fail(`unknown command \` + name)
+	return "", false
+}
+
+// readDelimiter reads the delimiter after \left, \right or \big.
+func (p *texParser) readDelimiter() string {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		p.fail("missing delimiter")
+		return ""
+	}
+	if p.src[p.pos] != '\\' {
+		c := p.src[p.pos]
+		if strings.IndexByte("()[]|/.", c) < 0 {
+			p.fail("invalid delimiter " + string(c))
+			return ""
+		}
+		p.pos++
+		if c == '.' {
+			return "" // no delimiter
+		}
+		return string(c)
+	}
+	name := p.peekCommand()
+	delim, ok := mathDelimiters[name]
+	if !ok {
+		p.fail(`invalid delimiter \` + name)
+		return ""
+	}
+	p.readCommand()
+	return delim
+}
+
+func fence(delim string) string {
+	if delim == "" {
+		return ""
+	}
+	return `<mo fence="true" stretchy="true">` + template.HTMLEscapeString(delim) + "</mo>"
+}
+
+// parseEnvironment parses \begin{name}...\end{name} as a table. Rows are
+// separated by \\ and cells by &.
+func (p *texParser) parseEnvironment(start int) string {
+	name := p.readText()
+	if p.err != nil {
+		return ""
+	}
+	env, ok := mathEnvironments[name]
+	if !ok {
+		p.pos = start
+		p.fail("unknown environment " + name)
+		return ""
+	}
+	if name == "array" {
+		p.readText() // column specification
+	}
+
+	var rows [][]string
+	row := []string{}
+	for p.err == nil {
+		items := p.parseList()
+		if p.err != nil {
+			return ""
+		}
+		row = append(row, "<mtd>"+strings.Join(items, "")+"</mtd>")
+		if p.pos >= len(p.src) {
+			p.pos = start
+			p.fail(`missing \end{` + name + "}")
+			return ""
+		}
+		switch p.stopToken() {
+		case "&":
+			p.pos++
+			continue
+		case `\\`:
+			p.pos += 2
+			rows = append(rows, row)
+			row = []string{}
+			continue
+		case `\end`:
+			p.readCommand()
+			end := p.readText()
+			if p.err == nil && end != name {
+				p.fail(`\begin{` + name + `} ended by \end{` + end + "}")
+			}
+		default:
+			p.fail("unexpected " + p.stopToken())
+		}
+		break
+	}
+	if p.err != nil {
+		return ""
+	}
+	// A \\ at the end of the last row doesn't start a new row.
+	if len(row) != 1 || row[0] != "<mtd></mtd>" || len(rows) == 0 {
+		rows = append(rows, row)
+	}
+
+	var buf strings.Builder
+	buf.WriteString("<mrow>")
+	buf.WriteString(fence(env.open))
+	buf.WriteString("<mtable")
+	if env.align != "" {
+		buf.WriteString(` columnalign="` + env.align + `"`)
+	}
+	if strings.HasPrefix(name, "align") || name == "split" || name == "gathered" {
+		buf.WriteString(` displaystyle="true"`)
+	}
+	buf.WriteString(">")
+	for _, row := range rows {
+		buf.WriteString("<mtr>" + strings.Join(row, "") + "</mtr>")
+	}
+	buf.WriteString("</mtable>")
+	buf.WriteString(fence(env.close))
+	buf.WriteString("</mrow>")
+	return buf.String()
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Navigation menus are named lists of links that the skin shows, like the
+// "header" and "footer" menus. Their names are set in the configuration
+// (menus). An item links to a page or post, or to any other URL, like
+// /archive/ or another site. Items are in the order set in the admin.
+//
+// A header menu without items shows the pages at the top of the page tree
+// instead, like before menus could be edited.
+//
+// Menus are loaded once and kept until a menu or a page changes.
+
+// MenuItem is a link in a navigation menu.
+type MenuItem struct {
+	Id       int64
+	Menu     string // name of the menu
+	Position int
+	PageId   int64  // 0 for links
+	Target   string // for links: a path within the blog or an absolute URL
+	Label    string // title as entered, "" to use the title of the page
+	Modified time.Time
+	page     *Page
+}
+
+// Page returns the page or post this item links to, or nil.
+func (item *MenuItem) Page() *Page {
+	if item.page == nil && item.PageId != 0 {
+		item.page = PageFromQuery(blog, PAGE_TYPE_NONE, FETCH_TITLE, "id=?", "", item.PageId)
+	}
+	return item.page
+}
+
+// Title returns the text of the link.
+func (item *MenuItem) Title() string {
+	if item.Label != "" {
+		return item.Label
+	}
+	if page := item.Page(); page != nil {
+		return page.Title
+	}
+	return item.Target
+}
+
+// Url returns the URL of the link, without urlprefix for links within the
+// blog.
+func (item *MenuItem) Url() string {
+	if item.PageId != 0 {
+		if page := item.Page(); page != nil {
+			return page.Url()
+		}
+		return ""
+	}
+	return item.Target
+}
+
+// Href returns the URL to link to, with urlprefix for links within the
+// blog.
+func (item *MenuItem) Href() string {
+	url := item.Url()
+	if strings.HasPrefix(url, "/") {
+		return blog.URLPrefix + url
+	}
+	return url
+}
+
+// visible returns whether the item is shown: links always are, and pages
+// when they're published.
+func (item *MenuItem) visible() bool {
+	if item.PageId == 0 {
+		return true
+	}
+	page := item.Page()
+	return page != nil && !page.Published.IsZero()
+}
+
+// navMenus holds the visible items of all menus.
+type navMenus struct {
+	menus        map[string][]*MenuItem
+	etag         string
+	lastModified time.Time
+}
+
+// navMenus returns the items of all menus (lazy load).
+func (b *Blog) navMenus() *navMenus {
+	b.menusLock.Lock()
+	defer b.menusLock.Unlock()
+	if b.menus == nil {
+		b.menus = loadNavMenus(b)
+	}
+	return b.menus
+}
+
+// resetMenus discards the loaded menus, after a menu or a page changed.
+func (b *Blog) resetMenus() {
+	b.menusLock.Lock()
+	b.menus = nil
+	b.menusLock.Unlock()
+}
+
+func loadNavMenus(b *Blog) *navMenus {
+	m := &navMenus{menus: make(map[string][]*MenuItem)}
+	var etag []string
+	var pages Pages
+	for _, item := range b.menuItems("") {
+		if !item.visible() {
+			continue
+		}
+		m.menus[item.Menu] = append(m.menus[item.Menu], item)
+		etag = append(etag, item.Menu, item.Title(), item.Url())
+		m.lastModified = lastTime(m.lastModified, item.Modified)
+		if page := item.Page(); page != nil {
+			pages = append(pages, page)
+		}
+	}
+
+	if len(m.menus["header"]) == 0 {
+		for _, page := range b.pageTree().visibleChildren(0) {
+			m.menus["header"] = append(m.menus["header"], &MenuItem{Menu: "header", PageId: page.Id, page: page})
+			etag = append(etag, "header", page.Title, page.Url())
+			pages = append(pages, page)
+		}
+	}
+
+	m.etag = makeETag(false, etag...)
+	m.lastModified = lastTime(m.lastModified, pages.LastModified())
+	return m
+}
+
+// Menu returns the visible items of a menu.
+func (b *Blog) Menu(name string) []*MenuItem {
+	return b.navMenus().menus[name]
+}
+
+// menuItems returns all items of a menu (or of all menus when name is ""),
+// including items of pages that aren't published.
+func (b *Blog) menuItems(name string) []*MenuItem {
+	where := ""
+	var args []interface{}
+	if name != "" {
+		where = "WHERE menu=?"
+		args = append(args, name)
+	}
+	rows, err := b.db.Query("SELECT id, menu, position, page, target, title, modified FROM menu_items "+where+" ORDER BY menu, position", args...)
+	checkError(err, "could not fetch menu items")
+	defer rows.Close()
+
+	var items []*MenuItem
+	for rows.Next() {
+		item := &MenuItem{}
+		var modified int64
+		err := rows.Scan(&item.Id, &item.Menu, &item.Position, &item.PageId, &item.Target, &item.Label, &modified)
+		checkError(err, "could not scan menu item")
+		item.Modified = importTime(modified)
+		items = append(items, item)
+	}
+	return items
+}
+
+// isMenu returns whether a menu with this name is configured.
+func (b *Blog) isMenu(name string) bool {
+	for _, menu := range b.Menus {
+		if menu == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseMenuItem checks a new item entered in the admin: either a page id or
+// a URL, with an optional title.
+func parseMenuItem(page, target, title string) (*MenuItem, error) {
+	item := &MenuItem{
+		Target: strings.TrimSpace(target),
+		Label:  strings.TrimSpace(title),
+	}
+	if page != "" && page != "0" {
+		id, err := strconv.ParseInt(page, 10, 64)
+		if err != nil {
+			return nil, errors.New("invalid page")
+		}
+		if PageFromQuery(blog, PAGE_TYPE_NONE, FETCH_TITLE, "id=?", "", id) == nil {
+			return nil, errors.New("page does not exist")
+		}
+		item.PageId = id
+		item.Target = ""
+		return item, nil
+	}
+	if item.Target == "" {
+		return nil, errors.New("choose a page or enter a URL")
+	}
+	if !strings.HasPrefix(item.Target, "/") && !strings.HasPrefix(item.Target, "http://") && !strings.HasPrefix(item.Target, "https://") {
+		return nil, errors.New("the URL must be a path like /archive/ or a URL starting with http:// or https://")
+	}
+	if item.Label == "" {
+		return nil, errors.New("a link needs a title")
+	}
+	return item, nil
+}
+
+// addMenuItem adds an item at the end of a menu.
+func (b *Blog) addMenuItem(name string, item *MenuItem) {
+	items := b.menuItems(name)
+	item.Menu = name
+	item.Position = len(items) + 1
+	item.Modified = time.Now()
+	_, err := b.db.Exec("INSERT INTO menu_items (menu, position, page, target, title, modified) VALUES (?, ?, ?, ?, ?, ?)",
+		item.Menu, item.Position, item.PageId, item.Target, item.Label, exportTime(item.Modified))
+	checkError(err, "could not add menu item")
+	b.menuChanged()
+}
+
+// moveMenuItem applies an action of the menu admin to an item: "up" and
+// "down" move it within its menu and "remove" removes it.
+func (b *Blog) moveMenuItem(id int64, action string) error {
+	var menu string
+	row := b.db.QueryRow("SELECT menu FROM menu_items WHERE id=?", id)
+	if err := row.Scan(&menu); err != nil {
+		return errors.New("menu item does not exist")
+	}
+	items := b.menuItems(menu)
+	index := 0
+	for i, item := range items {
+		if item.Id == id {
+			index = i
+		}
+	}
+
+	switch action {
+	case "up":
+		if index == 0 {
+			return nil
+		}
+		items[index-1], items[index] = items[index], items[index-1]
+	case "down":
+		if index == len(items)-1 {
+			return nil
+		}
+		items[index], items[index+1] = items[index+1], items[index]
+	case "remove":
+		_, err := b.db.Exec("DELETE FROM menu_items WHERE id=?", id)
+		checkError(err, "could not remove menu item")
+		items = append(items[:index], items[index+1:]...)
+	default:
+		return errors.New("unknown action " + strconv.Quote(action))
+	}
+
+	// Renumber the items. They all get a new modification time, so the
+	// Last-Modified time of pages changes even when an item was removed.
+	tx, err := b.db.Begin()
+	checkError(err, "could not start transaction")
+	modified := exportTime(time.Now())
+	for i, item := range items {
+		_, err := tx.Exec("UPDATE menu_items SET position=?, modified=? WHERE id=?", i+1, modified, item.Id)
+		checkError(err, "could not update menu item")
+	}
+	checkError(tx.Commit(), "could not update menu")
+	b.menuChanged()
+	return nil
+}
+
+// menuChanged is called after a menu was edited.
+func (b *Blog) menuChanged() {
+	b.resetMenus()
+	b.cache.invalidate()
+}
+
+// menuPageOptions returns the pages and posts that can be added to a menu.
+func (b *Blog) menuPageOptions() (pages, posts Pages) {
+	tree := b.pageTree()
+	for _, page := range tree.pages {
+		if !page.Published.IsZero() {
+			pages = append(pages, page)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return tree.path(pages[i]) < tree.path(pages[j])
+	})
+	posts = PagesFromQuery(b, PAGE_TYPE_POST, FETCH_TITLE, "published!=0", "ORDER BY published DESC")
+	return
+}
+
+// MenusHandler shows the navigation menus, to add, move and remove items.
+func MenusHandler(w http.ResponseWriter, r *http.Request) {
+	res := NewAuthenticatedResponse(w, r)
+	if res == nil {
+		return
+	}
+
+	if r.Method == "POST" {
+		var err error
+		if value := r.PostFormValue("action"); value != "" {
+			// The buttons have the action and the item as value, like "up 5".
+			action, item, _ := strings.Cut(value, " ")
+			var id int64
+			id, err = strconv.ParseInt(item, 10, 64)
+			if err == nil {
+				err = blog.moveMenuItem(id, action)
+			}
+		} else if menu := r.PostFormValue("menu"); !blog.isMenu(menu) {
+			err = errors.New("unknown menu " + strconv.Quote(menu))
+		} else {
+			var item *MenuItem
+			item, err = parseMenuItem(r.PostFormValue("page"), r.PostFormValue("target"), r.PostFormValue("title"))
+			if err == nil {
+				blog.addMenuItem(menu, item)
+			}
+		}
+		if err != nil {
+			res.data["menuError"] = err.Error()
+		} else {
+			w.Header().Set("Location", r.URL.String())
+			w.WriteHeader(303)
+			return
+		}
+	}
+
+	type menu struct {
+		Name  string
+		Items []*MenuItem
+	}
+	var menus []menu
+	for _, name := range blog.Menus {
+		menus = append(menus, menu{name, blog.menuItems(name)})
+	}
+
+	res.tpl = "menus"
+	res.data["title"] = "Navigation menus"
+	res.data["editMenus"] = menus
+	res.data["pages"], res.data["posts"] = blog.menuPageOptions()
+	res.Output(w, r, time.Time{})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are kept per process. In CGI mode every request is a new process,
+// so they are only useful with FastCGI or the HTTP(S) server.
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_http_requests_total",
+		Help: "Number of HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	metricRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blog_http_request_duration_seconds",
+		Help:    "Time spent handling HTTP requests by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	metricConditionalRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_http_conditional_requests_total",
+		Help: "Conditional requests, by whether they could be answered with 304 Not Modified (hit) or not (miss).",
+	}, []string{"result"})
+	metricTemplateRender = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blog_template_render_seconds",
+		Help:    "Time spent parsing and executing templates.",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 2, 12),
+	}, []string{"template"})
+	metricSCSSCompile = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "blog_scss_compile_seconds",
+		Help:    "Time spent compiling SCSS assets.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 10),
+	})
+	metricDBQuery = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "blog_db_query_seconds",
+		Help:    "Time spent fetching pages from the database, by page type.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 14),
+	}, []string{"type"})
+	metricPageCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_page_cache_requests_total",
+		Help: "Page cache lookups by result (hit or miss).",
+	}, []string{"result"})
+	metricHookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_hook_deliveries_total",
+		Help: "Completed hook deliveries by status (ok or failed).",
+	}, []string{"status"})
+	metricDiagrams = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_diagrams_total",
+		Help: "Diagrams by result (cached, rendered or error).",
+	}, []string{"result"})
+	metricLogins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "blog_logins_total",
+		Help: "Login attempts by result (success or failure).",
+	}, []string{"result"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricRequests,
+		metricRequestDuration,
+		metricConditionalRequests,
+		metricTemplateRender,
+		metricSCSSCompile,
+		metricDBQuery,
+		metricPageCache,
+		metricHookDeliveries,
+		metricDiagrams,
+		metricLogins,
+	)
+}
+
+// metricsMiddleware counts requests per route. It runs as mux middleware, so
+// the matched route is known.
+func metricsMiddleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+
+		route := routeName(r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		metricRequests.WithLabelValues(route, r.Method, strconv.Itoa(sw.status)).Inc()
+		metricRequestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// routeName returns the name of the matched route, or its path template if
+// it has no name.
+func routeName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	if name := route.GetName(); name != "" {
+		return name
+	}
+	tpl, _ := route.GetPathTemplate()
+	return tpl
+}
+
+// observeSince records the time elapsed since start in the given histogram.
+func observeSince(o prometheus.Observer, start time.Time) {
+	o.Observe(time.Since(start).Seconds())
+}
+
+// metricsHandler serves the metrics, using HTTP basic authentication when a
+// metrics user is configured.
+func (b *Blog) metricsHandler() http.Handler {
+	h := promhttp.Handler()
+	if b.MetricsUser == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(b.MetricsUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(b.MetricsPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveMetrics starts a separate metrics server when metrics-addr is
+// configured. Otherwise metrics are served by the normal router, but only with
+// a metrics user.
+func (b *Blog) serveMetrics() {
+	if b.MetricsEnabled && b.MetricsAddr == "" && b.MetricsUser == "" {
+		// They would be public.
+		logger.Warn("metrics are not served: set metrics-addr, or metrics-user and metrics-password")
+	}
+	if !b.MetricsEnabled || b.MetricsAddr == "" {
+		return
+	}
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", b.metricsHandler())
+		err := http.ListenAndServe(b.MetricsAddr, mux)
+		checkError(err, "could not bind to metrics address")
+	}()
+}
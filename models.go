@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aykevl/south"
@@ -40,6 +42,11 @@ type Page struct {
 	Published time.Time
 	Modified  time.Time
 	Text      string
+	TOC       bool  // show a table of contents
+	ParentId  int64 // parent of a static page, 0 at the top
+	Position  int   // position in the menu between pages with the same parent, or of a post in its series
+	Hidden    bool  // not shown in the menu
+	SeriesId  int64 // series of a post, 0 for none
 	author    *User
 }
 
@@ -66,9 +73,9 @@ type Pages []*Page
 func PagesFromQuery(blog *Blog, pageType PageType, hint Hint, whereClause, otherClauses string, args ...interface{}) Pages {
 	var pages []*Page
 
-	query := "SELECT id, name, title, type, author, summary, published, modified FROM pages "
+	query := "SELECT id, name, title, type, author, summary, published, modified, parent, position, hidden, series FROM pages "
 	if hint == FETCH_ALL {
-		query = "SELECT id, name, title, type, author, summary, created, published, modified, text FROM pages "
+		query = "SELECT id, name, title, type, author, summary, published, modified, parent, position, hidden, series, created, text, toc FROM pages "
 	}
 
 	if pageType == PAGE_TYPE_NONE {
@@ -88,6 +95,12 @@ func PagesFromQuery(blog *Blog, pageType PageType, hint Hint, whereClause, other
 
 	query += otherClauses
 
+	typeLabel := PageTypeNames[pageType]
+	if typeLabel == "" {
+		typeLabel = "any"
+	}
+	defer observeSince(metricDBQuery.WithLabelValues(typeLabel), time.Now())
+
 	rows, err := blog.db.Query(query, args...)
 	checkError(err, "failed to fetch list of pages")
 	defer rows.Close()
@@ -97,11 +110,11 @@ func PagesFromQuery(blog *Blog, pageType PageType, hint Hint, whereClause, other
 		var publishedUnix, modifiedUnix int64
 
 		if hint == FETCH_TITLE {
-			err = rows.Scan(&page.Id, &page.Name, &page.Title, &page.Type, &page.AuthorId, &page.Summary, &publishedUnix, &modifiedUnix)
+			err = rows.Scan(&page.Id, &page.Name, &page.Title, &page.Type, &page.AuthorId, &page.Summary, &publishedUnix, &modifiedUnix, &page.ParentId, &page.Position, &page.Hidden, &page.SeriesId)
 		} else {
 			var createdUnix int64
 
-			err = rows.Scan(&page.Id, &page.Name, &page.Title, &page.Type, &page.AuthorId, &page.Summary, &createdUnix, &publishedUnix, &modifiedUnix, &page.Text)
+			err = rows.Scan(&page.Id, &page.Name, &page.Title, &page.Type, &page.AuthorId, &page.Summary, &publishedUnix, &modifiedUnix, &page.ParentId, &page.Position, &page.Hidden, &page.SeriesId, &createdUnix, &page.Text, &page.TOC)
 
 			page.Created = importTime(createdUnix)
 		}
@@ -130,9 +143,9 @@ func (p *Page) Author() *User {
 func (p *Page) Url() string {
 	switch p.Type {
 	case PAGE_TYPE_POST:
-		return p.Published.Format("/2006/01/") + p.Name
+		return blog.postURL.url(p)
 	case PAGE_TYPE_STATIC:
-		return "/" + p.Name
+		return blog.pageTree().path(p)
 	default:
 		raiseError("unknown page type while generating url")
 		// We will never get here.
@@ -140,6 +153,14 @@ func (p *Page) Url() string {
 	}
 }
 
+// publicURL returns the URL of this page if it's published, or "" otherwise.
+func (p *Page) publicURL() string {
+	if p.Id == 0 || p.Published.IsZero() {
+		return ""
+	}
+	return p.Url()
+}
+
 // LastModified returns the HTTP Last-Modified time, which is the last time
 // anything got changed on this object.
 func (p *Page) LastModified() time.Time {
@@ -149,23 +170,74 @@ func (p *Page) LastModified() time.Time {
 	return lastTime(p.Published, p.Modified)
 }
 
-func (p *Page) Update(blog *Blog, author *User, name, title, summary, text string) {
+// ETag returns a strong entity tag of the contents of this page. It changes
+// whenever the page is edited or (un)published, so it is also used to detect
+// concurrent edits in the admin interface.
+func (p *Page) ETag() string {
+	return makeETag(false, strconv.FormatInt(p.Id, 10), p.Name, p.Title, strconv.Itoa(int(p.Type)),
+		strconv.FormatInt(p.AuthorId, 10), p.Summary, p.Text, strconv.FormatBool(p.TOC),
+		strconv.FormatInt(p.ParentId, 10), strconv.Itoa(p.Position), strconv.FormatBool(p.Hidden), strconv.FormatInt(p.SeriesId, 10),
+		strconv.FormatInt(exportTime(p.Published), 10), strconv.FormatInt(exportTime(p.Modified), 10))
+}
+
+// checkName checks whether a page can have this name: posts need a name that
+// no other post has, and static pages a name that no other page below the
+// same parent (0 for the top) has.
+//
+// Neither may get a URL that is used by the blog itself, like /admin/ for a
+// post named admin with the permalink /{name}/.
+func (p *Page) checkName(blog *Blog, name string, parentId int64) error {
+	var url string
+	if p.Type == PAGE_TYPE_STATIC {
+		tree := blog.pageTree()
+		if other := tree.child(parentId, name); other != nil && other.Id != p.Id {
+			return errors.New("there already is a page named " + strconv.Quote(name) + " at " + tree.path(other))
+		}
+		url = "/" + name
+		if parent := tree.pages[parentId]; parent != nil {
+			url = tree.path(parent) + url
+		}
+	} else {
+		if PageFromQuery(blog, p.Type, FETCH_TITLE, "name=? AND id!=?", "", name, p.Id) != nil {
+			return errors.New("there already is a post named " + strconv.Quote(name))
+		}
+		page := *p
+		page.Name = name
+		if page.Published.IsZero() {
+			page.Published = time.Now() // the URL may contain the date
+		}
+		url = blog.postURL.url(&page)
+	}
+	if route := blog.routeName(blog.URLPrefix + url); route != "post" && route != "page" {
+		return errors.New("the URL " + url + " is used by the blog itself")
+	}
+	return nil
+}
+
+func (p *Page) Update(blog *Blog, author *User, name, title, summary, text string, toc bool) {
+	oldURLs := blog.publicURLs(p)
+	textChanged := title != p.Title || summary != p.Summary || text != p.Text
+
 	p.Name = name
 	p.Title = title
 	p.Summary = summary
 	p.AuthorId = author.id
 	p.Text = text
+	p.TOC = toc
 	p.Modified = time.Now()
 
+	event := EVENT_UPDATE
 	if p.Id == 0 {
+		event = EVENT_CREATE
+
 		if p.Type == PAGE_TYPE_NONE {
 			raiseError("type is not defined while inserting page")
 		}
 
 		p.Created = p.Modified
 
-		result, err := blog.db.Exec("INSERT INTO pages (name, title, type, author, summary, text, created, modified) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
-			p.Name, p.Title, p.Type, p.AuthorId, p.Summary, p.Text, exportTime(p.Created), exportTime(p.Modified))
+		result, err := blog.db.Exec("INSERT INTO pages (name, title, type, author, summary, text, toc, created, modified) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			p.Name, p.Title, p.Type, p.AuthorId, p.Summary, p.Text, p.TOC, exportTime(p.Created), exportTime(p.Modified))
 		checkError(err, "could not insert page")
 
 		p.Id, err = result.LastInsertId()
@@ -175,27 +247,106 @@ func (p *Page) Update(blog *Blog, author *User, name, title, summary, text strin
 		}
 
 	} else {
-		_, err := blog.db.Exec("UPDATE pages SET name=?, title=?, summary=?, text=?, modified=? WHERE id=?",
-			p.Name, p.Title, p.Summary, p.Text, exportTime(p.Modified), p.Id)
+		_, err := blog.db.Exec("UPDATE pages SET name=?, title=?, summary=?, text=?, toc=?, modified=? WHERE id=?",
+			p.Name, p.Title, p.Summary, p.Text, p.TOC, exportTime(p.Modified), p.Id)
 		checkError(err, "could not update page")
 	}
+	blog.resetPageTree()
+	blog.pagesMoved(p, oldURLs)
+
+	// Drafts aren't visible to the public, so cached pages are still valid
+	// (unless published pages below it got a new URL).
+	if !p.Published.IsZero() || len(oldURLs) != 0 {
+		blog.cache.invalidate()
+	}
+	if p.Type == PAGE_TYPE_POST && !p.Published.IsZero() {
+		blog.updatePostLinks(textChanged)
+	}
+	blog.fireEvent(event, p)
 }
 
 // Publish updates the published time, making this page visible worldwide.
 func (p *Page) Publish(blog *Blog) {
+	oldURLs := blog.publicURLs(p)
 	p.Published = time.Now()
 
 	_, err := blog.db.Exec("UPDATE Pages SET published=? WHERE id=?", exportTime(p.Published), p.Id)
 	checkError(err, "could not publish page")
+	blog.resetPageTree()
+	blog.pagesMoved(p, oldURLs)
+	if p.Type == PAGE_TYPE_POST {
+		blog.updatePostLinks(true)
+	}
+	blog.cache.invalidate()
+	blog.fireEvent(EVENT_PUBLISH, p)
 }
 
 // Unpublish undoes publishing. It resets the published time to zero.
 func (p *Page) Unpublish(blog *Blog) {
+	// A post gets a new URL when it's published again in another month. The
+	// redirect is only used once the page is published again.
+	if url := p.publicURL(); url != "" {
+		blog.addRedirect(url, p.Id, "")
+	}
 	p.Published = time.Time{} // nil value
 
 	// We could also just simply set to 0
 	_, err := blog.db.Exec("UPDATE Pages SET published=? WHERE id=?", exportTime(p.Published), p.Id)
 	checkError(err, "could not unpublish page")
+	blog.resetPageTree()
+	if p.Type == PAGE_TYPE_POST {
+		blog.updatePostLinks(true)
+		// The post is no longer listed, which doesn't make any other
+		// post newer.
+		touchSeries(blog, p.SeriesId)
+	}
+	blog.cache.invalidate()
+	blog.fireEvent(EVENT_UNPUBLISH, p)
+}
+
+// Delete removes this page from the database. Its subpages move up to its
+// parent, which fails when a page there already has the name of one of them.
+func (p *Page) Delete(blog *Blog) error {
+	// Pages below this page move up, so their names must be free there.
+	if p.Type == PAGE_TYPE_STATIC {
+		tree := blog.pageTree()
+		var parentId int64
+		if parent := tree.parent(p); parent != nil {
+			parentId = parent.Id
+		}
+		var clashes []string
+		for _, child := range tree.children[p.Id] {
+			if other := tree.child(parentId, child.Name); other != nil && other.Id != p.Id {
+				clashes = append(clashes, child.Name)
+			}
+		}
+		if len(clashes) != 0 {
+			return errors.New("the subpages " + strings.Join(clashes, ", ") + " would move up next to pages with the same name; rename or move them first")
+		}
+	}
+
+	oldURLs := blog.publicURLs(p)
+	delete(oldURLs, p.Id)
+
+	_, err := blog.db.Exec("UPDATE pages SET parent=? WHERE parent=? AND type=?", p.ParentId, p.Id, PAGE_TYPE_STATIC)
+	checkError(err, "could not move subpages")
+	_, err = blog.db.Exec("DELETE FROM pages WHERE id=?", p.Id)
+	checkError(err, "could not delete page")
+	_, err = blog.db.Exec("DELETE FROM redirects WHERE page=?", p.Id)
+	checkError(err, "could not delete redirects to page")
+	_, err = blog.db.Exec("DELETE FROM menu_items WHERE page=?", p.Id)
+	checkError(err, "could not delete menu items of page")
+	blog.resetPageTree()
+	blog.pagesMoved(nil, oldURLs)
+	if p.Type == PAGE_TYPE_POST && !p.Published.IsZero() {
+		blog.updatePostLinks(true)
+		touchSeries(blog, p.SeriesId)
+	}
+	if !p.Published.IsZero() || len(oldURLs) != 0 {
+		blog.cache.invalidate()
+	}
+	blog.fireEvent(EVENT_DELETE, p)
+	return nil
 }
 
 // LastModified returns the latest Last-Modified date for all pages.
@@ -212,6 +363,15 @@ func (ps Pages) LastModified() time.Time {
 	return lm
 }
 
+// ETag returns an entity tag of the contents of all pages, in this order.
+func (ps Pages) ETag() string {
+	etags := make([]string, len(ps))
+	for i, p := range ps {
+		etags[i] = p.ETag()
+	}
+	return makeETag(false, etags...)
+}
+
 // authenticated user
 type User struct {
 	id    int64
@@ -243,14 +403,17 @@ func NewUser(blog *Blog, w http.ResponseWriter, r *http.Request) (*User, error)
 		err := row.Scan(&email, &passwordHash)
 		if err == sql.ErrNoRows {
 			// no user with this email address
+			metricLogins.WithLabelValues("failure").Inc()
 			return nil, ErrInvalidUser
 		}
 		checkError(err, "could not fetch information about user")
 
 		if !verifyPassword(r.PostFormValue("password"), passwordHash) {
 			// password doesn't match
+			metricLogins.WithLabelValues("failure").Inc()
 			return nil, ErrInvalidUser
 		}
+		metricLogins.WithLabelValues("success").Inc()
 
 		token, err := blog.SessionStore().NewToken(email)
 		checkError(err, "could not create token")
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Static pages form a tree: a page can have a parent page, and its URL is the
+// path of names from the top, like /docs/install. Names only need to be
+// unique between pages with the same parent, so /docs/install and
+// /guide/install can both exist. Pages at the top are shown in the menu,
+// ordered by their position, unless they're hidden from the menu. The same
+// goes for the subpages shown on a page.
+//
+// The tree of all static pages is loaded once and kept until a page changes,
+// so URLs, the menu and breadcrumbs don't need to query the database.
+
+// MAX_PAGE_DEPTH limits the depth of the tree, and ends loops in broken trees.
+const MAX_PAGE_DEPTH = 16
+
+// pageTree holds all static pages, with their parents and children.
+type pageTree struct {
+	pages        map[int64]*Page
+	children     map[int64]Pages // ordered children by parent id (0 is the top)
+	published    Pages           // all published pages, for the entity tag
+	etag         string
+	lastModified time.Time
+}
+
+// pageTree returns the tree of static pages (lazy load).
+func (b *Blog) pageTree() *pageTree {
+	b.treeLock.Lock()
+	defer b.treeLock.Unlock()
+	if b.tree == nil {
+		b.tree = loadPageTree(b)
+	}
+	return b.tree
+}
+
+// resetPageTree discards the loaded tree, after a page changed. The menus
+// link to pages too, so they're discarded as well.
+func (b *Blog) resetPageTree() {
+	b.treeLock.Lock()
+	b.tree = nil
+	b.treeLock.Unlock()
+	b.resetMenus()
+}
+
+func loadPageTree(b *Blog) *pageTree {
+	// Pages with the same position are ordered by title, like the menu was
+	// ordered before it could be ordered by hand.
+	pages := PagesFromQuery(b, PAGE_TYPE_STATIC, FETCH_TITLE, "", "ORDER BY position, title DESC")
+
+	t := &pageTree{
+		pages:    make(map[int64]*Page, len(pages)),
+		children: make(map[int64]Pages),
+	}
+	for _, p := range pages {
+		t.pages[p.Id] = p
+	}
+	for _, p := range pages {
+		parent := p.ParentId
+		if t.pages[parent] == nil {
+			parent = 0 // the parent was removed
+		}
+		t.children[parent] = append(t.children[parent], p)
+		if !p.Published.IsZero() {
+			t.published = append(t.published, p)
+		}
+	}
+	t.etag = t.published.ETag()
+	t.lastModified = t.published.LastModified()
+	return t
+}
+
+// parent returns the parent of a page, or nil for pages at the top.
+func (t *pageTree) parent(p *Page) *Page {
+	if p.ParentId == p.Id {
+		return nil
+	}
+	return t.pages[p.ParentId]
+}
+
+// ancestors returns the parents of a page, starting at the top.
+func (t *pageTree) ancestors(p *Page) Pages {
+	var ancestors Pages
+	for parent := t.parent(p); parent != nil && len(ancestors) < MAX_PAGE_DEPTH; parent = t.parent(parent) {
+		ancestors = append(Pages{parent}, ancestors...)
+	}
+	return ancestors
+}
+
+// path returns the URL of a static page.
+func (t *pageTree) path(p *Page) string {
+	var path strings.Builder
+	for _, parent := range t.ancestors(p) {
+		path.WriteString("/" + parent.Name)
+	}
+	path.WriteString("/" + p.Name)
+	return path.String()
+}
+
+// child returns the page with this name below a page (0 for the top), or nil.
+func (t *pageTree) child(parentId int64, name string) *Page {
+	for _, p := range t.children[parentId] {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// lookup returns the page at a path of names from the top, or nil.
+func (t *pageTree) lookup(names []string) *Page {
+	var p *Page
+	var parentId int64
+	for _, name := range names {
+		if p = t.child(parentId, name); p == nil {
+			return nil
+		}
+		parentId = p.Id
+	}
+	return p
+}
+
+// siblingIndex returns the position of a page between the pages with the
+// same parent, starting at 0.
+func (t *pageTree) siblingIndex(p *Page) int {
+	var parentId int64
+	if parent := t.parent(p); parent != nil {
+		parentId = parent.Id
+	}
+	for i, sibling := range t.children[parentId] {
+		if sibling.Id == p.Id {
+			return i
+		}
+	}
+	return -1
+}
+
+// descendants returns all pages below a page.
+func (t *pageTree) descendants(id int64) Pages {
+	var pages Pages
+	var add func(id int64, depth int)
+	add = func(id int64, depth int) {
+		if depth > MAX_PAGE_DEPTH {
+			return
+		}
+		for _, child := range t.children[id] {
+			pages = append(pages, child)
+			add(child.Id, depth+1)
+		}
+	}
+	add(id, 0)
+	return pages
+}
+
+// visibleChildren returns the published children of a page (0 for the top)
+// that aren't hidden from the menu.
+func (t *pageTree) visibleChildren(id int64) Pages {
+	var pages Pages
+	for _, p := range t.children[id] {
+		if !p.Published.IsZero() && !p.Hidden {
+			pages = append(pages, p)
+		}
+	}
+	return pages
+}
+
+// Children returns the visible subpages of a static page.
+func (p *Page) Children() Pages {
+	if p.Type != PAGE_TYPE_STATIC {
+		return nil
+	}
+	return blog.pageTree().visibleChildren(p.Id)
+}
+
+// Breadcrumbs returns the published parents of a static page, starting at the
+// top.
+func (p *Page) Breadcrumbs() Pages {
+	if p.Type != PAGE_TYPE_STATIC {
+		return nil
+	}
+	var pages Pages
+	for _, parent := range blog.pageTree().ancestors(p) {
+		if !parent.Published.IsZero() {
+			pages = append(pages, parent)
+		}
+	}
+	return pages
+}
+
+// SetMenu moves a static page below another page (0 for the top), at a
+// position between its new siblings (-1 for the end), and sets whether it's
+// hidden from the menu. Pages below it move along.
+func (p *Page) SetMenu(blog *Blog, parentId int64, position int, hidden bool) error {
+	if p.Type != PAGE_TYPE_STATIC {
+		return errors.New("only pages can be in the menu")
+	}
+	tree := blog.pageTree()
+	if parentId != 0 {
+		parent := tree.pages[parentId]
+		if parent == nil {
+			return errors.New("parent page does not exist")
+		}
+		if parentId == p.Id {
+			return errors.New("a page cannot be its own parent")
+		}
+		for _, ancestor := range tree.ancestors(parent) {
+			if ancestor.Id == p.Id {
+				return errors.New("a page cannot be moved below its own subpage")
+			}
+		}
+		if len(tree.ancestors(parent)) >= MAX_PAGE_DEPTH-1 {
+			return errors.New("pages are nested too deep")
+		}
+	}
+	if other := tree.child(parentId, p.Name); other != nil && other.Id != p.Id {
+		return errors.New("there already is a page named " + strconv.Quote(p.Name) + " at " + tree.path(other))
+	}
+
+	oldURLs := blog.publicURLs(p)
+
+	// Renumber the new siblings, with this page at its position.
+	var siblings Pages
+	for _, sibling := range tree.children[parentId] {
+		if sibling.Id != p.Id {
+			siblings = append(siblings, sibling)
+		}
+	}
+	if position < 0 || position > len(siblings) {
+		position = len(siblings)
+	}
+	siblings = append(siblings[:position], append(Pages{p}, siblings[position:]...)...)
+
+	tx, err := blog.db.Begin()
+	checkError(err, "could not start transaction")
+	for i, sibling := range siblings {
+		_, err := tx.Exec("UPDATE pages SET position=? WHERE id=?", i+1, sibling.Id)
+		checkError(err, "could not update menu position")
+	}
+	_, err = tx.Exec("UPDATE pages SET parent=?, hidden=? WHERE id=?", parentId, hidden, p.Id)
+	checkError(err, "could not update parent page")
+	checkError(tx.Commit(), "could not update menu")
+
+	p.ParentId = parentId
+	p.Position = position + 1
+	p.Hidden = hidden
+	blog.resetPageTree()
+	blog.pagesMoved(p, oldURLs)
+	blog.cache.invalidate()
+	return nil
+}
+
+// moveInMenu applies an action of the menu editor to a page: "up" and "down"
+// move it between its siblings, "indent" moves it below the sibling before it,
+// "outdent" moves it after its parent and "hide" and "show" set whether it's
+// in the menu.
+func (b *Blog) moveInMenu(id int64, action string) error {
+	tree := b.pageTree()
+	if tree.pages[id] == nil {
+		return errors.New("page does not exist")
+	}
+	page := *tree.pages[id] // the tree may be in use by other requests
+	p := &page
+	parent := tree.parent(p)
+	var parentId int64
+	if parent != nil {
+		parentId = parent.Id
+	}
+	siblings := tree.children[parentId]
+	index := tree.siblingIndex(p)
+
+	switch action {
+	case "up":
+		if index == 0 {
+			return nil
+		}
+		return p.SetMenu(b, parentId, index-1, p.Hidden)
+	case "down":
+		if index == len(siblings)-1 {
+			return nil
+		}
+		return p.SetMenu(b, parentId, index+1, p.Hidden)
+	case "indent":
+		if index == 0 {
+			return errors.New("the first page cannot be indented")
+		}
+		return p.SetMenu(b, siblings[index-1].Id, -1, p.Hidden)
+	case "outdent":
+		if parent == nil {
+			return errors.New("the page is already at the top")
+		}
+		var grandparentId int64
+		if grandparent := tree.parent(parent); grandparent != nil {
+			grandparentId = grandparent.Id
+		}
+		position := 0
+		for i, sibling := range tree.children[grandparentId] {
+			if sibling.Id == parent.Id {
+				position = i + 1
+			}
+		}
+		return p.SetMenu(b, grandparentId, position, p.Hidden)
+	case "hide", "show":
+		return p.SetMenu(b, parentId, index, action == "hide")
+	default:
+		return errors.New("unknown action " + strconv.Quote(action))
+	}
+}
+
+// menuEntry is a page in the menu editor.
+type menuEntry struct {
+	Page     *Page
+	Depth    int
+	First    bool // first of its siblings
+	Last     bool // last of its siblings
+	Children []*menuEntry
+}
+
+// menuEntries returns the tree of all static pages for the menu editor.
+func (t *pageTree) menuEntries(id int64, depth int) []*menuEntry {
+	if depth > MAX_PAGE_DEPTH {
+		return nil
+	}
+	children := t.children[id]
+	entries := make([]*menuEntry, len(children))
+	for i, p := range children {
+		entries[i] = &menuEntry{
+			Page:     p,
+			Depth:    depth,
+			First:    i == 0,
+			Last:     i == len(children)-1,
+			Children: t.menuEntries(p.Id, depth+1),
+		}
+	}
+	return entries
+}
+
+// parentOptions returns the pages that can be the parent of a page: all
+// static pages except the page itself and its subpages, sorted by URL.
+func (t *pageTree) parentOptions(p *Page) Pages {
+	exclude := make(map[int64]bool)
+	if p.Id != 0 {
+		exclude[p.Id] = true
+		for _, child := range t.descendants(p.Id) {
+			exclude[child.Id] = true
+		}
+	}
+	var pages Pages
+	for _, page := range t.pages {
+		if !exclude[page.Id] {
+			pages = append(pages, page)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return t.path(pages[i]) < t.path(pages[j])
+	})
+	return pages
+}
+
+// MenuHandler shows the tree of static pages, to change the menu.
+func MenuHandler(w http.ResponseWriter, r *http.Request) {
+	res := NewAuthenticatedResponse(w, r)
+	if res == nil {
+		return
+	}
+
+	if r.Method == "POST" {
+		// The buttons have the action and the page as value, like "up 5".
+		action, page, _ := strings.Cut(r.PostFormValue("action"), " ")
+		id, err := strconv.ParseInt(page, 10, 64)
+		if err == nil {
+			err = blog.moveInMenu(id, action)
+		}
+		if err != nil {
+			res.data["menuError"] = err.Error()
+		} else {
+			w.Header().Set("Location", r.URL.String())
+			w.WriteHeader(303)
+			return
+		}
+	}
+
+	res.tpl = "menu"
+	res.data["title"] = "Menu"
+	res.data["entries"] = blog.pageTree().menuEntries(0, 0)
+	res.Output(w, r, time.Time{})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// The URL of posts is configured with a pattern, like /{year}/{month}/{name}.
+// Both the route of posts and Page.Url are made from it, so they always
+// match. The fields are:
+//
+//	{year}   year of publication, like 2006
+//	{month}  month of publication, like 01
+//	{day}    day of publication, like 02
+//	{name}   name of the post (required)
+//	{id}     number of the post
+//
+// When the pattern changes, the old URLs of all posts redirect to the new
+// URLs (see redirectPermalinks).
+
+// DEFAULT_PERMALINK is the pattern for post URLs, which was the only one
+// before it could be configured.
+const DEFAULT_PERMALINK = "/{year}/{month}/{name}"
+
+type permalinkField struct {
+	pattern string // regular expression for the router
+	value   func(p *Page) string
+}
+
+var permalinkFields = map[string]permalinkField{
+	"year":  {`[0-9]{4}`, func(p *Page) string { return p.Published.Format("2006") }},
+	"month": {`0[1-9]|1[0-2]`, func(p *Page) string { return p.Published.Format("01") }},
+	"day":   {`0[1-9]|[12][0-9]|3[01]`, func(p *Page) string { return p.Published.Format("02") }},
+	"name":  {`[a-z0-9]+(?:-[a-z0-9]+)*`, func(p *Page) string { return p.Name }},
+	"id":    {`[1-9][0-9]*`, func(p *Page) string { return strconv.FormatInt(p.Id, 10) }},
+}
+
+// permalink is a parsed permalink pattern.
+type permalink struct {
+	parts []string // literal text and {field} parts
+}
+
+// parsePermalink checks and parses a permalink pattern.
+func parsePermalink(pattern string) (*permalink, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New("permalink must start with /")
+	}
+	if pattern == "/{name}" {
+		return nil, errors.New("permalink /{name} is used by pages")
+	}
+
+	pl := &permalink{}
+	seen := make(map[string]bool)
+	for s := pattern; s != ""; {
+		start := strings.IndexByte(s, '{')
+		if start < 0 {
+			start = len(s)
+		}
+		if start != 0 {
+			literal := s[:start]
+			for _, c := range literal {
+				if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.ContainsRune("/-_.", c)) {
+					return nil, errors.New("permalink may not contain " + strconv.QuoteRune(c))
+				}
+			}
+			pl.parts = append(pl.parts, literal)
+			s = s[start:]
+			continue
+		}
+
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return nil, errors.New("permalink has { without }")
+		}
+		field := s[1:end]
+		if _, ok := permalinkFields[field]; !ok {
+			return nil, errors.New("unknown field {" + field + "} in permalink")
+		}
+		if seen[field] {
+			return nil, errors.New("field {" + field + "} is used twice in permalink")
+		}
+		seen[field] = true
+		if len(pl.parts) != 0 && strings.HasPrefix(pl.parts[len(pl.parts)-1], "{") {
+			return nil, errors.New("fields in permalink must be separated, like {year}/{month}")
+		}
+		pl.parts = append(pl.parts, s[:end+1])
+		s = s[end+1:]
+	}
+	if !seen["name"] {
+		return nil, errors.New("permalink must contain {name}")
+	}
+	return pl, nil
+}
+
+// route returns the pattern for the router.
+func (pl *permalink) route() string {
+	var route strings.Builder
+	for _, part := range pl.parts {
+		if strings.HasPrefix(part, "{") {
+			field := part[1 : len(part)-1]
+			route.WriteString("{" + field + ":" + permalinkFields[field].pattern + "}")
+		} else {
+			route.WriteString(part)
+		}
+	}
+	return route.String()
+}
+
+// url returns the URL of a post (without urlprefix).
+func (pl *permalink) url(p *Page) string {
+	var url strings.Builder
+	for _, part := range pl.parts {
+		if strings.HasPrefix(part, "{") {
+			url.WriteString(permalinkFields[part[1:len(part)-1]].value(p))
+		} else {
+			url.WriteString(part)
+		}
+	}
+	return url.String()
+}
+
+// routeName returns the name of the route that serves a URL path (with
+// urlprefix), like "admin" for /admin/. Posts and pages can't be at the URLs
+// of other routes, as those come first.
+func (b *Blog) routeName(url string) string {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return ""
+	}
+	var match mux.RouteMatch
+	if !b.mux.Match(r, &match) || match.Route == nil {
+		return ""
+	}
+	return match.Route.GetName()
+}
+
+// redirectPermalinks adds redirects from the URLs of all published posts
+// under the previous permalink pattern, after it was changed in the
+// configuration.
+func (b *Blog) redirectPermalinks() {
+	if b.PermalinkActive == b.Permalink {
+		return
+	}
+
+	old, err := parsePermalink(b.PermalinkActive)
+	if err != nil {
+		checkWarning(err, "could not add redirects from the previous permalink")
+	} else {
+		posts := PagesFromQuery(b, PAGE_TYPE_POST, FETCH_TITLE, "published!=0", "")
+		for _, post := range posts {
+			if from := old.url(post); from != post.Url() {
+				b.addRedirect(from, post.Id, "")
+			}
+		}
+		if logger != nil {
+			logger.Info("permalink changed, old URLs redirect to the new URLs", "from", b.PermalinkActive, "to", b.Permalink, "posts", len(posts))
+		}
+	}
+
+	b.PermalinkActive = b.Permalink
+	b.Config.Update()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Redirects keep old URLs working. When the URL of a published page changes
+// (it's renamed, or a post is published again in another month), the old URL
+// is stored as a redirect to the page. These follow the page, so a page that
+// moved twice doesn't need a chain of redirects. Admins can also add manual
+// redirects to any URL.
+//
+// Redirects are only served for URLs that would otherwise be a 404 error, so
+// they can never hide a page.
+
+// Redirect is an old URL path (without urlprefix) that redirects to a page or
+// to a manually entered target.
+type Redirect struct {
+	Id      int64
+	Path    string
+	PageId  int64  // 0 for manual redirects
+	Target  string // a path within the blog or an absolute URL, for manual redirects
+	Created time.Time
+	page    *Page
+}
+
+// Page returns the page this redirect leads to, or nil if it's a manual
+// redirect or the page was removed.
+func (r *Redirect) Page() *Page {
+	if r.page == nil && r.PageId != 0 {
+		r.page = PageFromQuery(blog, PAGE_TYPE_NONE, FETCH_TITLE, "id=?", "", r.PageId)
+	}
+	return r.page
+}
+
+// Redirects returns all redirects, ordered by path.
+func (b *Blog) Redirects() []*Redirect {
+	rows, err := b.db.Query("SELECT id, path, page, target, created FROM redirects ORDER BY path")
+	checkError(err, "could not fetch redirects")
+	defer rows.Close()
+
+	var redirects []*Redirect
+	for rows.Next() {
+		r := &Redirect{}
+		var created int64
+		err := rows.Scan(&r.Id, &r.Path, &r.PageId, &r.Target, &created)
+		checkError(err, "could not scan redirect")
+		r.Created = importTime(created)
+		redirects = append(redirects, r)
+	}
+	return redirects
+}
+
+// addRedirect stores a redirect from path, replacing an existing redirect
+// from the same path.
+func (b *Blog) addRedirect(path string, pageId int64, target string) {
+	_, err := b.db.Exec("DELETE FROM redirects WHERE path=?", path)
+	checkError(err, "could not replace redirect")
+	_, err = b.db.Exec("INSERT INTO redirects (path, page, target, created) VALUES (?, ?, ?, ?)",
+		path, pageId, target, exportTime(time.Now()))
+	checkError(err, "could not add redirect")
+}
+
+// deleteRedirect removes a redirect by its id.
+func (b *Blog) deleteRedirect(id int64) {
+	_, err := b.db.Exec("DELETE FROM redirects WHERE id=?", id)
+	checkError(err, "could not delete redirect")
+}
+
+// publicURLs returns the public URLs of a page and the pages below it, by id.
+func (b *Blog) publicURLs(p *Page) map[int64]string {
+	urls := make(map[int64]string)
+	if url := p.publicURL(); url != "" {
+		urls[p.Id] = url
+	}
+	if p.Type == PAGE_TYPE_STATIC && p.Id != 0 {
+		for _, child := range b.pageTree().descendants(p.Id) {
+			if url := child.publicURL(); url != "" {
+				urls[child.Id] = url
+			}
+		}
+	}
+	return urls
+}
+
+// pagesMoved is called after the URL of a page (and the pages below it) may
+// have changed. oldURLs are the URLs before, from publicURLs. The page may be
+// nil when only the pages below it moved.
+func (b *Blog) pagesMoved(p *Page, oldURLs map[int64]string) {
+	var pages Pages
+	if p != nil {
+		pages = append(pages, p)
+	}
+	tree := b.pageTree()
+	for id := range oldURLs {
+		if page := tree.pages[id]; page != nil && (p == nil || id != p.Id) {
+			pages = append(pages, page)
+		}
+	}
+
+	for _, page := range pages {
+		if page.Published.IsZero() {
+			continue
+		}
+		newURL := page.Url()
+		if oldURL := oldURLs[page.Id]; oldURL != "" && oldURL != newURL {
+			b.addRedirect(oldURL, page.Id, "")
+		}
+		// The page is at this URL now, so a redirect from here is never used.
+		_, err := b.db.Exec("DELETE FROM redirects WHERE path=?", newURL)
+		checkError(err, "could not delete redirect")
+	}
+}
+
+// redirectFor returns the URL that a path (without urlprefix) redirects to,
+// or "" when there is no redirect.
+func (b *Blog) redirectFor(path string) string {
+	var pageId int64
+	var target string
+	row := b.db.QueryRow("SELECT page, target FROM redirects WHERE path=?", path)
+	if err := row.Scan(&pageId, &target); err == sql.ErrNoRows {
+		return ""
+	} else {
+		checkError(err, "could not fetch redirect")
+	}
+
+	if pageId != 0 {
+		// Only redirect to pages that are visible.
+		page := PageFromQuery(b, PAGE_TYPE_NONE, FETCH_TITLE, "id=? AND published!=0", "", pageId)
+		if page == nil || page.Url() == path {
+			return ""
+		}
+		return b.URLPrefix + page.Url()
+	}
+	if strings.HasPrefix(target, "/") {
+		return b.URLPrefix + target
+	}
+	return target
+}
+
+// serveRedirect sends a redirect for the request if there is one, and returns
+// whether it did.
+func (b *Blog) serveRedirect(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if !strings.HasPrefix(r.URL.Path, b.URLPrefix+"/") {
+		return false
+	}
+	target := b.redirectFor(strings.TrimPrefix(r.URL.Path, b.URLPrefix))
+	if target == "" {
+		return false
+	}
+	if r.URL.RawQuery != "" && !strings.Contains(target, "?") {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusMovedPermanently)
+	return true
+}
+
+// parseRedirect checks a manual redirect entered in the admin.
+func parseRedirect(from, to string) (string, string, error) {
+	from = strings.TrimSpace(from)
+	to = strings.TrimSpace(to)
+	if !strings.HasPrefix(from, "/") || strings.ContainsAny(from, " ?#") {
+		return "", "", errors.New("the old URL must be a path like /old/page, without the urlprefix")
+	}
+	if !strings.HasPrefix(to, "/") && !strings.HasPrefix(to, "http://") && !strings.HasPrefix(to, "https://") {
+		return "", "", errors.New("the target must be a path like /new/page or a URL starting with http:// or https://")
+	}
+	if from == to {
+		return "", "", errors.New("the old URL and the target are the same")
+	}
+	return from, to, nil
+}
+
+// RedirectsHandler lists all redirects, and adds or removes manual
+// redirects.
+func RedirectsHandler(w http.ResponseWriter, r *http.Request) {
+	res := NewAuthenticatedResponse(w, r)
+	if res == nil {
+		return
+	}
+
+	if r.Method == "POST" {
+		var err error
+		if id := r.PostFormValue("delete"); id != "" {
+			var redirectId int64
+			redirectId, err = strconv.ParseInt(id, 10, 64)
+			if err == nil {
+				blog.deleteRedirect(redirectId)
+			}
+		} else {
+			var from, to string
+			from, to, err = parseRedirect(r.PostFormValue("from"), r.PostFormValue("to"))
+			if err == nil {
+				blog.addRedirect(from, 0, to)
+			}
+		}
+		if err != nil {
+			res.data["redirectError"] = err.Error()
+			res.data["from"] = r.PostFormValue("from")
+			res.data["to"] = r.PostFormValue("to")
+		} else {
+			w.Header().Set("Location", r.URL.String())
+			w.WriteHeader(303)
+			return
+		}
+	}
+
+	res.tpl = "redirects"
+	res.data["title"] = "Redirects"
+	res.data["redirects"] = blog.Redirects()
+	res.Output(w, r, time.Time{})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Every published post links to the posts published before and after it, and
+// to related posts: the posts that share the most distinctive words with it
+// (by TF-IDF over the title, summary and text). These links are computed for
+// all posts whenever a published post changes, and stored, so showing a post
+// needs no text of other posts.
+//
+// The links of a post have their own modification time. When a neighbour is
+// unpublished or deleted, the pages of the posts next to it change even
+// though those posts weren't edited.
+
+// relatedMinScore is the minimal similarity of related posts, so posts that
+// only share a few words aren't shown.
+const relatedMinScore = 0.05
+
+// postLinks are the stored links of a post to other posts.
+type postLinks struct {
+	previous int64
+	next     int64
+	related  []int64
+	modified time.Time
+}
+
+// equal returns whether the links are the same, ignoring the modification
+// time.
+func (l *postLinks) equal(other *postLinks) bool {
+	if l.previous != other.previous || l.next != other.next || len(l.related) != len(other.related) {
+		return false
+	}
+	for i := range l.related {
+		if l.related[i] != other.related[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// loadPostLinks returns the stored links of a post (or of all posts when id
+// is 0), by post id.
+func (b *Blog) loadPostLinks(id int64) map[int64]*postLinks {
+	query := "SELECT page, previous, next, related, modified FROM post_links"
+	var args []interface{}
+	if id != 0 {
+		query += " WHERE page=?"
+		args = append(args, id)
+	}
+	rows, err := b.db.Query(query, args...)
+	checkError(err, "could not fetch post links")
+	defer rows.Close()
+
+	links := make(map[int64]*postLinks)
+	for rows.Next() {
+		var page, modified int64
+		var related string
+		l := &postLinks{}
+		err := rows.Scan(&page, &l.previous, &l.next, &related, &modified)
+		checkError(err, "could not scan post links")
+		l.related = parseIds(related)
+		l.modified = importTime(modified)
+		links[page] = l
+	}
+	return links
+}
+
+// parseIds parses a list of ids like "3,12,7".
+func parseIds(s string) []int64 {
+	var ids []int64
+	for _, field := range strings.Split(s, ",") {
+		if id, err := strconv.ParseInt(field, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// updatePostLinks computes the links of all published posts, and stores
+// those that changed. Related posts need the text of all posts and compare
+// every post with every other post, so they're only computed again when
+// withRelated is true: when a post is published or unpublished, or the text
+// of a published post changed. Otherwise only the previous and next posts are
+// updated.
+func (b *Blog) updatePostLinks(withRelated bool) {
+	hint := Hint(FETCH_TITLE)
+	if withRelated {
+		hint = FETCH_ALL
+	}
+	posts := PagesFromQuery(b, PAGE_TYPE_POST, hint, "published!=0", "ORDER BY published, id")
+	oldLinks := b.loadPostLinks(0)
+	var related map[int64][]int64
+	if withRelated {
+		related = relatedPosts(posts, b.RelatedPosts)
+	}
+
+	now := time.Now()
+	tx, err := b.db.Begin()
+	checkError(err, "could not start transaction")
+	keep := make([]string, len(posts))
+	for i, post := range posts {
+		keep[i] = strconv.FormatInt(post.Id, 10)
+
+		links := &postLinks{related: related[post.Id]}
+		if old := oldLinks[post.Id]; old != nil && !withRelated {
+			links.related = old.related
+		}
+		if i > 0 {
+			links.previous = posts[i-1].Id
+		}
+		if i < len(posts)-1 {
+			links.next = posts[i+1].Id
+		}
+		if old := oldLinks[post.Id]; old != nil && old.equal(links) {
+			continue
+		}
+
+		ids := make([]string, len(links.related))
+		for j, id := range links.related {
+			ids[j] = strconv.FormatInt(id, 10)
+		}
+		_, err := tx.Exec("DELETE FROM post_links WHERE page=?", post.Id)
+		checkError(err, "could not replace post links")
+		_, err = tx.Exec("INSERT INTO post_links (page, previous, next, related, modified) VALUES (?, ?, ?, ?, ?)",
+			post.Id, links.previous, links.next, strings.Join(ids, ","), exportTime(now))
+		checkError(err, "could not store post links")
+	}
+	// Posts that aren't published (anymore) have no links.
+	_, err = tx.Exec("DELETE FROM post_links WHERE page NOT IN (" + strings.Join(append(keep, "0"), ",") + ")")
+	checkError(err, "could not delete post links")
+	checkError(tx.Commit(), "could not update post links")
+}
+
+// postTerms returns how often each word occurs in a post.
+func postTerms(p *Page) map[string]int {
+	terms := make(map[string]int)
+	text := strings.ToLower(p.Title + " " + p.Summary + " " + p.Text)
+	words := strings.FieldsFunc(text, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	for _, word := range words {
+		// Short words are mostly stop words or Markdown leftovers.
+		if len([]rune(word)) >= 3 {
+			terms[word]++
+		}
+	}
+	return terms
+}
+
+// relatedPosts returns for every post the ids of at most n other posts that
+// are most similar, by cosine similarity of TF-IDF vectors.
+func relatedPosts(posts Pages, n int) map[int64][]int64 {
+	related := make(map[int64][]int64)
+	if n <= 0 || len(posts) < 2 {
+		return related
+	}
+
+	// Document frequency of each word.
+	terms := make([]map[string]int, len(posts))
+	df := make(map[string]int)
+	for i, post := range posts {
+		terms[i] = postTerms(post)
+		for term := range terms[i] {
+			df[term]++
+		}
+	}
+
+	// Normalized TF-IDF vectors. Words in all posts have no weight.
+	vectors := make([]map[string]float64, len(posts))
+	for i := range posts {
+		vector := make(map[string]float64)
+		var length float64
+		for term, count := range terms[i] {
+			weight := (1 + math.Log(float64(count))) * math.Log(float64(len(posts))/float64(df[term]))
+			if weight > 0 {
+				vector[term] = weight
+				length += weight * weight
+			}
+		}
+		length = math.Sqrt(length)
+		for term := range vector {
+			vector[term] /= length
+		}
+		vectors[i] = vector
+	}
+
+	type scored struct {
+		id    int64
+		score float64
+	}
+	for i, post := range posts {
+		var candidates []scored
+		for j, other := range posts {
+			if i == j {
+				continue
+			}
+			var score float64
+			for term, weight := range vectors[i] {
+				score += weight * vectors[j][term]
+			}
+			if score >= relatedMinScore {
+				candidates = append(candidates, scored{other.Id, score})
+			}
+		}
+		sort.Slice(candidates, func(a, b int) bool {
+			if candidates[a].score != candidates[b].score {
+				return candidates[a].score > candidates[b].score
+			}
+			return candidates[a].id > candidates[b].id // newer first
+		})
+		for k := 0; k < n && k < len(candidates); k++ {
+			related[post.Id] = append(related[post.Id], candidates[k].id)
+		}
+	}
+	return related
+}
+
+// PostNeighbours are the posts linked from a post, for templates.
+type PostNeighbours struct {
+	Previous *Page // published before this post, or nil
+	Next     *Page // published after this post, or nil
+	Related  Pages
+	etag     string
+	modified time.Time
+}
+
+// neighbours returns the posts linked from a published post, or nil when
+// they haven't been computed.
+func (p *Page) neighbours(blog *Blog) *PostNeighbours {
+	if p.Type != PAGE_TYPE_POST {
+		return nil
+	}
+	links := blog.loadPostLinks(p.Id)[p.Id]
+	if links == nil {
+		return nil
+	}
+
+	ids := append([]int64{links.previous, links.next}, links.related...)
+	byId := make(map[int64]*Page)
+	var args []interface{}
+	var params []string
+	for _, id := range ids {
+		if id != 0 {
+			args = append(args, id)
+			params = append(params, "?")
+		}
+	}
+	var pages Pages
+	if len(args) != 0 {
+		pages = PagesFromQuery(blog, PAGE_TYPE_POST, FETCH_TITLE, "published!=0 AND id IN ("+strings.Join(params, ",")+")", "ORDER BY id", args...)
+	}
+	for _, page := range pages {
+		byId[page.Id] = page
+	}
+
+	n := &PostNeighbours{
+		Previous: byId[links.previous],
+		Next:     byId[links.next],
+	}
+	for _, id := range links.related {
+		if page := byId[id]; page != nil {
+			n.Related = append(n.Related, page)
+		}
+	}
+	// Titles and URLs of the linked posts are shown, so the post changes
+	// with them.
+	n.etag = makeETag(false, strconv.FormatInt(exportTime(links.modified), 10), pages.ETag())
+	n.modified = lastTime(links.modified, pages.LastModified())
+	return n
+}
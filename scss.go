@@ -0,0 +1,931 @@
+package main
+
+// A small SCSS compiler, so that no external sass binary is needed.
+//
+// It supports the commonly used subset of SCSS: variables (including
+// !default and !global), nested rules with the parent selector &, nested
+// @media and @supports, @import of partials, @mixin/@include/@content,
+// interpolation with #{...}, // comments, arithmetic and the common color
+// and number functions (see scssvalue.go). Other Sass functions, control
+// directives (@if, @each, etc.) and @extend are reported as errors.
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// scssError is a compile error with the position in the source file.
+type scssError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *scssError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+type scssStmtKind int
+
+const (
+	scssRule    scssStmtKind = iota + 1 // selector { ... }
+	scssDecl                            // property: value;
+	scssAt                              // @name params; or @name params { ... }
+	scssComment                         // /* ... */
+)
+
+type scssStmt struct {
+	kind     scssStmtKind
+	prelude  string // selector, property or "@name params"
+	value    string // declaration value
+	block    bool   // whether this is a block (has children)
+	children []*scssStmt
+	file     string
+	line     int
+}
+
+type scssParser struct {
+	file string
+	src  string
+	pos  int
+	line int
+}
+
+func parseSCSS(file, src string) ([]*scssStmt, error) {
+	p := &scssParser{file: file, src: src, line: 1}
+	return p.parseBlock(false)
+}
+
+func (p *scssParser) errorf(line int, format string, args ...interface{}) error {
+	return &scssError{p.file, line, fmt.Sprintf(format, args...)}
+}
+
+// advance moves the position forward by n bytes, counting newlines.
+func (p *scssParser) advance(n int) {
+	for i := 0; i < n && p.pos < len(p.src); i++ {
+		if p.src[p.pos] == '\n' {
+			p.line++
+		}
+		p.pos++
+	}
+}
+
+func (p *scssParser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch p.src[p.pos] {
+		case ' ', '\t', '\r', '\n', '\f':
+			p.advance(1)
+		default:
+			return
+		}
+	}
+}
+
+// skipLineComment skips a // comment up to the end of the line.
+func (p *scssParser) skipLineComment() {
+	for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+		p.pos++
+	}
+}
+
+// readComment reads a /* ... */ comment.
+func (p *scssParser) readComment() (string, error) {
+	line := p.line
+	end := strings.Index(p.src[p.pos+2:], "*/")
+	if end < 0 {
+		return "", p.errorf(line, "unterminated comment")
+	}
+	comment := p.src[p.pos : p.pos+2+end+2]
+	p.advance(len(comment))
+	return comment, nil
+}
+
+// readString reads a quoted string including the quotes.
+func (p *scssParser) readString() (string, error) {
+	line := p.line
+	quote := p.src[p.pos]
+	start := p.pos
+	p.advance(1)
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '\\':
+			p.advance(2)
+		case c == quote:
+			p.advance(1)
+			return p.src[start:p.pos], nil
+		case c == '\n':
+			return "", p.errorf(line, "unterminated string")
+		default:
+			p.advance(1)
+		}
+	}
+	return "", p.errorf(line, "unterminated string")
+}
+
+// readUntilClose reads a balanced (...) or #{...} group starting at the
+// opening character, including the closing character.
+func (p *scssParser) readUntilClose(open, close byte) (string, error) {
+	line := p.line
+	var buf strings.Builder
+	depth := 0
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"' || c == '\'':
+			s, err := p.readString()
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(s)
+			continue
+		case c == open:
+			depth++
+		case c == close:
+			depth--
+		}
+		buf.WriteByte(c)
+		p.advance(1)
+		if depth == 0 {
+			return buf.String(), nil
+		}
+	}
+	return "", p.errorf(line, "missing '%c'", close)
+}
+
+// parseBlock parses statements until the end of the block (or file).
+func (p *scssParser) parseBlock(nested bool) ([]*scssStmt, error) {
+	var stmts []*scssStmt
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			if nested {
+				return nil, p.errorf(p.line, "unexpected end of file, expected '}'")
+			}
+			return stmts, nil
+		}
+
+		switch {
+		case p.src[p.pos] == '}':
+			if !nested {
+				return nil, p.errorf(p.line, "unexpected '}'")
+			}
+			p.advance(1)
+			return stmts, nil
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			p.skipLineComment()
+			continue
+		case strings.HasPrefix(p.src[p.pos:], "/*"):
+			line := p.line
+			comment, err := p.readComment()
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, &scssStmt{kind: scssComment, prelude: comment, file: p.file, line: line})
+			continue
+		case p.src[p.pos] == ';':
+			p.advance(1)
+			continue
+		}
+
+		stmt, err := p.parseStatement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+}
+
+// parseStatement parses a single rule, declaration or at-rule.
+func (p *scssParser) parseStatement() (*scssStmt, error) {
+	stmt := &scssStmt{file: p.file, line: p.line}
+	var buf strings.Builder
+
+loop:
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '"' || c == '\'':
+			s, err := p.readString()
+			if err != nil {
+				return nil, err
+			}
+			buf.WriteString(s)
+		case c == '#' && strings.HasPrefix(p.src[p.pos:], "#{"):
+			buf.WriteByte('#')
+			p.advance(1)
+			s, err := p.readUntilClose('{', '}')
+			if err != nil {
+				return nil, err
+			}
+			buf.WriteString(s)
+		case c == '(' || c == '[':
+			close := byte(')')
+			if c == '[' {
+				close = ']'
+			}
+			// This also keeps url(http://...) intact.
+			s, err := p.readUntilClose(c, close)
+			if err != nil {
+				return nil, err
+			}
+			buf.WriteString(s)
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			p.skipLineComment()
+		case strings.HasPrefix(p.src[p.pos:], "/*"):
+			if _, err := p.readComment(); err != nil {
+				return nil, err
+			}
+		case c == '{':
+			p.advance(1)
+			stmt.block = true
+			children, err := p.parseBlock(true)
+			if err != nil {
+				return nil, err
+			}
+			stmt.children = children
+			break loop
+		case c == ';':
+			p.advance(1)
+			break loop
+		case c == '}':
+			// last declaration in a block without a semicolon
+			break loop
+		default:
+			buf.WriteByte(c)
+			p.advance(1)
+		}
+	}
+
+	text := strings.TrimSpace(buf.String())
+	switch {
+	case strings.HasPrefix(text, "@"):
+		stmt.kind = scssAt
+		stmt.prelude = text
+	case stmt.block:
+		stmt.kind = scssRule
+		stmt.prelude = text
+	default:
+		colon := indexTopLevel(text, ':')
+		if colon < 0 {
+			return nil, p.errorf(stmt.line, "expected '{' or ':' after %q", text)
+		}
+		stmt.kind = scssDecl
+		stmt.prelude = strings.TrimSpace(text[:colon])
+		stmt.value = strings.TrimSpace(text[colon+1:])
+	}
+	return stmt, nil
+}
+
+// indexTopLevel returns the index of the first c outside of strings,
+// parentheses and interpolation, or -1.
+func indexTopLevel(s string, c byte) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == '(' || s[i] == '[' || s[i] == '{':
+			depth++
+		case s[i] == ')' || s[i] == ']' || s[i] == '}':
+			depth--
+		case s[i] == c && depth == 0:
+			return i
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits s at every c outside of strings, parentheses and
+// interpolation.
+func splitTopLevel(s string, c byte) []string {
+	var parts []string
+	for {
+		i := indexTopLevel(s, c)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+type scssScope struct {
+	vars   map[string]string
+	parent *scssScope
+}
+
+func (s *scssScope) lookup(name string) (string, bool) {
+	for ; s != nil; s = s.parent {
+		if v, ok := s.vars[name]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+type scssMixin struct {
+	params []string // parameter names, without $
+	defs   []string // default values (unevaluated), "" if required
+	body   []*scssStmt
+	scope  *scssScope
+}
+
+// cssWrapper is an at-rule block (@media, @font-face, ...) around CSS
+// blocks. Wrappers are compared by identity, so two separate @media rules
+// with the same query are kept separate.
+type cssWrapper struct {
+	prelude string
+}
+
+type cssBlock struct {
+	wrappers []*cssWrapper
+	selector string // empty for declarations directly inside an at-rule
+	decls    []string
+	raw      string // raw line (comment, @import, @charset)
+}
+
+type scssContext struct {
+	selectors    []string // nil at the top level
+	wrappers     []*cssWrapper
+	block        *cssBlock // receives declarations, nil at the top level
+	scope        *scssScope
+	content      []*scssStmt // @content of the mixin being included
+	contentScope *scssScope
+}
+
+type scssCompiler struct {
+	includePaths []string
+	root         *scssScope
+	mixins       map[string]*scssMixin
+	blocks       []*cssBlock
+	importDepth  int
+}
+
+// compileSCSS compiles the SCSS file, resolving imports relative to the file
+// and then in includePaths (in order).
+func compileSCSS(filename string, includePaths []string) ([]byte, error) {
+	c := &scssCompiler{
+		includePaths: includePaths,
+		root:         &scssScope{vars: make(map[string]string)},
+		mixins:       make(map[string]*scssMixin),
+	}
+	err := c.importFile(filename, scssContext{scope: c.root}, filename, 0)
+	if err != nil {
+		return nil, err
+	}
+	return c.output(), nil
+}
+
+func (c *scssCompiler) importFile(filename string, ctx scssContext, fromFile string, fromLine int) error {
+	if c.importDepth > 50 {
+		return &scssError{fromFile, fromLine, "too many nested imports (import loop?)"}
+	}
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return &scssError{fromFile, fromLine, err.Error()}
+	}
+	stmts, err := parseSCSS(filename, string(src))
+	if err != nil {
+		return err
+	}
+	c.importDepth++
+	defer func() { c.importDepth-- }()
+	return c.eval(stmts, ctx)
+}
+
+// resolveImport finds the file for an @import, trying partials (_name.scss)
+// too.
+func (c *scssCompiler) resolveImport(name, fromFile string) (string, bool) {
+	dirs := append([]string{filepath.Dir(fromFile)}, c.includePaths...)
+	dir, base := filepath.Split(name)
+	candidates := []string{name, name + ".scss", filepath.Join(dir, "_"+base+".scss"), filepath.Join(dir, "_"+base)}
+	for _, d := range dirs {
+		for _, candidate := range candidates {
+			p := filepath.Join(d, candidate)
+			if st, err := os.Stat(p); err == nil && !st.IsDir() {
+				return p, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (c *scssCompiler) eval(stmts []*scssStmt, ctx scssContext) error {
+	for _, stmt := range stmts {
+		if ctx.block != nil && c.blocks[len(c.blocks)-1] != ctx.block && (stmt.kind == scssComment || stmt.kind == scssDecl && !strings.HasPrefix(stmt.prelude, "$")) {
+			// A nested rule or @media came in between: continue in a new
+			// block with the same selector, to keep the source order.
+			ctx.block = &cssBlock{wrappers: ctx.block.wrappers, selector: ctx.block.selector}
+			c.blocks = append(c.blocks, ctx.block)
+		}
+
+		var err error
+		switch stmt.kind {
+		case scssComment:
+			if ctx.block != nil {
+				ctx.block.decls = append(ctx.block.decls, stmt.prelude)
+			} else {
+				c.blocks = append(c.blocks, &cssBlock{wrappers: ctx.wrappers, raw: stmt.prelude})
+			}
+		case scssDecl:
+			err = c.evalDecl(stmt, ctx)
+		case scssRule:
+			err = c.evalRule(stmt, ctx)
+		case scssAt:
+			err = c.evalAtRule(stmt, ctx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *scssCompiler) evalDecl(stmt *scssStmt, ctx scssContext) error {
+	if strings.HasPrefix(stmt.prelude, "$") {
+		// variable assignment
+		name := stmt.prelude[1:]
+		value := stmt.value
+		isDefault, isGlobal := false, false
+		for {
+			value = strings.TrimSpace(value)
+			if strings.HasSuffix(value, "!default") {
+				isDefault = true
+				value = strings.TrimSuffix(value, "!default")
+			} else if strings.HasSuffix(value, "!global") {
+				isGlobal = true
+				value = strings.TrimSuffix(value, "!global")
+			} else {
+				break
+			}
+		}
+		if isDefault {
+			if _, ok := ctx.scope.lookup(name); ok {
+				return nil
+			}
+		}
+		value, err := c.evalValue(value, ctx.scope, stmt)
+		if err != nil {
+			return err
+		}
+		if isGlobal {
+			c.root.vars[name] = value
+		} else {
+			ctx.scope.vars[name] = value
+		}
+		return nil
+	}
+
+	if ctx.block == nil {
+		return &scssError{stmt.file, stmt.line, "properties are only allowed within rules"}
+	}
+	prop, err := c.interpolate(stmt.prelude, ctx.scope, stmt)
+	if err != nil {
+		return err
+	}
+	evalValue := c.evalValue
+	if strings.HasPrefix(prop, "--") {
+		// Custom properties can hold any tokens.
+		evalValue = c.substituteVars
+	}
+	value, err := evalValue(stmt.value, ctx.scope, stmt)
+	if err != nil {
+		return err
+	}
+	ctx.block.decls = append(ctx.block.decls, prop+": "+value+";")
+	return nil
+}
+
+func (c *scssCompiler) evalRule(stmt *scssStmt, ctx scssContext) error {
+	prelude, err := c.interpolate(stmt.prelude, ctx.scope, stmt)
+	if err != nil {
+		return err
+	}
+
+	var selectors []string
+	for _, child := range splitTopLevel(prelude, ',') {
+		child = strings.Join(strings.Fields(child), " ")
+		if child == "" {
+			return &scssError{stmt.file, stmt.line, "empty selector"}
+		}
+		if ctx.selectors == nil {
+			if strings.Contains(child, "&") {
+				return &scssError{stmt.file, stmt.line, "top-level selectors may not contain the parent selector '&'"}
+			}
+			selectors = append(selectors, child)
+			continue
+		}
+		for _, parent := range ctx.selectors {
+			if strings.Contains(child, "&") {
+				selectors = append(selectors, strings.Replace(child, "&", parent, -1))
+			} else {
+				selectors = append(selectors, parent+" "+child)
+			}
+		}
+	}
+
+	block := &cssBlock{wrappers: ctx.wrappers, selector: strings.Join(selectors, ",\n")}
+	c.blocks = append(c.blocks, block)
+
+	inner := ctx
+	inner.selectors = selectors
+	inner.block = block
+	inner.scope = &scssScope{vars: make(map[string]string), parent: ctx.scope}
+	return c.eval(stmt.children, inner)
+}
+
+func (c *scssCompiler) evalAtRule(stmt *scssStmt, ctx scssContext) error {
+	name := stmt.prelude[1:]
+	params := ""
+	if i := strings.IndexAny(name, " \t\r\n("); i >= 0 {
+		name, params = name[:i], strings.TrimSpace(name[i:])
+	}
+
+	switch name {
+	case "import":
+		if stmt.block {
+			break
+		}
+		return c.evalImport(params, stmt, ctx)
+
+	case "charset", "namespace":
+		if stmt.block {
+			break
+		}
+		c.blocks = append(c.blocks, &cssBlock{wrappers: ctx.wrappers, raw: stmt.prelude + ";"})
+		return nil
+
+	case "media", "supports":
+		if !stmt.block {
+			break
+		}
+		params, err := c.substituteVars(params, ctx.scope, stmt)
+		if err != nil {
+			return err
+		}
+		wrappers := append([]*cssWrapper(nil), ctx.wrappers...)
+		n := len(wrappers)
+		merged := false
+		if name == "media" && n != 0 && strings.HasPrefix(wrappers[n-1].prelude, "@media ") {
+			// Merge nested media queries, like Sass does.
+			var query string
+			query, merged = mergeMediaQueries(strings.TrimPrefix(wrappers[n-1].prelude, "@media "), params)
+			if merged {
+				wrappers[n-1] = &cssWrapper{"@media " + query}
+			}
+		}
+		if !merged {
+			wrappers = append(wrappers, &cssWrapper{"@" + name + " " + params})
+		}
+		inner := ctx
+		inner.wrappers = wrappers
+		inner.scope = &scssScope{vars: make(map[string]string), parent: ctx.scope}
+		if ctx.block != nil {
+			// Nested in a rule: the declarations go into the same selector,
+			// inside the media query.
+			inner.block = &cssBlock{wrappers: wrappers, selector: ctx.block.selector}
+			c.blocks = append(c.blocks, inner.block)
+		}
+		return c.eval(stmt.children, inner)
+
+	case "mixin":
+		if !stmt.block {
+			break
+		}
+		mixinName, args := splitCall(params)
+		mixin := &scssMixin{body: stmt.children, scope: ctx.scope}
+		for _, arg := range args {
+			param, def := arg, ""
+			if colon := indexTopLevel(arg, ':'); colon >= 0 {
+				param, def = strings.TrimSpace(arg[:colon]), strings.TrimSpace(arg[colon+1:])
+			}
+			if !strings.HasPrefix(param, "$") {
+				return &scssError{stmt.file, stmt.line, "invalid mixin parameter " + param}
+			}
+			mixin.params = append(mixin.params, param[1:])
+			mixin.defs = append(mixin.defs, def)
+		}
+		c.mixins[mixinName] = mixin
+		return nil
+
+	case "include":
+		return c.evalInclude(params, stmt, ctx)
+
+	case "content":
+		if stmt.block {
+			break
+		}
+		if ctx.content == nil {
+			return nil
+		}
+		inner := ctx
+		inner.scope = &scssScope{vars: make(map[string]string), parent: ctx.contentScope}
+		inner.content = nil
+		return c.eval(ctx.content, inner)
+
+	case "extend", "if", "else", "each", "for", "while", "function", "return", "use", "forward", "at-root":
+		return &scssError{stmt.file, stmt.line, "@" + name + " is not supported"}
+
+	case "debug", "warn":
+		return nil
+
+	case "error":
+		return &scssError{stmt.file, stmt.line, "@error " + params}
+
+	default:
+		// Other CSS at-rules, like @font-face, @keyframes and @page.
+		if !stmt.block {
+			c.blocks = append(c.blocks, &cssBlock{wrappers: ctx.wrappers, raw: stmt.prelude + ";"})
+			return nil
+		}
+		prelude, err := c.interpolate(stmt.prelude, ctx.scope, stmt)
+		if err != nil {
+			return err
+		}
+		wrappers := append(append([]*cssWrapper(nil), ctx.wrappers...), &cssWrapper{prelude})
+		block := &cssBlock{wrappers: wrappers}
+		c.blocks = append(c.blocks, block)
+		inner := ctx
+		inner.wrappers = wrappers
+		inner.selectors = nil
+		inner.block = block
+		inner.scope = &scssScope{vars: make(map[string]string), parent: ctx.scope}
+		return c.eval(stmt.children, inner)
+	}
+
+	if stmt.block {
+		return &scssError{stmt.file, stmt.line, "@" + name + " does not take a block"}
+	}
+	return &scssError{stmt.file, stmt.line, "@" + name + " requires a block"}
+}
+
+func (c *scssCompiler) evalImport(params string, stmt *scssStmt, ctx scssContext) error {
+	for _, part := range splitTopLevel(params, ',') {
+		part = strings.TrimSpace(part)
+		name := unquote(part)
+		if name == part || strings.HasSuffix(name, ".css") || strings.Contains(name, "://") {
+			// Plain CSS import: url(...), a remote file, a .css file, or an
+			// import with a media query.
+			c.blocks = append(c.blocks, &cssBlock{wrappers: ctx.wrappers, raw: "@import " + part + ";"})
+			continue
+		}
+		p, ok := c.resolveImport(name, stmt.file)
+		if !ok {
+			return &scssError{stmt.file, stmt.line, "file to import not found: " + name}
+		}
+		if err := c.importFile(p, ctx, stmt.file, stmt.line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *scssCompiler) evalInclude(params string, stmt *scssStmt, ctx scssContext) error {
+	name, args := splitCall(params)
+	mixin, ok := c.mixins[name]
+	if !ok {
+		return &scssError{stmt.file, stmt.line, "undefined mixin " + name}
+	}
+
+	scope := &scssScope{vars: make(map[string]string), parent: mixin.scope}
+	positional := 0
+	for _, arg := range args {
+		if colon := indexTopLevel(arg, ':'); colon >= 0 && strings.HasPrefix(arg, "$") {
+			// keyword argument
+			value, err := c.evalValue(strings.TrimSpace(arg[colon+1:]), ctx.scope, stmt)
+			if err != nil {
+				return err
+			}
+			scope.vars[strings.TrimSpace(arg[1:colon])] = value
+			continue
+		}
+		if positional >= len(mixin.params) {
+			return &scssError{stmt.file, stmt.line, "too many arguments for mixin " + name}
+		}
+		value, err := c.evalValue(arg, ctx.scope, stmt)
+		if err != nil {
+			return err
+		}
+		scope.vars[mixin.params[positional]] = value
+		positional++
+	}
+	for i, param := range mixin.params {
+		if _, ok := scope.vars[param]; ok {
+			continue
+		}
+		if mixin.defs[i] == "" {
+			return &scssError{stmt.file, stmt.line, "missing argument $" + param + " for mixin " + name}
+		}
+		value, err := c.evalValue(mixin.defs[i], scope, stmt)
+		if err != nil {
+			return err
+		}
+		scope.vars[param] = value
+	}
+
+	inner := ctx
+	inner.scope = scope
+	inner.content = nil
+	if stmt.block {
+		inner.content = stmt.children
+		inner.contentScope = ctx.scope
+	}
+	return c.eval(mixin.body, inner)
+}
+
+// mergeMediaQueries combines an outer and inner media query into one, which
+// is only possible for simple queries with at most one media type.
+func mergeMediaQueries(outer, inner string) (string, bool) {
+	if strings.Contains(outer, ",") || strings.Contains(inner, ",") {
+		return "", false
+	}
+	outerType := !strings.HasPrefix(outer, "(")
+	innerType := !strings.HasPrefix(inner, "(")
+	switch {
+	case outerType && innerType:
+		return "", false
+	case innerType:
+		// The media type must come first.
+		return inner + " and " + outer, true
+	default:
+		return outer + " and " + inner, true
+	}
+}
+
+// splitCall splits "name(a, b)" into the name and its arguments.
+func splitCall(s string) (string, []string) {
+	open := strings.IndexByte(s, '(')
+	if open < 0 || !strings.HasSuffix(s, ")") {
+		return strings.TrimSpace(s), nil
+	}
+	var args []string
+	for _, arg := range splitTopLevel(s[open+1:len(s)-1], ',') {
+		if arg = strings.TrimSpace(arg); arg != "" {
+			args = append(args, arg)
+		}
+	}
+	return strings.TrimSpace(s[:open]), args
+}
+
+// substituteVars substitutes variables and interpolation in text that isn't
+// evaluated, like media queries, custom properties and calc().
+func (c *scssCompiler) substituteVars(s string, scope *scssScope, stmt *scssStmt) (string, error) {
+	var buf strings.Builder
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch == '#' && i+1 < len(s) && s[i+1] == '{':
+			end := matchingBrace(s, i+1)
+			if end < 0 {
+				return "", &scssError{stmt.file, stmt.line, "unterminated interpolation"}
+			}
+			value, err := c.evalValue(s[i+2:end], scope, stmt)
+			if err != nil {
+				return "", err
+			}
+			buf.WriteString(unquote(strings.TrimSpace(value)))
+			i = end
+		case quote != 0:
+			if ch == '\\' && i+1 < len(s) {
+				buf.WriteByte(ch)
+				i++
+				ch = s[i]
+			} else if ch == quote {
+				quote = 0
+			}
+			buf.WriteByte(ch)
+		case ch == '"' || ch == '\'':
+			quote = ch
+			buf.WriteByte(ch)
+		case ch == '$':
+			end := i + 1
+			for end < len(s) && isSCSSNameChar(s[end]) {
+				end++
+			}
+			name := s[i+1 : end]
+			value, ok := scope.lookup(name)
+			if !ok {
+				return "", &scssError{stmt.file, stmt.line, "undefined variable $" + name}
+			}
+			buf.WriteString(value)
+			i = end - 1
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// interpolate only substitutes #{...}, for selectors and property names.
+func (c *scssCompiler) interpolate(s string, scope *scssScope, stmt *scssStmt) (string, error) {
+	if !strings.Contains(s, "#{") {
+		return s, nil
+	}
+	var buf strings.Builder
+	for {
+		i := strings.Index(s, "#{")
+		if i < 0 {
+			buf.WriteString(s)
+			return buf.String(), nil
+		}
+		end := matchingBrace(s, i+1)
+		if end < 0 {
+			return "", &scssError{stmt.file, stmt.line, "unterminated interpolation"}
+		}
+		value, err := c.evalValue(s[i+2:end], scope, stmt)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(s[:i])
+		buf.WriteString(unquote(value))
+		s = s[end+1:]
+	}
+}
+
+// matchingBrace returns the index of the } matching the { at s[open].
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isSCSSNameChar(c byte) bool {
+	return c == '-' || c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80
+}
+
+// unquote removes the quotes around a quoted string.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// output writes the compiled CSS, in the expanded style.
+func (c *scssCompiler) output() []byte {
+	var buf bytes.Buffer
+	var open []*cssWrapper
+	for _, block := range c.blocks {
+		if block.raw == "" && len(block.decls) == 0 {
+			continue
+		}
+
+		// Close and open the at-rules around this block.
+		common := 0
+		for common < len(open) && common < len(block.wrappers) && open[common] == block.wrappers[common] {
+			common++
+		}
+		for len(open) > common {
+			open = open[:len(open)-1]
+			buf.WriteString(strings.Repeat("  ", len(open)) + "}\n")
+		}
+		for len(open) < len(block.wrappers) {
+			buf.WriteString(strings.Repeat("  ", len(open)) + block.wrappers[len(open)].prelude + " {\n")
+			open = append(open, block.wrappers[len(open)])
+		}
+
+		indent := strings.Repeat("  ", len(open))
+		switch {
+		case block.raw != "":
+			buf.WriteString(indent + block.raw + "\n")
+		case block.selector == "":
+			for _, decl := range block.decls {
+				buf.WriteString(indent + decl + "\n")
+			}
+		default:
+			buf.WriteString(indent + strings.Replace(block.selector, "\n", "\n"+indent, -1) + " {\n")
+			for _, decl := range block.decls {
+				buf.WriteString(indent + "  " + decl + "\n")
+			}
+			buf.WriteString(indent + "}\n")
+		}
+	}
+	for len(open) > 0 {
+		open = open[:len(open)-1]
+		buf.WriteString(strings.Repeat("  ", len(open)) + "}\n")
+	}
+	return buf.Bytes()
+}
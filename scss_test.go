@@ -0,0 +1,368 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compileSCSSString compiles SCSS source, with the partials in files
+// available for @import.
+func compileSCSSString(t *testing.T, src string, files map[string]string) (string, error) {
+	dir := t.TempDir()
+	files["main.scss"] = src
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	css, err := compileSCSS(filepath.Join(dir, "main.scss"), nil)
+	return string(css), err
+}
+
+// normalizeCSS removes blank lines, as Sass puts them between rules.
+func normalizeCSS(css string) string {
+	var lines []string
+	for _, line := range strings.Split(css, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// The expected output is that of Sass (expanded style), and the colors are
+// the examples of the Sass documentation.
+var scssTests = []struct {
+	name  string
+	files map[string]string
+	scss  string
+	css   string
+}{
+	{
+		name: "plain CSS",
+		scss: `
+a { color: #0645ad; font: 12px/1.5 "Times New Roman", serif; margin: 0 -5px; }
+@media (min-width: 960px) { html { padding-left: calc(100vw - 100%); } }
+p.error { background: hsla(0, 100%, 50%, 0.12); unicode-range: U+0025-00FF; }
+`,
+		css: `
+a {
+  color: #0645ad;
+  font: 12px/1.5 "Times New Roman", serif;
+  margin: 0 -5px;
+}
+@media (min-width: 960px) {
+  html {
+    padding-left: calc(100vw - 100%);
+  }
+}
+p.error {
+  background: hsla(0, 100%, 50%, 0.12);
+  unicode-range: U+0025-00FF;
+}`,
+	},
+	{
+		name: "nesting",
+		scss: `
+.a, .b {
+  color: red;
+  .c { color: blue; }
+  > li { margin: 0; }
+}`,
+		css: `
+.a,
+.b {
+  color: red;
+}
+.a .c,
+.b .c {
+  color: blue;
+}
+.a > li,
+.b > li {
+  margin: 0;
+}`,
+	},
+	{
+		name: "parent selector",
+		scss: `
+.a {
+  &:hover { color: red; }
+  &-title { color: blue; }
+  .no-js & { display: none; }
+  & + & { margin: 0; }
+}`,
+		css: `
+.a:hover {
+  color: red;
+}
+.a-title {
+  color: blue;
+}
+.no-js .a {
+  display: none;
+}
+.a + .a {
+  margin: 0;
+}`,
+	},
+	{
+		name: "declaration order",
+		scss: `
+.a {
+  color: red;
+  @media (max-width: 600px) { color: blue; }
+  margin: 0;
+  .b { color: green; }
+  padding: 1px;
+}`,
+		css: `
+.a {
+  color: red;
+}
+@media (max-width: 600px) {
+  .a {
+    color: blue;
+  }
+}
+.a {
+  margin: 0;
+}
+.a .b {
+  color: green;
+}
+.a {
+  padding: 1px;
+}`,
+	},
+	{
+		name: "nested media",
+		scss: `
+@media screen {
+  .a {
+    @media (min-width: 10px) { color: red; }
+  }
+}`,
+		css: `
+@media screen and (min-width: 10px) {
+  .a {
+    color: red;
+  }
+}`,
+	},
+	{
+		name:  "variables",
+		files: map[string]string{"_vars.scss": "$color: blue !default;\n$size: 10px !default;"},
+		scss: `
+$color: red;
+@import "vars";
+$name: title;
+.#{$name} {
+  color: $color;
+  border: 1px solid $color;
+  $local: 2px;
+  margin: $local;
+  $global: 3px !global;
+  width: $size;
+}
+.b { padding: $global; }`,
+		css: `
+.title {
+  color: red;
+  border: 1px solid red;
+  margin: 2px;
+  width: 10px;
+}
+.b {
+  padding: 3px;
+}`,
+	},
+	{
+		name: "mixins",
+		scss: `
+@mixin box($width, $padding: 2px) {
+  width: $width;
+  padding: $padding;
+}
+@mixin small {
+  @media (max-width: 600px) { @content; }
+}
+.a {
+  @include box(10px);
+  @include box(20px, $padding: 4px);
+  @include small { display: none; }
+}`,
+		css: `
+.a {
+  width: 10px;
+  padding: 2px;
+  width: 20px;
+  padding: 4px;
+}
+@media (max-width: 600px) {
+  .a {
+    display: none;
+  }
+}`,
+	},
+	{
+		name: "unit arithmetic",
+		scss: `
+$w: 10px;
+$lh: 1.5;
+.a {
+  width: $w * 2;
+  height: $w / 4;
+  margin: $w + 5px;
+  padding: $w - 2;
+  top: (10px / 4);
+  left: -$w;
+  font: 12px/1.5 serif;
+  line-height: $lh * 2;
+  right: 2 * $w + 1px;
+  bottom: $w % 3;
+  ratio: $w / 5px;
+  width: percentage(0.2);
+  width: round(2.6px);
+  transform: translate(-$w, $w * 2);
+  content: "a" + "b";
+}`,
+		css: `
+.a {
+  width: 20px;
+  height: 2.5px;
+  margin: 15px;
+  padding: 8px;
+  top: 2.5px;
+  left: -10px;
+  font: 12px/1.5 serif;
+  line-height: 3;
+  right: 21px;
+  bottom: 1px;
+  ratio: 2;
+  width: 20%;
+  width: 3px;
+  transform: translate(-10px, 20px);
+  content: "ab";
+}`,
+	},
+	{
+		name: "color functions",
+		scss: `
+$c: #6b717f;
+.a {
+  color: $c;
+  color: darken(#b37399, 20%);
+  color: darken(#f2ece4, 40%);
+  color: lighten($c, 20%);
+  color: lighten(#036, 60%);
+  color: saturate(#c69, 20%);
+  color: desaturate(#036, 20%);
+  color: adjust-hue($c, 60deg);
+  color: complement($c);
+  color: grayscale($c);
+  color: invert(#b37399);
+  color: mix(#036, #d2e1dd);
+  color: mix(#036, #d2e1dd, 75%);
+  color: mix(rgba(242, 236, 228, 0.5), $c);
+  color: rgba($c, 0.5);
+  color: transparentize(rgba($c, 0.5), 0.2);
+  color: opacify(rgba($c, 0.5), 0.2);
+  filter: grayscale(50%) invert(1);
+}`,
+		css: `
+.a {
+  color: #6b717f;
+  color: #7c4465;
+  color: #b08b5a;
+  color: #a1a5af;
+  color: #99ccff;
+  color: #e05299;
+  color: #0a335c;
+  color: #796b7f;
+  color: #7f796b;
+  color: #757575;
+  color: #4c8c66;
+  color: #698aa2;
+  color: #355f84;
+  color: rgba(141, 144, 152, 0.75);
+  color: rgba(107, 113, 127, 0.5);
+  color: rgba(107, 113, 127, 0.3);
+  color: rgba(107, 113, 127, 0.7);
+  filter: grayscale(50%) invert(1);
+}`,
+	},
+	{
+		name: "at-rules and comments",
+		scss: `
+@charset "UTF-8";
+/* header */
+@font-face { font-family: X; src: url(x.woff); }
+.a {
+  // not in the output
+  /* in the output */
+  color: red;
+}`,
+		css: `
+@charset "UTF-8";
+/* header */
+@font-face {
+  font-family: X;
+  src: url(x.woff);
+}
+.a {
+  /* in the output */
+  color: red;
+}`,
+	},
+}
+
+func TestCompileSCSS(t *testing.T) {
+	for _, test := range scssTests {
+		t.Run(test.name, func(t *testing.T) {
+			files := make(map[string]string)
+			for name, content := range test.files {
+				files[name] = content
+			}
+			css, err := compileSCSSString(t, test.scss, files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := normalizeCSS(css), normalizeCSS(test.css); got != want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+var scssErrorTests = []struct {
+	scss string
+	err  string
+}{
+	{".a { color: $missing; }", "undefined variable $missing"},
+	{"$c: red; .a { width: $c * 2; }", "undefined operation red * 2"},
+	{".a { width: 10px + 2em; }", "incompatible units px and em"},
+	{".a { width: 10px * 2px; }", "can't multiply px by px"},
+	{".a { color: darken(1px, 10%); }", "1px is not a color"},
+	{".a { color: darken(red); }", "expected 2 arguments, got 1"},
+	{".a { width: nth(1px 2px, 1); }", "function nth() is not supported"},
+	{".a { width: math.div(10px, 2); }", "module functions like math.div are not supported"},
+	{".a { @extend .b; }", "@extend is not supported"},
+	{".a { @include missing; }", "undefined mixin missing"},
+	{".a { color: red;", "expected '}'"},
+	{"color: red;", "properties are only allowed within rules"},
+	{`@import "missing";`, "file to import not found: missing"},
+}
+
+func TestCompileSCSSErrors(t *testing.T) {
+	for _, test := range scssErrorTests {
+		_, err := compileSCSSString(t, test.scss, make(map[string]string))
+		if err == nil {
+			t.Errorf("%s: no error, expected %q", test.scss, test.err)
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %q, expected %q", test.scss, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,988 @@
+package main
+
+// Evaluation of SCSS values: variables, arithmetic and the common Sass
+// functions for colors and numbers. Parts of a value that have nothing to
+// evaluate are written as they are in the source, so plain CSS is left
+// alone: 12px/1.5 stays a shorthand while $size/1.5 is a division, like in
+// Sass. Operations and Sass functions that can't be evaluated are errors
+// instead of ending up in the CSS.
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type sassKind int
+
+const (
+	sassLiteral sassKind = iota // identifiers, lists, CSS functions, ...
+	sassNumber
+	sassColor
+	sassString // quoted string
+)
+
+// sassValue is a (partly) evaluated value.
+type sassValue struct {
+	kind     sassKind
+	text     string     // CSS text
+	num      float64    // for numbers
+	unit     string     // for numbers
+	rgba     [4]float64 // for colors: red, green and blue (0-255), alpha (0-1)
+	str      string     // for strings: the text between the quotes
+	quote    byte       // for strings
+	computed bool       // from a variable, function, parentheses or operation
+	start    int        // position in the source
+	end      int
+}
+
+func sassNumberValue(num float64, unit string) *sassValue {
+	return &sassValue{kind: sassNumber, num: num, unit: unit, text: formatSassNumber(num) + unit}
+}
+
+func sassColorValue(rgba [4]float64) *sassValue {
+	for i := range rgba {
+		max := 255.0
+		if i == 3 {
+			max = 1
+		}
+		rgba[i] = math.Max(0, math.Min(max, rgba[i]))
+	}
+	return &sassValue{kind: sassColor, rgba: rgba, text: formatSassColor(rgba)}
+}
+
+func formatSassNumber(num float64) string {
+	num = math.Round(num*1e10) / 1e10
+	if num == 0 {
+		num = 0 // no -0
+	}
+	return strconv.FormatFloat(num, 'f', -1, 64)
+}
+
+func formatSassColor(rgba [4]float64) string {
+	r, g, b := int(math.Round(rgba[0])), int(math.Round(rgba[1])), int(math.Round(rgba[2]))
+	if rgba[3] >= 1 {
+		return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+	}
+	return fmt.Sprintf("rgba(%d, %d, %d, %s)", r, g, b, formatSassNumber(rgba[3]))
+}
+
+// sassNamedColors are the basic CSS color keywords, for color functions.
+var sassNamedColors = map[string][4]float64{
+	"black":       {0, 0, 0, 1},
+	"silver":      {192, 192, 192, 1},
+	"gray":        {128, 128, 128, 1},
+	"grey":        {128, 128, 128, 1},
+	"white":       {255, 255, 255, 1},
+	"maroon":      {128, 0, 0, 1},
+	"red":         {255, 0, 0, 1},
+	"purple":      {128, 0, 128, 1},
+	"fuchsia":     {255, 0, 255, 1},
+	"green":       {0, 128, 0, 1},
+	"lime":        {0, 255, 0, 1},
+	"olive":       {128, 128, 0, 1},
+	"yellow":      {255, 255, 0, 1},
+	"navy":        {0, 0, 128, 1},
+	"blue":        {0, 0, 255, 1},
+	"teal":        {0, 128, 128, 1},
+	"aqua":        {0, 255, 255, 1},
+	"orange":      {255, 165, 0, 1},
+	"transparent": {0, 0, 0, 0},
+}
+
+// parseHexColor parses #rgb, #rgba, #rrggbb and #rrggbbaa.
+func parseHexColor(s string) ([4]float64, bool) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 || len(hex) == 4 {
+		var long strings.Builder
+		for i := 0; i < len(hex); i++ {
+			long.WriteString(hex[i:i+1] + hex[i:i+1])
+		}
+		hex = long.String()
+	}
+	if len(hex) != 6 && len(hex) != 8 {
+		return [4]float64{}, false
+	}
+	rgba := [4]float64{0, 0, 0, 1}
+	for i := 0; i < len(hex)/2; i++ {
+		n, err := strconv.ParseUint(hex[2*i:2*i+2], 16, 8)
+		if err != nil {
+			return [4]float64{}, false
+		}
+		rgba[i] = float64(n)
+	}
+	if len(hex) == 8 {
+		rgba[3] /= 255
+	}
+	return rgba, true
+}
+
+// toColor returns the color of a color value or color keyword.
+func (v *sassValue) toColor() ([4]float64, bool) {
+	if v.kind == sassColor {
+		return v.rgba, true
+	}
+	if v.kind == sassLiteral {
+		rgba, ok := sassNamedColors[strings.ToLower(v.text)]
+		return rgba, ok
+	}
+	return [4]float64{}, false
+}
+
+// rgbToHSL returns the hue (0-360) and the saturation and lightness (0-100).
+func rgbToHSL(rgba [4]float64) [3]float64 {
+	r, g, b := rgba[0]/255, rgba[1]/255, rgba[2]/255
+	max, min := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	l := (max + min) / 2
+	if max == min {
+		return [3]float64{0, 0, l * 100}
+	}
+	d := max - min
+	s := d / (1 - math.Abs(2*l-1))
+	var h float64
+	switch max {
+	case r:
+		h = math.Mod((g-b)/d+6, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	return [3]float64{h * 60, s * 100, l * 100}
+}
+
+func hslToRGB(hsl [3]float64, alpha float64) [4]float64 {
+	h := math.Mod(math.Mod(hsl[0], 360)+360, 360) / 60
+	s := math.Max(0, math.Min(100, hsl[1])) / 100
+	l := math.Max(0, math.Min(100, hsl[2])) / 100
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h, 2)-1))
+	var r, g, b float64
+	switch int(h) {
+	case 0:
+		r, g, b = c, x, 0
+	case 1:
+		r, g, b = x, c, 0
+	case 2:
+		r, g, b = 0, c, x
+	case 3:
+		r, g, b = 0, x, c
+	case 4:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	m := l - c/2
+	return [4]float64{(r + m) * 255, (g + m) * 255, (b + m) * 255, alpha}
+}
+
+// sassFunction evaluates a Sass function. It returns nil without an error
+// for a CSS function of the same name, like the grayscale() filter.
+type sassFunction func(args []*sassValue) (*sassValue, error)
+
+func colorArg(args []*sassValue, i int) ([4]float64, error) {
+	rgba, ok := args[i].toColor()
+	if !ok {
+		return rgba, fmt.Errorf("%s is not a color", args[i].text)
+	}
+	return rgba, nil
+}
+
+func numberArg(args []*sassValue, i int) (float64, error) {
+	if args[i].kind != sassNumber {
+		return 0, fmt.Errorf("%s is not a number", args[i].text)
+	}
+	return args[i].num, nil
+}
+
+// alphaArg returns an alpha value or amount, which is a number from 0 to 1
+// or a percentage.
+func alphaArg(args []*sassValue, i int) (float64, error) {
+	a, err := numberArg(args, i)
+	if args[i].unit == "%" {
+		a /= 100
+	}
+	return a, err
+}
+
+func argCount(args []*sassValue, min, max int) error {
+	switch {
+	case len(args) >= min && len(args) <= max:
+		return nil
+	case min == max:
+		return fmt.Errorf("expected %d arguments, got %d", max, len(args))
+	}
+	return fmt.Errorf("expected %d to %d arguments, got %d", min, max, len(args))
+}
+
+// adjustHSL returns a function that changes the hue, saturation or lightness
+// of a color by an amount.
+func adjustHSL(component int, sign float64) sassFunction {
+	return func(args []*sassValue) (*sassValue, error) {
+		if err := argCount(args, 2, 2); err != nil {
+			return nil, err
+		}
+		rgba, err := colorArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := numberArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		hsl := rgbToHSL(rgba)
+		hsl[component] += sign * amount
+		return sassColorValue(hslToRGB(hsl, rgba[3])), nil
+	}
+}
+
+// adjustAlpha returns a function that changes the opacity of a color.
+func adjustAlpha(sign float64) sassFunction {
+	return func(args []*sassValue) (*sassValue, error) {
+		if err := argCount(args, 2, 2); err != nil {
+			return nil, err
+		}
+		rgba, err := colorArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		amount, err := alphaArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		rgba[3] += sign * amount
+		return sassColorValue(rgba), nil
+	}
+}
+
+// roundNumber returns a function that rounds a number, keeping its unit.
+func roundNumber(round func(float64) float64) sassFunction {
+	return func(args []*sassValue) (*sassValue, error) {
+		if len(args) != 1 || args[0].kind != sassNumber {
+			// CSS round() with a rounding strategy or calc() terms.
+			return nil, nil
+		}
+		return sassNumberValue(round(args[0].num), args[0].unit), nil
+	}
+}
+
+var sassFunctions = map[string]sassFunction{
+	"lighten":        adjustHSL(2, 1),
+	"darken":         adjustHSL(2, -1),
+	"desaturate":     adjustHSL(1, -1),
+	"adjust-hue":     adjustHSL(0, 1),
+	"opacify":        adjustAlpha(1),
+	"fade-in":        adjustAlpha(1),
+	"transparentize": adjustAlpha(-1),
+	"fade-out":       adjustAlpha(-1),
+	"saturate": func(args []*sassValue) (*sassValue, error) {
+		if len(args) == 1 && args[0].kind == sassNumber {
+			return nil, nil // CSS filter
+		}
+		return adjustHSL(1, 1)(args)
+	},
+	"complement": func(args []*sassValue) (*sassValue, error) {
+		if err := argCount(args, 1, 1); err != nil {
+			return nil, err
+		}
+		return adjustHSL(0, 1)(append(args, sassNumberValue(180, "deg")))
+	},
+	"grayscale": func(args []*sassValue) (*sassValue, error) {
+		if len(args) == 1 && args[0].kind == sassNumber {
+			return nil, nil // CSS filter
+		}
+		return adjustHSL(1, -1)(append(args, sassNumberValue(100, "%")))
+	},
+	"invert": func(args []*sassValue) (*sassValue, error) {
+		if len(args) == 1 && args[0].kind == sassNumber {
+			return nil, nil // CSS filter
+		}
+		if err := argCount(args, 1, 1); err != nil {
+			return nil, err
+		}
+		rgba, err := colorArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		return sassColorValue([4]float64{255 - rgba[0], 255 - rgba[1], 255 - rgba[2], rgba[3]}), nil
+	},
+	"mix": func(args []*sassValue) (*sassValue, error) {
+		if err := argCount(args, 2, 3); err != nil {
+			return nil, err
+		}
+		c1, err := colorArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		c2, err := colorArg(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		weight := 0.5
+		if len(args) == 3 {
+			if weight, err = alphaArg(args, 2); err != nil {
+				return nil, err
+			}
+		}
+		// The algorithm of Sass, which also takes the opacity into account.
+		w := 2*weight - 1
+		a := c1[3] - c2[3]
+		w1 := w
+		if w*a != -1 {
+			w1 = (w + a) / (1 + w*a)
+		}
+		w1 = (w1 + 1) / 2
+		w2 := 1 - w1
+		var rgba [4]float64
+		for i := 0; i < 3; i++ {
+			rgba[i] = c1[i]*w1 + c2[i]*w2
+		}
+		rgba[3] = c1[3]*weight + c2[3]*(1-weight)
+		return sassColorValue(rgba), nil
+	},
+	"alpha": func(args []*sassValue) (*sassValue, error) {
+		if len(args) == 1 {
+			if _, ok := args[0].toColor(); ok {
+				return nil, errors.New("the alpha of colors is not supported")
+			}
+		}
+		return nil, nil // alpha(opacity=50) of old IEs
+	},
+	"rgba": sassRGBA,
+	"rgb":  sassRGBA,
+	"percentage": func(args []*sassValue) (*sassValue, error) {
+		if err := argCount(args, 1, 1); err != nil {
+			return nil, err
+		}
+		if args[0].kind != sassNumber || args[0].unit != "" {
+			return nil, fmt.Errorf("%s is not a number without unit", args[0].text)
+		}
+		return sassNumberValue(args[0].num*100, "%"), nil
+	},
+	"round": roundNumber(math.Round),
+	"ceil":  roundNumber(math.Ceil),
+	"floor": roundNumber(math.Floor),
+	"abs":   roundNumber(math.Abs),
+}
+
+// sassRGBA evaluates rgba($color, $alpha), and rgb() and rgba() with numbers
+// as colors for color functions.
+func sassRGBA(args []*sassValue) (*sassValue, error) {
+	if len(args) == 2 {
+		rgba, err := colorArg(args, 0)
+		if err != nil {
+			return nil, err
+		}
+		if rgba[3], err = alphaArg(args, 1); err != nil {
+			return nil, err
+		}
+		return sassColorValue(rgba), nil
+	}
+	if len(args) != 3 && len(args) != 4 {
+		return nil, nil
+	}
+	rgba := [4]float64{0, 0, 0, 1}
+	for i, arg := range args {
+		if arg.kind != sassNumber {
+			return nil, nil // like rgb(var(--red), 0, 0)
+		}
+		switch {
+		case i == 3:
+			rgba[3], _ = alphaArg(args, i)
+		case arg.unit == "%":
+			rgba[i] = arg.num * 255 / 100
+		default:
+			rgba[i] = arg.num
+		}
+	}
+	return sassColorValue(rgba), nil
+}
+
+// sassUnsupportedFunctions are Sass functions that aren't implemented.
+// Passing them through would silently produce invalid CSS.
+var sassUnsupportedFunctions = map[string]bool{
+	"adjust-color": true, "scale-color": true, "change-color": true, "red": true,
+	"green": true, "blue": true, "hue": true, "saturation": true, "lightness": true,
+	"ie-hex-str": true, "unquote": true, "quote": true,
+	"str-length": true, "str-insert": true, "str-index": true, "str-slice": true,
+	"to-upper-case": true, "to-lower-case": true, "unique-id": true,
+	"length": true, "nth": true, "set-nth": true, "join": true, "append": true,
+	"zip": true, "index": true, "list-separator": true, "map-get": true,
+	"map-merge": true, "map-remove": true, "map-keys": true, "map-values": true,
+	"map-has-key": true, "keywords": true, "type-of": true, "unit": true,
+	"unitless": true, "comparable": true, "if": true, "call": true,
+	"get-function": true, "variable-exists": true, "global-variable-exists": true,
+	"function-exists": true, "mixin-exists": true, "feature-exists": true,
+	"inspect": true, "random": true, "selector-nest": true,
+	"selector-append": true, "selector-replace": true, "selector-unify": true,
+	"is-superselector": true, "simple-selectors": true, "selector-parse": true,
+}
+
+// sassModules are the modules of the Sass module system, whose functions are
+// called like math.div().
+var sassModules = map[string]bool{
+	"math": true, "color": true, "string": true, "list": true, "map": true,
+	"selector": true, "meta": true,
+}
+
+// sassRawFunctions are CSS functions whose arguments aren't evaluated.
+var sassRawFunctions = map[string]bool{
+	"calc": true, "clamp": true, "env": true, "expression": true, "max": true,
+	"min": true, "url": true, "var": true,
+}
+
+type sassToken struct {
+	kind  byte // see tokenizeSass
+	text  string
+	start int
+	end   int
+	space bool // whitespace before the token
+}
+
+// tokenizeSass splits a value into tokens: numbers ('n'), hash colors ('h'),
+// strings ('s'), identifiers and other characters ('i'), functions ('f',
+// the text includes the '('), variables ('v'), operators and punctuation
+// ('o') and raw text ('r') for functions like calc() and [...].
+func tokenizeSass(s string) ([]sassToken, error) {
+	var tokens []sassToken
+	space := false
+	for i := 0; i < len(s); {
+		start := i
+		c := s[i]
+		var kind byte
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\f':
+			space = true
+			i++
+			continue
+		case isDigit(c) || c == '.' && i+1 < len(s) && isDigit(s[i+1]):
+			for i < len(s) && (isDigit(s[i]) || s[i] == '.') {
+				i++
+			}
+			for i < len(s) && (isLetter(s[i]) || s[i] == '%') {
+				i++
+			}
+			kind = 'n'
+		case c == '"' || c == '\'':
+			for i++; i < len(s) && s[i] != c; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(s) {
+				return nil, errors.New("unterminated string")
+			}
+			i++
+			kind = 's'
+		case c == '$':
+			for i++; i < len(s) && isSCSSNameChar(s[i]); i++ {
+			}
+			kind = 'v'
+		case c == '#':
+			for i++; i < len(s) && isSCSSNameChar(s[i]); i++ {
+			}
+			kind = 'h'
+		case c == '[':
+			end := matchingClose(s, i)
+			if end < 0 {
+				return nil, errors.New("missing ']'")
+			}
+			i = end + 1
+			kind = 'r'
+		case isLetter(c) || c == '_' || c >= 0x80 || c == '!' && i+1 < len(s) && isLetter(s[i+1]) ||
+			c == '-' && i+1 < len(s) && (isLetter(s[i+1]) || s[i+1] == '_' || s[i+1] == '-' || s[i+1] >= 0x80):
+			for i++; i < len(s) && isSCSSNameChar(s[i]); i++ {
+			}
+			name := s[start:i]
+			if i+1 < len(s) && s[i] == '.' && sassModules[name] {
+				return nil, fmt.Errorf("module functions like %s.%s are not supported", name, strings.SplitN(s[i+1:], "(", 2)[0])
+			}
+			kind = 'i'
+			if i < len(s) && s[i] == '(' {
+				if sassRawFunctions[strings.ToLower(cssUnprefixed(name))] {
+					end := matchingClose(s, i)
+					if end < 0 {
+						return nil, errors.New("missing ')'")
+					}
+					i = end + 1
+					kind = 'r'
+				} else {
+					i++
+					kind = 'f'
+				}
+			}
+		case strings.IndexByte("+-*/%,()", c) >= 0:
+			i++
+			kind = 'o'
+		default:
+			// Other characters, like the : in progid:... or the = in
+			// alpha(opacity=50), are kept as they are.
+			i++
+			kind = 'i'
+		}
+		tokens = append(tokens, sassToken{kind, s[start:i], start, i, space})
+		space = false
+	}
+	return tokens, nil
+}
+
+// cssUnprefixed removes a vendor prefix like -webkit- from a name.
+func cssUnprefixed(name string) string {
+	if strings.HasPrefix(name, "-") && !strings.HasPrefix(name, "--") {
+		if i := strings.IndexByte(name[1:], '-'); i >= 0 {
+			return name[i+2:]
+		}
+	}
+	return name
+}
+
+// matchingClose returns the index of the ) or ] matching the ( or [ at
+// s[open], skipping strings.
+func matchingClose(s string, open int) int {
+	var stack []byte
+	var quote byte
+	for i := open; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			stack = append(stack, ')')
+		case c == '[':
+			stack = append(stack, ']')
+		case c == ')' || c == ']':
+			if len(stack) == 0 || stack[len(stack)-1] != c {
+				return -1
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isLetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+type sassParser struct {
+	c      *scssCompiler
+	src    string
+	tokens []sassToken
+	pos    int
+	parens int // depth of parentheses, in which / divides
+	scope  *scssScope
+	stmt   *scssStmt
+}
+
+// evalValue evaluates a value: interpolation, variables, arithmetic and Sass
+// functions.
+func (c *scssCompiler) evalValue(s string, scope *scssScope, stmt *scssStmt) (string, error) {
+	s, err := c.interpolate(s, scope, stmt)
+	if err != nil {
+		return "", err
+	}
+	v, err := c.parseValue(strings.TrimSpace(s), scope, stmt)
+	if err != nil || v == nil {
+		return "", err
+	}
+	return v.text, nil
+}
+
+// parseValue evaluates a value, or returns nil for an empty value.
+func (c *scssCompiler) parseValue(s string, scope *scssScope, stmt *scssStmt) (*sassValue, error) {
+	tokens, err := tokenizeSass(s)
+	if err != nil {
+		return nil, &scssError{stmt.file, stmt.line, err.Error()}
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+	p := &sassParser{c: c, src: s, tokens: tokens, scope: scope, stmt: stmt}
+	v, err := p.parseList()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return v, nil
+}
+
+func (p *sassParser) errorf(format string, args ...interface{}) error {
+	return &scssError{p.stmt.file, p.stmt.line, fmt.Sprintf(format, args...)}
+}
+
+// peek returns the next token, or nil at the end.
+func (p *sassParser) peek() *sassToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+// peekOp returns the next token if it is one of the operators.
+func (p *sassParser) peekOp(ops ...string) *sassToken {
+	t := p.peek()
+	if t == nil || t.kind != 'o' {
+		return nil
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return t
+		}
+	}
+	return nil
+}
+
+// verbatim returns whether the text of a value is as in the source.
+func (p *sassParser) verbatim(v *sassValue) bool {
+	return v.text == p.src[v.start:v.end]
+}
+
+// join makes a list or CSS function of values. It keeps the source text
+// when nothing was evaluated.
+func (p *sassParser) join(items []*sassValue, sep, prefix, suffix string, start, end int) *sassValue {
+	v := &sassValue{kind: sassLiteral, start: start, end: end}
+	verbatim := true
+	texts := make([]string, len(items))
+	for i, item := range items {
+		verbatim = verbatim && p.verbatim(item)
+		texts[i] = item.text
+	}
+	if verbatim {
+		v.text = p.src[start:end]
+	} else {
+		v.text = prefix + strings.Join(texts, sep) + suffix
+	}
+	return v
+}
+
+// parseList parses a comma separated list.
+func (p *sassParser) parseList() (*sassValue, error) {
+	var items []*sassValue
+	for {
+		v, err := p.parseSpaceList()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+		if p.peekOp(",") == nil {
+			break
+		}
+		p.pos++
+	}
+	if len(items) == 1 {
+		return items[0], nil
+	}
+	return p.join(items, ", ", "", "", items[0].start, items[len(items)-1].end), nil
+}
+
+// parseSpaceList parses a space separated list.
+func (p *sassParser) parseSpaceList() (*sassValue, error) {
+	var items []*sassValue
+	for p.peek() != nil && p.peekOp(",", ")") == nil {
+		v, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+	}
+	switch len(items) {
+	case 0:
+		return nil, p.errorf("expected a value")
+	case 1:
+		return items[0], nil
+	}
+	return p.join(items, " ", "", "", items[0].start, items[len(items)-1].end), nil
+}
+
+func (p *sassParser) parseSum() (*sassValue, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peekOp("+", "-")
+		if t == nil {
+			return left, nil
+		}
+		// A sign after a space and right before a value starts the next
+		// value of a list, like in margin: 0 -5px.
+		if t.space && p.pos+1 < len(p.tokens) && !p.tokens[p.pos+1].space {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.operate(t.text, left, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *sassParser) parseProduct() (*sassValue, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peekOp("*", "/", "%")
+		if t == nil {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if left, err = p.operate(t.text, left, right); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *sassParser) parseUnary() (*sassValue, error) {
+	t := p.peekOp("+", "-")
+	if t == nil {
+		return p.parsePrimary()
+	}
+	p.pos++
+	v, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	r := *v
+	r.start = t.start
+	if v.kind == sassNumber {
+		if t.text == "-" {
+			r.num = -v.num
+		}
+		if v.computed {
+			r.text = formatSassNumber(r.num) + r.unit
+		} else {
+			r.text = p.src[r.start:r.end]
+		}
+		return &r, nil
+	}
+	r.kind = sassLiteral
+	r.text = t.text + v.text
+	return &r, nil
+}
+
+func (p *sassParser) parsePrimary() (*sassValue, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, p.errorf("expected a value")
+	}
+	p.pos++
+	v := &sassValue{kind: sassLiteral, text: t.text, start: t.start, end: t.end}
+	switch t.kind {
+	case 'n':
+		i := strings.IndexFunc(t.text, func(c rune) bool { return c == '%' || c < 128 && isLetter(byte(c)) })
+		if i < 0 {
+			i = len(t.text)
+		}
+		num, err := strconv.ParseFloat(t.text[:i], 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %s", t.text)
+		}
+		v.kind, v.num, v.unit = sassNumber, num, t.text[i:]
+	case 'h':
+		if rgba, ok := parseHexColor(t.text); ok {
+			v.kind, v.rgba = sassColor, rgba
+		}
+	case 's':
+		v.kind, v.quote, v.str = sassString, t.text[0], t.text[1:len(t.text)-1]
+	case 'r':
+		if strings.Contains(t.text, "$") {
+			text, err := p.c.substituteVars(t.text, p.scope, p.stmt)
+			if err != nil {
+				return nil, err
+			}
+			v.text = text
+		}
+	case 'v':
+		name := t.text[1:]
+		value, ok := p.scope.lookup(name)
+		if !ok {
+			return nil, p.errorf("undefined variable $%s", name)
+		}
+		// Variables hold evaluated values, which are parsed again.
+		inner, err := p.c.parseValue(value, p.scope, p.stmt)
+		if err != nil {
+			return nil, err
+		}
+		if inner == nil {
+			inner = &sassValue{kind: sassLiteral}
+		}
+		inner.computed = true
+		inner.start, inner.end = v.start, v.end
+		return inner, nil
+	case 'f':
+		return p.parseCall(t)
+	case 'o':
+		if t.text != "(" {
+			return nil, p.errorf("unexpected %q", t.text)
+		}
+		p.parens++
+		inner, err := p.parseList()
+		p.parens--
+		if err != nil {
+			return nil, err
+		}
+		end := p.peekOp(")")
+		if end == nil {
+			return nil, p.errorf("missing ')'")
+		}
+		p.pos++
+		// The parentheses only group, like in Sass.
+		inner.computed = true
+		inner.start, inner.end = t.start, end.end
+		return inner, nil
+	}
+	return v, nil
+}
+
+// parseCall parses the arguments of a function and calls it when it is a
+// Sass function.
+func (p *sassParser) parseCall(t *sassToken) (*sassValue, error) {
+	name := strings.TrimSuffix(t.text, "(")
+	var args []*sassValue
+	if p.peekOp(")") == nil {
+		for {
+			arg, err := p.parseSpaceList()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peekOp(",") == nil {
+				break
+			}
+			p.pos++
+		}
+	}
+	end := p.peekOp(")")
+	if end == nil {
+		return nil, p.errorf("missing ')' after the arguments of %s()", name)
+	}
+	p.pos++
+
+	key := strings.Replace(strings.ToLower(name), "_", "-", -1)
+	if f := sassFunctions[key]; f != nil {
+		v, err := f(args)
+		if err != nil {
+			return nil, p.errorf("%s(): %s", name, err)
+		}
+		if v != nil {
+			v.start, v.end = t.start, end.end
+			v.computed = true
+			if (key == "rgb" || key == "rgba") && len(args) > 2 {
+				// Plain CSS, like rgba(0,0,0,.5), is kept as it is.
+				v.computed = false
+				for _, arg := range args {
+					v.computed = v.computed || arg.computed || !p.verbatim(arg)
+				}
+				if !v.computed {
+					v.text = p.src[v.start:v.end]
+				}
+			}
+			return v, nil
+		}
+	} else if sassUnsupportedFunctions[key] {
+		return nil, p.errorf("function %s() is not supported", name)
+	}
+
+	// A CSS function, like translate() or rgba() with numbers.
+	return p.join(args, ", ", name+"(", ")", t.start, end.end), nil
+}
+
+// operate applies an operator to two values.
+func (p *sassParser) operate(op string, l, r *sassValue) (*sassValue, error) {
+	numbers := l.kind == sassNumber && r.kind == sassNumber
+	quoted := l.kind == sassString || r.kind == sassString
+	plain := op == "/" && (!numbers || p.parens == 0) || (op == "+" || op == "-") && !numbers && !quoted
+	if !l.computed && !r.computed && plain {
+		// Plain CSS, like font: 12px/1.5 or unicode-range: U+0025-00FF.
+		return &sassValue{kind: sassLiteral, text: l.text + p.src[l.end:r.start] + r.text, start: l.start, end: r.end}, nil
+	}
+
+	var v *sassValue
+	switch {
+	case numbers:
+		num, unit, err := sassArithmetic(op, l, r)
+		if err != nil {
+			return nil, p.errorf("%s %s %s: %s", l.text, op, r.text, err)
+		}
+		v = sassNumberValue(num, unit)
+	case op == "+" && l.kind == sassString:
+		right := r.text
+		if r.kind == sassString {
+			right = r.str
+		}
+		v = &sassValue{kind: sassString, quote: l.quote, str: l.str + right}
+		v.text = string(v.quote) + v.str + string(v.quote)
+	case op == "+" && r.kind == sassString:
+		v = &sassValue{kind: sassLiteral, text: l.text + r.str}
+	default:
+		return nil, p.errorf("undefined operation %s %s %s", l.text, op, r.text)
+	}
+	v.computed = true
+	v.start, v.end = l.start, r.end
+	return v, nil
+}
+
+// sassArithmetic applies an operator to two numbers, checking their units.
+func sassArithmetic(op string, l, r *sassValue) (float64, string, error) {
+	switch op {
+	case "*":
+		if l.unit != "" && r.unit != "" {
+			return 0, "", fmt.Errorf("can't multiply %s by %s", l.unit, r.unit)
+		}
+		return l.num * r.num, l.unit + r.unit, nil
+	case "/":
+		if r.num == 0 {
+			return 0, "", errors.New("division by zero")
+		}
+		switch r.unit {
+		case "":
+			return l.num / r.num, l.unit, nil
+		case l.unit:
+			return l.num / r.num, "", nil
+		}
+		return 0, "", fmt.Errorf("can't divide %s by %s", l.unit, r.unit)
+	}
+
+	unit := l.unit
+	if unit == "" {
+		unit = r.unit
+	} else if r.unit != "" && r.unit != unit {
+		return 0, "", fmt.Errorf("incompatible units %s and %s", l.unit, r.unit)
+	}
+	switch op {
+	case "+":
+		return l.num + r.num, unit, nil
+	case "-":
+		return l.num - r.num, unit, nil
+	}
+	if r.num == 0 {
+		return 0, "", errors.New("modulo by zero")
+	}
+	return math.Mod(l.num, r.num), unit, nil
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A series is a set of posts that are meant to be read in order, like a
+// tutorial in multiple parts. Every post can be in one series, at a position
+// set in the admin. Posts in a series link to the posts before and after
+// them, and the series has an overview page at /series/{name}.
+
+// seriesNamePattern is the pattern of series names, the same as for pages.
+var seriesNamePattern = regexp.MustCompile("^(?:" + permalinkFields["name"].pattern + ")$")
+
+type Series struct {
+	Id          int64
+	Name        string
+	Title       string
+	Description string // Markdown
+	Created     time.Time
+	Modified    time.Time
+}
+
+// SeriesFromQuery returns all series matching the where clause (which may be
+// empty), ordered by title.
+func SeriesFromQuery(blog *Blog, whereClause string, args ...interface{}) []*Series {
+	query := "SELECT id, name, title, description, created, modified FROM series "
+	if whereClause != "" {
+		query += "WHERE " + whereClause + " "
+	}
+	rows, err := blog.db.Query(query+"ORDER BY title", args...)
+	checkError(err, "could not fetch series")
+	defer rows.Close()
+
+	var series []*Series
+	for rows.Next() {
+		s := &Series{}
+		var created, modified int64
+		err := rows.Scan(&s.Id, &s.Name, &s.Title, &s.Description, &created, &modified)
+		checkError(err, "could not scan series")
+		s.Created = importTime(created)
+		s.Modified = importTime(modified)
+		series = append(series, s)
+	}
+	return series
+}
+
+// SeriesById returns the series with this id, or nil.
+func SeriesById(blog *Blog, id int64) *Series {
+	if series := SeriesFromQuery(blog, "id=?", id); len(series) != 0 {
+		return series[0]
+	}
+	return nil
+}
+
+// Url returns the URL of the overview page (without urlprefix).
+func (s *Series) Url() string {
+	return "/series/" + s.Name
+}
+
+// Posts returns the published posts in this series, in order.
+func (s *Series) Posts() Pages {
+	return PagesFromQuery(blog, PAGE_TYPE_POST, FETCH_TITLE, "series=? AND published!=0", "ORDER BY position, published", s.Id)
+}
+
+// publicSeries returns the series with published posts, the series that are
+// linked from posts.
+func publicSeries(blog *Blog) []*Series {
+	return SeriesFromQuery(blog, "id IN (SELECT series FROM pages WHERE type=? AND published!=0)", PAGE_TYPE_POST)
+}
+
+// allPosts returns all posts in this series, including drafts, in order.
+func (s *Series) allPosts() Pages {
+	return PagesFromQuery(blog, PAGE_TYPE_POST, FETCH_TITLE, "series=?", "ORDER BY position, published", s.Id)
+}
+
+// ETag returns a strong entity tag of the series and its published posts.
+func (s *Series) ETag(posts Pages) string {
+	return makeETag(false, strconv.FormatInt(s.Id, 10), s.Name, s.Title, s.Description,
+		strconv.FormatInt(exportTime(s.Modified), 10), posts.ETag())
+}
+
+// LastModified returns the last time the series or one of its published
+// posts changed.
+func (s *Series) LastModified(posts Pages) time.Time {
+	return lastTime(s.Modified, posts.LastModified())
+}
+
+// Update saves the series, or inserts it when it's new.
+func (s *Series) Update(blog *Blog, name, title, description string) error {
+	name = strings.TrimSpace(name)
+	if !seriesNamePattern.MatchString(name) {
+		return errors.New("the name may only contain a-z, 0-9 and dashes between them")
+	}
+	if other := SeriesFromQuery(blog, "name=? AND id!=?", name, s.Id); len(other) != 0 {
+		return errors.New("there is already a series with this name")
+	}
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return errors.New("the series needs a title")
+	}
+
+	s.Name = name
+	s.Title = title
+	s.Description = description
+	s.Modified = time.Now()
+	if s.Id == 0 {
+		s.Created = s.Modified
+		result, err := blog.db.Exec("INSERT INTO series (name, title, description, created, modified) VALUES (?, ?, ?, ?, ?)",
+			s.Name, s.Title, s.Description, exportTime(s.Created), exportTime(s.Modified))
+		checkError(err, "could not insert series")
+		s.Id, err = result.LastInsertId()
+		checkError(err, "could not get last inserted ID")
+	} else {
+		_, err := blog.db.Exec("UPDATE series SET name=?, title=?, description=?, modified=? WHERE id=?",
+			s.Name, s.Title, s.Description, exportTime(s.Modified), s.Id)
+		checkError(err, "could not update series")
+	}
+	blog.cache.invalidate()
+	return nil
+}
+
+// Delete removes the series. Its posts stay, without a series.
+func (s *Series) Delete(blog *Blog) {
+	_, err := blog.db.Exec("UPDATE pages SET series=0, position=0 WHERE series=? AND type=?", s.Id, PAGE_TYPE_POST)
+	checkError(err, "could not remove posts from series")
+	_, err = blog.db.Exec("DELETE FROM series WHERE id=?", s.Id)
+	checkError(err, "could not delete series")
+	blog.cache.invalidate()
+}
+
+// SetSeries moves a post to a series (0 for none), at the end.
+func (p *Page) SetSeries(blog *Blog, seriesId int64) error {
+	if p.Type != PAGE_TYPE_POST {
+		return errors.New("only posts can be in a series")
+	}
+	position := 0
+	if seriesId != 0 {
+		if SeriesById(blog, seriesId) == nil {
+			return errors.New("series does not exist")
+		}
+		row := blog.db.QueryRow("SELECT COALESCE(MAX(position), 0) FROM pages WHERE series=? AND id!=?", seriesId, p.Id)
+		checkError(row.Scan(&position), "could not fetch series position")
+		position++
+	}
+	_, err := blog.db.Exec("UPDATE pages SET series=?, position=? WHERE id=?", seriesId, position, p.Id)
+	checkError(err, "could not update series of post")
+	touchSeries(blog, p.SeriesId, seriesId)
+	p.SeriesId = seriesId
+	p.Position = position
+	if !p.Published.IsZero() {
+		blog.cache.invalidate()
+	}
+	return nil
+}
+
+// moveInSeries applies an action of the series editor to a post: "up" and
+// "down" move it within the series and "remove" removes it from the series.
+func (s *Series) moveInSeries(blog *Blog, id int64, action string) error {
+	posts := s.allPosts()
+	index := -1
+	for i, post := range posts {
+		if post.Id == id {
+			index = i
+		}
+	}
+	if index < 0 {
+		return errors.New("post is not in this series")
+	}
+
+	switch action {
+	case "up":
+		if index == 0 {
+			return nil
+		}
+		posts[index-1], posts[index] = posts[index], posts[index-1]
+	case "down":
+		if index == len(posts)-1 {
+			return nil
+		}
+		posts[index], posts[index+1] = posts[index+1], posts[index]
+	case "remove":
+		return posts[index].SetSeries(blog, 0)
+	default:
+		return errors.New("unknown action " + strconv.Quote(action))
+	}
+
+	tx, err := blog.db.Begin()
+	checkError(err, "could not start transaction")
+	for i, post := range posts {
+		_, err := tx.Exec("UPDATE pages SET position=? WHERE id=?", i+1, post.Id)
+		checkError(err, "could not update series position")
+	}
+	checkError(tx.Commit(), "could not update series")
+	touchSeries(blog, s.Id)
+	blog.cache.invalidate()
+	return nil
+}
+
+// touchSeries updates the modification time of series after their posts
+// changed, as that changes the pages of all posts in the series.
+func touchSeries(blog *Blog, ids ...int64) {
+	for _, id := range ids {
+		if id == 0 {
+			continue
+		}
+		_, err := blog.db.Exec("UPDATE series SET modified=? WHERE id=?", exportTime(time.Now()), id)
+		checkError(err, "could not update series")
+	}
+}
+
+// SeriesPart is the place of a post in its series, for templates.
+type SeriesPart struct {
+	Series   *Series
+	Number   int // starting at 1
+	Count    int
+	Previous *Page // nil for the first part
+	Next     *Page // nil for the last part
+	etag     string
+	modified time.Time
+}
+
+// seriesPart returns the place of a published post in its series, or nil if
+// it isn't in a series.
+func (p *Page) seriesPart(blog *Blog) *SeriesPart {
+	if p.SeriesId == 0 || p.Published.IsZero() {
+		return nil
+	}
+	series := SeriesById(blog, p.SeriesId)
+	if series == nil {
+		return nil
+	}
+	posts := series.Posts()
+	for i, post := range posts {
+		if post.Id != p.Id {
+			continue
+		}
+		part := &SeriesPart{
+			Series:   series,
+			Number:   i + 1,
+			Count:    len(posts),
+			etag:     series.ETag(posts),
+			modified: series.LastModified(posts),
+		}
+		if i > 0 {
+			part.Previous = posts[i-1]
+		}
+		if i < len(posts)-1 {
+			part.Next = posts[i+1]
+		}
+		return part
+	}
+	return nil
+}
+
+// SeriesViewHandler shows the overview page of a series.
+func SeriesViewHandler(w http.ResponseWriter, r *http.Request) {
+	series := SeriesFromQuery(blog, "name=?", mux.Vars(r)["name"])
+	if len(series) == 0 {
+		NotFound(w, r)
+		return
+	}
+	s := series[0]
+	posts := s.Posts()
+
+	res := NewResponse()
+	res.tpl = "series"
+	res.data["series"] = s
+	res.data["posts"] = posts
+	res.data["title"] = s.Title
+	res.etag = s.ETag(posts)
+	res.Output(w, r, s.LastModified(posts))
+}
+
+// SeriesAdminHandler lists all series, and adds new series.
+func SeriesAdminHandler(w http.ResponseWriter, r *http.Request) {
+	res := NewAuthenticatedResponse(w, r)
+	if res == nil {
+		return
+	}
+
+	if r.Method == "POST" {
+		s := &Series{}
+		err := s.Update(blog, r.PostFormValue("name"), r.PostFormValue("title"), "")
+		if err != nil {
+			res.data["seriesError"] = err.Error()
+			res.data["name"] = r.PostFormValue("name")
+			res.data["seriesTitle"] = r.PostFormValue("title")
+		} else {
+			w.Header().Set("Location", r.URL.String()+"/"+strconv.FormatInt(s.Id, 10))
+			w.WriteHeader(303)
+			return
+		}
+	}
+
+	res.tpl = "seriesadmin"
+	res.data["title"] = "Series"
+	res.data["allSeries"] = SeriesFromQuery(blog, "")
+	res.Output(w, r, time.Time{})
+}
+
+// SeriesEditHandler edits a series and the order of its posts.
+func SeriesEditHandler(w http.ResponseWriter, r *http.Request) {
+	res := NewAuthenticatedResponse(w, r)
+	if res == nil {
+		return
+	}
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	s := SeriesById(blog, id)
+	if s == nil {
+		NotFound(w, r)
+		return
+	}
+
+	if r.Method == "POST" {
+		var err error
+		if r.PostFormValue("delete") != "" {
+			s.Delete(blog)
+			list, _ := blog.mux.Get("seriesadmin").URLPath()
+			w.Header().Set("Location", list.Path)
+			w.WriteHeader(303)
+			return
+		} else if value := r.PostFormValue("action"); value != "" {
+			// The buttons have the action and the post as value, like "up 5".
+			action, post, _ := strings.Cut(value, " ")
+			var postId int64
+			postId, err = strconv.ParseInt(post, 10, 64)
+			if err == nil {
+				err = s.moveInSeries(blog, postId, action)
+			}
+		} else {
+			err = s.Update(blog, r.PostFormValue("name"), r.PostFormValue("title"), r.PostFormValue("description"))
+		}
+		if err != nil {
+			res.data["seriesError"] = err.Error()
+		} else {
+			w.Header().Set("Location", r.URL.String())
+			w.WriteHeader(303)
+			return
+		}
+	}
+
+	res.tpl = "editseries"
+	res.data["title"] = s.Title
+	res.data["posts"] = s.allPosts()
+	if _, ok := res.data["seriesError"]; ok && r.PostFormValue("action") == "" {
+		// Show the entered values again.
+		s = &Series{Id: s.Id, Name: r.PostFormValue("name"), Title: r.PostFormValue("title"), Description: r.PostFormValue("description")}
+	}
+	res.data["series"] = s
+	res.Output(w, r, time.Time{})
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Shortcodes are written like {{< youtube dQw4w9WgXcQ >}} or
+// {{< figure src="/a.png" caption="A" >}}. A shortcode on its own line is a
+// block, otherwise it is inline. Block shortcodes whose template uses .Inner
+// enclose content up to a closing tag: {{< name >}}...{{< /name >}}.
+//
+// Skins define shortcodes as templates in skins/<skin>/shortcodes/<name>.html,
+// which are looked up in the skin and then its parents, like other templates.
+// The template data is a *Shortcode.
+
+// Shortcode is the data passed to a shortcode template.
+type Shortcode struct {
+	Name   string
+	Args   map[string]string // named arguments: key="value"
+	Params []string          // positional arguments
+	Inner  string            // content between the opening and closing tag
+	Base   string            // URL prefix of the blog
+}
+
+// Get returns a named argument, or a positional argument when key is an
+// index. It returns "" if the argument doesn't exist.
+func (s *Shortcode) Get(key interface{}) string {
+	switch key := key.(type) {
+	case string:
+		if value, ok := s.Args[key]; ok {
+			return value
+		}
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(s.Params) {
+			return s.Params[i]
+		}
+	case int:
+		if key >= 0 && key < len(s.Params) {
+			return s.Params[key]
+		}
+	}
+	return ""
+}
+
+func isShortcodeNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// parseShortcode parses a shortcode tag at the start of buf. It returns nil if
+// there is none, and otherwise the length of the tag. closing is true for a
+// closing tag ({{< /name >}}), selfClosing for {{< name />}}.
+func parseShortcode(buf []byte) (sc *Shortcode, closing, selfClosing bool, length int) {
+	if !bytes.HasPrefix(buf, []byte("{{<")) {
+		return nil, false, false, 0
+	}
+	i := 3
+	skipSpace := func() {
+		for i < len(buf) && (buf[i] == ' ' || buf[i] == '\t') {
+			i++
+		}
+	}
+
+	skipSpace()
+	if i < len(buf) && buf[i] == '/' {
+		closing = true
+		i++
+		skipSpace()
+	}
+	start := i
+	for i < len(buf) && isShortcodeNameChar(buf[i]) {
+		i++
+	}
+	if i == start {
+		return nil, false, false, 0
+	}
+	sc = &Shortcode{Name: string(buf[start:i]), Args: make(map[string]string), Base: blog.URLPrefix}
+
+	for {
+		skipSpace()
+		if bytes.HasPrefix(buf[i:], []byte(">}}")) {
+			return sc, closing, false, i + 3
+		}
+		if bytes.HasPrefix(buf[i:], []byte("/>}}")) {
+			return sc, closing, true, i + 4
+		}
+		if i >= len(buf) || buf[i] == '\n' || buf[i] == '\r' {
+			return nil, false, false, 0
+		}
+
+		key := ""
+		j := i
+		for j < len(buf) && isShortcodeNameChar(buf[j]) {
+			j++
+		}
+		if j > i && j < len(buf) && buf[j] == '=' {
+			key = string(buf[i:j])
+			i = j + 1
+		}
+
+		var value string
+		if i < len(buf) && buf[i] == '"' {
+			end := bytes.IndexByte(buf[i+1:], '"')
+			if end < 0 || bytes.IndexByte(buf[i+1:i+1+end], '\n') >= 0 {
+				return nil, false, false, 0
+			}
+			value = string(buf[i+1 : i+1+end])
+			i += end + 2
+		} else {
+			j = i
+			for j < len(buf) && buf[j] != ' ' && buf[j] != '\t' && buf[j] != '\n' && buf[j] != '\r' && !bytes.HasPrefix(buf[j:], []byte(">}}")) {
+				j++
+			}
+			if j == i {
+				return nil, false, false, 0
+			}
+			value = string(buf[i:j])
+			i = j
+		}
+
+		if key != "" {
+			sc.Args[key] = value
+		} else {
+			sc.Params = append(sc.Params, value)
+		}
+	}
+}
+
+// shortcodeTemplate returns the parsed template of a shortcode. paired is true
+// when the template uses .Inner, which means the shortcode needs a closing
+// tag.
+func (b *Blog) shortcodeTemplate(name string) (tpl *template.Template, paired bool, err error) {
+	b.loadSkin()
+	for _, skin := range b.skins {
+		p := path.Join(b.BlogPath, "skins", skin, "shortcodes", name+".html")
+		st, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, false, err
+		}
+
+		key := "shortcode:" + name
+		b.templateLock.Lock()
+		defer b.templateLock.Unlock()
+		if t, ok := b.templates[key]; ok && t.modified.Equal(st.ModTime()) {
+			return t.tpl, t.paired, nil
+		}
+
+		src, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, false, err
+		}
+		tpl, err := template.New(name).Funcs(funcMap).Parse(string(src))
+		if err != nil {
+			return nil, false, err
+		}
+		paired := bytes.Contains(src, []byte(".Inner"))
+		b.templates[key] = &parsedTemplate{tpl: tpl, modified: st.ModTime(), paired: paired}
+		return tpl, paired, nil
+	}
+	return nil, false, errors.New("unknown shortcode")
+}
+
+// shortcodesModified returns the last time a shortcode template was changed.
+// Any page may use them, so they count as part of every page template.
+func (b *Blog) shortcodesModified() time.Time {
+	var t time.Time
+	for _, skin := range b.skins {
+		dir := path.Join(b.BlogPath, "skins", skin, "shortcodes")
+		st, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		checkError(err, "failed to stat shortcodes directory")
+		t = lastTime(t, st.ModTime()) // changes when a file is removed
+
+		files, err := ioutil.ReadDir(dir)
+		checkError(err, "failed to read shortcodes directory")
+		for _, f := range files {
+			t = lastTime(t, f.ModTime())
+		}
+	}
+	return t
+}
+
+var kindShortcodeBlock = ast.NewNodeKind("ShortcodeBlock")
+var kindShortcodeInline = ast.NewNodeKind("ShortcodeInline")
+
+type shortcodeBlock struct {
+	ast.BaseBlock
+	shortcode *Shortcode
+	open      bool // waiting for the closing tag
+}
+
+func (n *shortcodeBlock) Kind() ast.NodeKind {
+	return kindShortcodeBlock
+}
+
+// IsRaw returns true, as the content between the tags is passed as-is to the
+// template.
+func (n *shortcodeBlock) IsRaw() bool {
+	return true
+}
+
+func (n *shortcodeBlock) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Name": n.shortcode.Name}, nil)
+}
+
+type shortcodeInline struct {
+	ast.BaseInline
+	shortcode *Shortcode
+}
+
+func (n *shortcodeInline) Kind() ast.NodeKind {
+	return kindShortcodeInline
+}
+
+func (n *shortcodeInline) Dump(source []byte, level int) {
+	ast.DumpHelper(n, source, level, map[string]string{"Name": n.shortcode.Name}, nil)
+}
+
+type shortcodeBlockParser struct{}
+
+func (p *shortcodeBlockParser) Trigger() []byte {
+	return []byte{'{'}
+}
+
+// lineLength returns the number of bytes to advance to the end of the line,
+// excluding the newline.
+func lineLength(line []byte, segment text.Segment) int {
+	if len(line) != 0 && line[len(line)-1] == '\n' {
+		return segment.Len() - 1
+	}
+	return segment.Len()
+}
+
+func (p *shortcodeBlockParser) Open(parent ast.Node, reader text.Reader, pc parser.Context) (ast.Node, parser.State) {
+	line, segment := reader.PeekLine()
+	trimmed := util.TrimLeftSpace(line)
+	sc, closing, selfClosing, n := parseShortcode(trimmed)
+	if sc == nil || closing || !util.IsBlank(trimmed[n:]) {
+		return nil, parser.NoChildren
+	}
+
+	node := &shortcodeBlock{shortcode: sc}
+	if !selfClosing {
+		_, paired, err := blog.shortcodeTemplate(sc.Name)
+		node.open = err == nil && paired
+	}
+	reader.Advance(lineLength(line, segment))
+	return node, parser.NoChildren
+}
+
+func (p *shortcodeBlockParser) Continue(node ast.Node, reader text.Reader, pc parser.Context) parser.State {
+	n := node.(*shortcodeBlock)
+	if !n.open {
+		return parser.Close
+	}
+	line, segment := reader.PeekLine()
+	if line == nil {
+		return parser.Close
+	}
+
+	trimmed := util.TrimLeftSpace(line)
+	if sc, closing, _, length := parseShortcode(trimmed); sc != nil && closing && sc.Name == n.shortcode.Name && util.IsBlank(trimmed[length:]) {
+		n.open = false
+		reader.Advance(lineLength(line, segment))
+		return parser.Close
+	}
+	node.Lines().Append(segment)
+	reader.Advance(lineLength(line, segment))
+	return parser.Continue | parser.NoChildren
+}
+
+func (p *shortcodeBlockParser) Close(node ast.Node, reader text.Reader, pc parser.Context) {
+}
+
+func (p *shortcodeBlockParser) CanInterruptParagraph() bool {
+	return false
+}
+
+func (p *shortcodeBlockParser) CanAcceptIndentedLine() bool {
+	return false
+}
+
+type shortcodeInlineParser struct{}
+
+func (p *shortcodeInlineParser) Trigger() []byte {
+	return []byte{'{'}
+}
+
+func (p *shortcodeInlineParser) Parse(parent ast.Node, block text.Reader, pc parser.Context) ast.Node {
+	line, _ := block.PeekLine()
+	sc, closing, _, n := parseShortcode(line)
+	if sc == nil || closing {
+		return nil
+	}
+	block.Advance(n)
+	return &shortcodeInline{shortcode: sc}
+}
+
+type shortcodeRenderer struct{}
+
+func (r *shortcodeRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(kindShortcodeBlock, r.render)
+	reg.Register(kindShortcodeInline, r.render)
+}
+
+// render executes the shortcode template. Errors are shown in the page (like
+// in the preview), so they can be fixed by the author.
+func (r *shortcodeRenderer) render(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+
+	var sc *Shortcode
+	var err error
+	block := false
+	switch n := node.(type) {
+	case *shortcodeBlock:
+		sc, block = n.shortcode, true
+		sc.Inner = string(n.Lines().Value(source))
+		if n.open {
+			err = errors.New("missing closing tag {{< /" + sc.Name + " >}}")
+		}
+	case *shortcodeInline:
+		sc = n.shortcode
+	}
+
+	var buf bytes.Buffer
+	if err == nil {
+		var tpl *template.Template
+		tpl, _, err = blog.shortcodeTemplate(sc.Name)
+		if err == nil {
+			err = tpl.Execute(&buf, sc)
+		}
+	}
+	if err != nil {
+		msg := template.HTMLEscapeString("shortcode " + sc.Name + ": " + err.Error())
+		if block {
+			w.WriteString(`<p class="error">` + msg + "</p>\n")
+		} else {
+			w.WriteString(`<span class="error">` + msg + "</span>")
+		}
+		return ast.WalkSkipChildren, nil
+	}
+
+	w.Write(buf.Bytes())
+	if block && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		w.WriteByte('\n')
+	}
+	return ast.WalkSkipChildren, nil
+}
+
+// shortcodes is the goldmark extension for shortcodes.
+var shortcodes = &shortcodesExtension{}
+
+type shortcodesExtension struct{}
+
+func (e *shortcodesExtension) Extend(m goldmark.Markdown) {
+	m.Parser().AddOptions(
+		parser.WithBlockParsers(util.Prioritized(&shortcodeBlockParser{}, 850)),
+		parser.WithInlineParsers(util.Prioritized(&shortcodeInlineParser{}, 850)),
+	)
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(&shortcodeRenderer{}, 500)))
+}
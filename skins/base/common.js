@@ -24,8 +24,23 @@ function enableAutoExpand() {
 	}
 }
 
+// Ask for confirmation before submitting with buttons that have a
+// data-confirm attribute. Inline event handlers are blocked by the
+// Content-Security-Policy.
+function enableConfirm() {
+	let buttons = document.querySelectorAll('[data-confirm]');
+	for (let i=0; i<buttons.length; i++) {
+		buttons[i].addEventListener('click', function (e) {
+			if (!confirm(this.dataset.confirm)) {
+				e.preventDefault();
+			}
+		});
+	}
+}
+
 function onLoad() {
 	enableAutoExpand();
+	enableConfirm();
 }
 
 if (document.readyState == 'interactive' || document.readyState == 'complete') {
@@ -9,7 +9,7 @@ import (
 	texttemplate "text/template"
 	"time"
 
-	"github.com/russross/blackfriday"
+	"github.com/yuin/goldmark"
 )
 
 var months = [...]string{
@@ -39,24 +39,38 @@ func formatTimestamp(date time.Time) string {
 	return date.Format(time.RFC3339)
 }
 
-func formatMarkdown(text string) []byte {
-	htmlFlags := blackfriday.HTML_USE_XHTML
-	renderer := blackfriday.HtmlRenderer(htmlFlags, "", "")
-
-	extensions := 0 | // put all extensions on a separate line
-		blackfriday.EXTENSION_FENCED_CODE |
-		blackfriday.EXTENSION_TABLES |
-		blackfriday.EXTENSION_AUTOLINK |
-		blackfriday.EXTENSION_FOOTNOTES
-	return blackfriday.Markdown([]byte(text), renderer, extensions)
+func formatMarkdown(md goldmark.Markdown, text string) []byte {
+	var buf bytes.Buffer
+	err := md.Convert([]byte(text), &buf)
+	checkError(err, "could not render Markdown")
+	return buf.Bytes()
 }
 
+// formatMarkdownText is used in the feed.
 func formatMarkdownText(text string) string {
-	return string(formatMarkdown(text))
+	return string(formatMarkdown(blog.feedMarkdown(), text))
 }
 
 func formatMarkdownHTML(text string) template.HTML {
-	return template.HTML(formatMarkdown(text))
+	return template.HTML(formatMarkdown(blog.markdown(), text))
+}
+
+// pageTOC returns the table of contents of a page, or nil when it is disabled
+// for the page.
+func pageTOC(page *Page) []*TOCEntry {
+	if page == nil || !page.TOC {
+		return nil
+	}
+	return tableOfContents(blog.markdown(), []byte(page.Text))
+}
+
+// increment returns n+1, for counting from 1 in templates.
+func increment(n int) int {
+	return n + 1
+}
+
+func assetURL(name string) string {
+	return blog.assetURL(name)
 }
 
 func isTime(t interface{}) bool {
@@ -73,16 +87,24 @@ func xmlEscape(s string) string {
 }
 
 var funcMap = template.FuncMap{
+	"asset":      assetURL,
 	"capitalize": capitalizeFirst,
 	"date":       formatDate,
+	"inc":        increment,
 	"timestamp":  formatTimestamp,
-	"markdown":   formatMarkdownHTML,
 	"istime":     isTime,
 	"xmlescape":  xmlEscape,
 }
 
 var funcMapText = texttemplate.FuncMap{
 	"timestamp": formatTimestamp,
-	"markdown":   formatMarkdownText,
 	"xmlescape": xmlEscape,
 }
+
+func init() {
+	// Do this inside init() to avoid an initialization loop: shortcode
+	// templates, used while rendering Markdown, use funcMap too.
+	funcMap["markdown"] = formatMarkdownHTML
+	funcMap["toc"] = pageTOC
+	funcMapText["markdown"] = formatMarkdownText
+}
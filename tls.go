@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// hstsHeader returns the value of the Strict-Transport-Security header, or an
+// empty string if HSTS is disabled.
+func (b *Blog) hstsHeader() string {
+	if b.HSTSMaxAge <= 0 {
+		return ""
+	}
+	value := "max-age=" + strconv.Itoa(b.HSTSMaxAge)
+	if b.HSTSIncludeSubs {
+		value += "; includeSubDomains"
+	}
+	return value
+}
+
+// redirectHTTPS redirects plain HTTP requests to the same URL over HTTPS.
+func (b *Blog) redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Use HTTPS", http.StatusBadRequest)
+		return
+	}
+	u := *r.URL
+	u.Scheme = "https"
+	u.Host = r.Host
+	if b.OriginURL.Scheme == "https" && b.OriginURL.Host != "" {
+		u.Host = b.OriginURL.Host
+	}
+	http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+}
+
+// acmeManager returns a certificate manager that fetches certificates for the
+// configured domains and stores them in the cache directory.
+func (b *Blog) acmeManager() *autocert.Manager {
+	domains := b.ACMEDomains
+	if len(domains) == 0 {
+		if b.OriginURL.Hostname() == "" {
+			raiseError("no ACME domains configured and origin has no host")
+		}
+		domains = []string{b.OriginURL.Hostname()}
+	}
+
+	err := os.MkdirAll(b.ACMECacheDir, 0700)
+	checkError(err, "could not create ACME cache directory")
+
+	client := &acme.Client{DirectoryURL: b.ACMEDirectory}
+	if b.ACMECAFile != "" {
+		// Useful for testing against a local ACME server like Pebble, which
+		// uses a self-signed certificate for its directory.
+		pem, err := ioutil.ReadFile(b.ACMECAFile)
+		checkError(err, "could not read ACME CA file")
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			raiseError("could not parse ACME CA file " + b.ACMECAFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(b.ACMECacheDir),
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Email:      b.ACMEEmail,
+		Client:     client,
+	}
+}
+
+func (b *Blog) serveHTTPS(addr string) {
+	b.startLogging()
+	b.redirectPermalinks()
+	b.retryDeliveries()
+	b.serveMetrics()
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: b.router,
+	}
+
+	var redirect http.Handler = http.HandlerFunc(b.redirectHTTPS)
+
+	if b.ACME {
+		manager := b.acmeManager()
+		server.TLSConfig = manager.TLSConfig()
+		// The HTTP server must also answer http-01 challenges.
+		redirect = manager.HTTPHandler(redirect)
+	} else if b.TLSCertFile == "" || b.TLSKeyFile == "" {
+		raiseError("no TLS certificate configured (set tls-cert and tls-key, or enable acme)")
+	}
+
+	if b.HTTPRedirectAddr != "" {
+		go func() {
+			err := http.ListenAndServe(b.HTTPRedirectAddr, redirect)
+			checkError(err, "could not bind to HTTP redirect address")
+		}()
+	} else if b.ACME {
+		// Without a plain HTTP server only the tls-alpn-01 challenge can be
+		// used, which is fine but worth mentioning.
+		internalError("no http-redirect-addr configured, ACME will only use tls-alpn-01", nil, false)
+	}
+
+	certFile, keyFile := b.TLSCertFile, b.TLSKeyFile
+	if b.ACME {
+		// The certificate comes from the TLSConfig.
+		certFile, keyFile = "", ""
+	}
+	err := server.ListenAndServeTLS(certFile, keyFile)
+	checkError(err, "could not bind to HTTPS server address")
+}
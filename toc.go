@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// Every heading gets an id, a slug of its text: "Installing *Go* 1.22" becomes
+// installing-go-1-22. The id only changes when the text of the heading
+// changes, so links to a section keep working when the page is edited.
+// Headings with the same text get a suffix: -1, -2, etc.
+
+// TOCEntry is a heading in the table of contents of a page, with the headings
+// of its subsections as children.
+type TOCEntry struct {
+	Title    string
+	ID       string
+	Level    int
+	Children []*TOCEntry
+}
+
+// headingSlug returns the id for a heading with this text: letters and digits
+// in lower case, with all other characters replaced by single dashes.
+func headingSlug(s string) string {
+	var slug strings.Builder
+	dash := false
+	for _, c := range s {
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			if dash && slug.Len() != 0 {
+				slug.WriteByte('-')
+			}
+			slug.WriteRune(unicode.ToLower(c))
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if slug.Len() == 0 {
+		return "section"
+	}
+	return slug.String()
+}
+
+// headingText returns the text of a heading without markup, and without the
+// link added by the heading-anchors extension.
+func headingText(node ast.Node, source []byte) string {
+	var buf bytes.Buffer
+	ast.Walk(node, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		switch n := n.(type) {
+		case *ast.Link:
+			if class, ok := n.AttributeString("class"); ok && string(class.([]byte)) == "anchor" {
+				return ast.WalkSkipChildren, nil
+			}
+		case *ast.Text:
+			buf.Write(n.Segment.Value(source))
+			if n.SoftLineBreak() || n.HardLineBreak() {
+				buf.WriteByte(' ')
+			}
+		case *ast.String:
+			buf.Write(n.Value)
+		case *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		case *mathInline:
+			buf.Write(n.tex)
+		}
+		return ast.WalkContinue, nil
+	})
+	return strings.TrimSpace(buf.String())
+}
+
+// headingIDs gives all headings an id. It is always enabled.
+var headingIDs = &headingIDsExtension{}
+
+type headingIDsExtension struct{}
+
+func (e *headingIDsExtension) Extend(m goldmark.Markdown) {
+	// Before heading-anchors (priority 1000), which links to these ids.
+	m.Parser().AddOptions(parser.WithASTTransformers(util.Prioritized(e, 900)))
+}
+
+// Transform sets the id attribute of all headings.
+func (e *headingIDsExtension) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	used := make(map[string]bool)
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		slug := headingSlug(headingText(heading, source))
+		id := slug
+		for i := 1; used[id]; i++ {
+			id = slug + "-" + strconv.Itoa(i)
+		}
+		used[id] = true
+		heading.SetAttributeString("id", []byte(id))
+		return ast.WalkSkipChildren, nil
+	})
+}
+
+// tableOfContents returns the headings of a Markdown text, nested by level.
+func tableOfContents(md goldmark.Markdown, source []byte) []*TOCEntry {
+	doc := md.Parser().Parse(text.NewReader(source))
+
+	var toc []*TOCEntry
+	var stack []*TOCEntry // the last entry of every level above the current one
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		heading, ok := n.(*ast.Heading)
+		if !ok || !entering {
+			return ast.WalkContinue, nil
+		}
+		entry := &TOCEntry{
+			Title: headingText(heading, source),
+			Level: heading.Level,
+		}
+		if id, ok := heading.AttributeString("id"); ok {
+			entry.ID = string(id.([]byte))
+		}
+
+		for len(stack) != 0 && stack[len(stack)-1].Level >= entry.Level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			toc = append(toc, entry)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, entry)
+		}
+		stack = append(stack, entry)
+		return ast.WalkSkipChildren, nil
+	})
+	return toc
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -32,17 +36,82 @@ func lastTime(times ...time.Time) time.Time {
 	return t
 }
 
-func equalLastModified(t time.Time, req *http.Request) bool {
-	ims, err := time.Parse(time.RFC1123, req.Header.Get("If-Modified-Since"))
-	return err == nil && t.Equal(ims)
-	// Error means: there is no IMS header present, or the parser failed.
-	//
-	// According to rfc7231, an implementation MUST also parse certain
-	// legacy date formats.
-	// Because I don't think current HTTP clients still use them and a
-	// full reply is valid anyway, I'll only parse the recommended date
-	// format.
-	// See https://tools.ietf.org/html/rfc7231#section-7.1.1.1
+// notModified evaluates the If-None-Match and If-Modified-Since headers of a
+// GET or HEAD request, and returns true if a 304 Not Modified reply can be
+// sent. etag may be empty when the resource has no entity tag.
+// See https://tools.ietf.org/html/rfc7232#section-6
+func notModified(req *http.Request, etag string, lastModified time.Time) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+
+	inm := strings.Join(req.Header.Values("If-None-Match"), ",")
+	ims := req.Header.Get("If-Modified-Since")
+	if inm == "" && ims == "" {
+		return false
+	}
+
+	match := false
+	if inm != "" {
+		// If-Modified-Since must be ignored when If-None-Match is present.
+		match = etagMatch(inm, etag, true)
+	} else if !lastModified.IsZero() {
+		// http.ParseTime also parses the legacy RFC 850 and asctime() date
+		// formats, which rfc7231 says an implementation MUST accept.
+		// See https://tools.ietf.org/html/rfc7231#section-7.1.1.1
+		t, err := http.ParseTime(ims)
+		// Last-Modified has a resolution of one second, so the sub-second part
+		// must not make the resource look newer than the client's copy.
+		match = err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+
+	if match {
+		metricConditionalRequests.WithLabelValues("hit").Inc()
+	} else {
+		metricConditionalRequests.WithLabelValues("miss").Inc()
+	}
+	return match
+}
+
+// etagMatch returns true if etag is in the list of entity tags of an If-Match
+// or If-None-Match header. If-None-Match uses the weak comparison (weak is
+// true), where W/"x" and "x" are equal. If-Match uses the strong comparison,
+// where weak tags never match.
+// See https://tools.ietf.org/html/rfc7232#section-2.3.2
+func etagMatch(header, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if tag == etag && !strings.HasPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// makeETag returns an entity tag from a hash of all parts. Weak tags are used
+// for responses that are semantically but not byte-for-byte equal, like pages
+// containing a CSP nonce.
+func makeETag(weak bool, parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		// Separate the parts, so ("ab", "c") and ("a", "bc") differ.
+		io.WriteString(h, strconv.Itoa(len(part))+":"+part)
+	}
+	etag := `"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`
+	if weak {
+		etag = "W/" + etag
+	}
+	return etag
 }
 
 func httpLastModified(t time.Time) string {
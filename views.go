@@ -2,13 +2,13 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
+	"encoding/json"
 	"io"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"strconv"
+	"strings"
 	texttemplate "text/template"
 	"time"
 
@@ -25,6 +25,7 @@ type Viewer interface {
 type Response struct {
 	data                map[string]interface{}
 	tpl                 string
+	etag                string // entity tag of the data added inside the view
 	errorCode           int
 	CookieAuthenticated bool
 }
@@ -40,28 +41,46 @@ func NewResponse() *Response {
 	// these should be moved to template blocks in Go 1.6
 	res.data["extraCSS"] = blog.extraCSS
 	res.data["extraJS"] = blog.extraJS
+	res.data["bundleJS"] = blog.BundleJS
 	res.data["icons"] = blog.icons
 	return &res
 }
 
 // Output serves the page, implementing some web server logic. It gives proper
-// responses to If-Modified_since requests.
+// responses to If-None-Match and If-Modified-Since requests.
 // lastModified is the Last-Modified date of the data added inside the view.
 // Output may also add some more and output a different Last-Modified header,
-// but if lastModified is nil, no Last-Modified HTTP header will be outputted.
+// but if lastModified is nil, no Last-Modified or ETag HTTP header will be
+// outputted.
 func (res *Response) Output(w http.ResponseWriter, r *http.Request, lastModified time.Time) {
 
-	menu := PagesFromQuery(blog, PAGE_TYPE_STATIC, FETCH_TITLE, "published != 0", "ORDER BY title DESC")
-	res.data["menu"] = menu
+	tree := blog.pageTree()
+	menus := blog.navMenus()
+	res.data["menu"] = menus.menus["header"]
+	res.data["menus"] = menus.menus
+	res.data["cspNonce"] = cspNonce(r)
 
 	h := w.Header()
+	addVary(h, "Accept-Encoding")
 
+	var etag string
 	if !lastModified.IsZero() {
 		// This only adds a Last-Modified header to views that explicitly add a
 		// Last-Modified timestamp. Otherwise we might end up with serving old
 		// invalid Last-Modified dates.
 
-		lastModified = lastTime(lastModified, blog.GetTemplateModified(res.tpl).Truncate(time.Second), menu.LastModified())
+		templateModified := blog.GetTemplateModified(res.tpl)
+		lastModified = lastTime(lastModified, templateModified.Truncate(time.Second), tree.lastModified, menus.lastModified)
+
+		// The entity tag covers everything the page is generated from. It is
+		// weak, as the CSP nonce differs between responses.
+		var user string
+		if u, ok := res.data["user"].(*User); ok {
+			user = u.email
+		}
+		etag = makeETag(true, res.tpl, res.etag, tree.etag, menus.etag, user,
+			strconv.FormatInt(templateModified.UnixNano(), 10), blog.skinVersion,
+			strconv.FormatInt(blog.assetManifest().modified.UnixNano(), 10))
 
 		// These headers must be served at all times, even when sending a 304
 		// Not Modified reply.
@@ -71,9 +90,10 @@ func (res *Response) Output(w http.ResponseWriter, r *http.Request, lastModified
 		//     response to the same request: Cache-Control, Content-Location, Date,
 		//     ETag, Expires, and Vary.
 
+		h.Set("ETag", etag)
 		if res.CookieAuthenticated {
 			h.Set("Cache-Control", "private")
-			h.Set("Vary", "Cookie")
+			addVary(h, "Cookie")
 		} else {
 			h.Set("Cache-Control", "max-age=60,s-maxage=5")
 		}
@@ -81,25 +101,37 @@ func (res *Response) Output(w http.ResponseWriter, r *http.Request, lastModified
 
 	// Test whether we can serve a 304 Not Modified reply.
 	if !lastModified.IsZero() && res.errorCode == 0 {
-		if equalLastModified(lastModified, r) {
+		if notModified(r, etag, lastModified) {
+			// The cached page contains the CSP nonce of the response it came
+			// from. Headers of a 304 reply replace the stored ones, so a new
+			// policy would block its scripts and styles.
+			h.Del("Content-Security-Policy")
 			w.WriteHeader(304) // Not Modified
 			return
 		}
 	}
 
+	renderStart := time.Now()
 	tpl := blog.GetTemplate(res.tpl)
 
 	var buf bytes.Buffer
-	gz := gzip.NewWriter(&buf)
-
-	err := tpl.Execute(gz, res.data)
+	err := tpl.Execute(&buf, res.data)
 	checkError(err, "failed to get view output")
-
-	gz.Close()
+	observeSince(metricTemplateRender.WithLabelValues(res.tpl), renderStart)
 
 	h.Set("Content-Type", "text/html; charset=utf-8")
-	h.Set("Content-Encoding", "gzip")
-	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+
+	if !lastModified.IsZero() && res.errorCode == 0 && !res.CookieAuthenticated {
+		storeCached(r, &cacheEntry{
+			contentType:  h.Get("Content-Type"),
+			cacheControl: h.Get("Cache-Control"),
+			etag:         etag,
+			lastModified: lastModified,
+			tpl:          res.tpl,
+		}, buf.Bytes())
+	}
+
+	body := writeEncoded(w, r, buf.Bytes())
 
 	if !lastModified.IsZero() {
 		h.Set("Last-Modified", httpLastModified(lastModified))
@@ -110,20 +142,43 @@ func (res *Response) Output(w http.ResponseWriter, r *http.Request, lastModified
 	}
 
 	if r.Method != "HEAD" {
-		w.Write(buf.Bytes())
+		w.Write(body)
 	}
 }
 
-func OutputStatic(w http.ResponseWriter, r *http.Request, contentType string, p string) {
-	f, err := os.Open(p)
+// OutputStatic serves a file from the webroot. Precompressed versions of the
+// file (p + ".br", p + ".gz") are served if the client accepts them.
+func OutputStatic(w http.ResponseWriter, r *http.Request, contentType string, p string, cacheControl string) {
+	var available []string
+	for _, coding := range encodings {
+		if _, err := os.Stat(p + encodingExtensions[coding]); err == nil {
+			available = append(available, coding)
+		}
+	}
+	coding := negotiateEncoding(r, available)
+
+	// Use the modification time of the uncompressed file, so all versions
+	// have the same Last-Modified header.
+	plainSt, err := os.Stat(p)
+	checkError(err, "OutputStatic: could not stat file")
+	modTime := plainSt.ModTime()
+
+	f, err := os.Open(p + encodingExtensions[coding])
 	checkError(err, "OutputStatic: could not open")
+	defer f.Close()
 	st, err := f.Stat()
 	checkError(err, "OutputStatic: could not stat file")
 
+	// Every content coding is a different representation, so it needs its own
+	// strong entity tag.
+	etag := makeETag(false, strconv.FormatInt(modTime.UnixNano(), 10), strconv.FormatInt(plainSt.Size(), 10), coding)
+
 	h := w.Header()
-	h.Set("Cache-Control", "max-age=3600,s-maxage=5")
+	h.Set("Cache-Control", cacheControl)
+	h.Set("ETag", etag)
+	addVary(h, "Accept-Encoding")
 
-	if equalLastModified(st.ModTime(), r) {
+	if notModified(r, etag, modTime) {
 		w.WriteHeader(304) // Not Modified
 		return
 	}
@@ -144,9 +199,11 @@ func OutputStatic(w http.ResponseWriter, r *http.Request, contentType string, p
 	}
 
 	h.Set("Content-Type", contentType+"; charset=utf-8")
-	h.Set("Content-Encoding", "gzip")
+	if coding != "" {
+		h.Set("Content-Encoding", coding)
+	}
 	h.Set("Content-Length", strconv.FormatInt(st.Size(), 10))
-	h.Set("Last-Modified", httpLastModified(st.ModTime()))
+	h.Set("Last-Modified", httpLastModified(modTime))
 
 	if r.Method != "HEAD" {
 		n, err := io.Copy(w, f)
@@ -172,102 +229,96 @@ func AssetHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if blog.Dev {
+		// Always compile assets in development mode, so changes are visible
+		// immediately.
+		data, err := blog.compileAsset(name)
+		if os.IsNotExist(err) {
+			NotFound(w, r)
+			return
+		}
+		if err != nil {
+			if logger != nil {
+				logger.Warn("could not compile asset", "asset", name, "error", err)
+			}
+			outputAssetError(w, name, err)
+			return
+		}
+		h := w.Header()
+		h.Set("Content-Type", assetMediaTypes[ext]+"; charset=utf-8")
+		h.Set("Cache-Control", "no-cache")
+		h.Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method != "HEAD" {
+			w.Write(data)
+		}
+		return
+	}
+
+	// Fingerprinted assets (from build-assets) never change.
+	cacheControl := "max-age=3600,s-maxage=5"
+	if blog.isFingerprintedAsset(name) {
+		cacheControl = "public,max-age=31536000,immutable"
+	}
+
 	outpath := path.Join(blog.WebRoot, blog.AssetsPrefix, name)
-	if _, err := os.Stat(outpath + ".gz"); err == nil {
+	if _, err := os.Stat(outpath); err == nil {
 		// The file already exists. That means the server isn't well-configured
-		// or there is a race between creating a file and serving another via
-		// the blog.
-		OutputStatic(w, r, ext, outpath+".gz")
+		// or the asset was built ahead of time with build-assets.
+		OutputStatic(w, r, ext, outpath, cacheControl)
 		return
 	} else if !os.IsNotExist(err) {
 		checkError(err, "could not stat asset file")
 	}
 
-	blog.loadSkin()
-	for i, skin := range blog.skins {
-		var cmd *exec.Cmd // input via command
-		var reader io.Reader
-		var err error
-
-		// TODO clean up duplicate code
-
-		switch ext {
-		case ".js":
-			// Only open input JavaScript file
-			infile, err := os.Open(path.Join(blog.BlogPath, "skins", skin, name))
-			if os.IsNotExist(err) {
-				continue
-			}
-			checkError(err, "failed to open JavaScript file")
-			defer infile.Close()
-			reader = infile
-
-		case ".css":
-			// Start converting input SCSS file to CSS
-			scssPath := path.Join(blog.BlogPath, "skins", skin, name[:len(name)-len(ext)]+".scss")
-			_, err = os.Stat(scssPath)
-			if os.IsNotExist(err) {
-				continue
-			}
-			checkError(err, "failed to stat SCSS file")
-
-			args := []string{"--default-encoding", "utf-8", "--no-cache"}
-			for j := i; j < len(blog.skins); j++ {
-				args = append(args, "-I", path.Join(blog.BlogPath, "skins", blog.skins[j]))
-			}
-			args = append(args, scssPath)
+	data, err := blog.compileAsset(name)
+	if os.IsNotExist(err) {
+		NotFound(w, r)
+		return
+	}
+	checkError(err, "could not compile asset")
 
-			// Debian package for command: ruby-sass
-			cmd = exec.Command("scss", args...)
-			reader, err = cmd.StdoutPipe()
-			checkError(err, "could not get stdout")
-			checkError(cmd.Start(), "could not run scss")
+	writeAsset(outpath, data)
+	OutputStatic(w, r, ext, outpath, cacheControl)
+}
 
+// cssString returns s as a quoted CSS string. Quotes, backslashes and
+// control characters (like newlines) are escaped as hex escapes.
+// See https://www.w3.org/TR/css-syntax-3/#consume-string-token
+func cssString(s string) string {
+	var buf strings.Builder
+	buf.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(c)
+		case c < 0x20 || c == 0x7f:
+			buf.WriteString("\\" + strconv.FormatInt(int64(c), 16) + " ")
 		default:
-			panic("unreachable")
-		}
-
-		err = os.Remove(outpath + ".tmp")
-		if !os.IsNotExist(err) {
-			checkError(err, "could not remove temporary file")
-		}
-		err = os.Remove(outpath + ".gz.tmp")
-		if !os.IsNotExist(err) {
-			checkError(err, "could not remove temporary file")
+			buf.WriteRune(c)
 		}
-		// There is a race here: two processes could be creating these files at
-		// the same time.
-		outfile, err := os.OpenFile(outpath+".tmp", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
-		checkError(err, "failed to open output asset file")
-		outgzfile, err := os.OpenFile(outpath+".gz.tmp", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
-		checkError(err, "failed to open output gz asset file")
-
-		gzwriter := gzip.NewWriter(outgzfile)
-		// Write the normal and the GZ files at once!
-		tee := io.TeeReader(reader, gzwriter)
-
-		_, err = io.Copy(outfile, tee)
-		checkError(err, "could not compress and write asset file")
-		gzwriter.Close()
-
-		if cmd != nil {
-			// It is important to check whether the command finished
-			// successfully, otherwise we might end up with invalid SCSS files.
-			checkError(cmd.Wait(), "could not finish command")
-		}
-
-		// This can be implemented faster by seeking and outputting the file,
-		// and then doing the sync+close+rename. Unfortunately, that doesn't
-		// seem to work so easily...
-		checkError(outfile.Sync(), "could not sync data to tmpfile")
-		checkError(outgzfile.Sync(), "could not sync data to gzip tmpfile")
-		checkError(outfile.Close(), "could not close tmpfile")
-		checkError(outgzfile.Close(), "could not close gzip tmpfile")
-		checkError(os.Rename(outpath+".tmp", outpath), "could not rename tmpfile")
-		checkError(os.Rename(outpath+".gz.tmp", outpath+".gz"), "could not rename gzip tmpfile")
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
 
-		OutputStatic(w, r, ext, outpath+".gz")
+// outputAssetError shows a compile error (including the file and line):
+// stylesheets show it at the top of every page using them, scripts log it to
+// the console. Only used in development mode.
+func outputAssetError(w http.ResponseWriter, name string, err error) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	if path.Ext(name) == ".js" {
+		msg, _ := json.Marshal(name + ": " + err.Error())
+		h.Set("Content-Type", "text/javascript; charset=utf-8")
+		w.WriteHeader(500)
+		io.WriteString(w, "console.error("+string(msg)+");\n")
+		return
 	}
+	h.Set("Content-Type", "text/css; charset=utf-8")
+	w.WriteHeader(500)
+	io.WriteString(w, "/* "+strings.Replace(err.Error(), "*/", "* /", -1)+" */\n"+
+		"body::before { display: block; white-space: pre-wrap; padding: 1em; background: #fdd; color: #900; font-family: monospace; content: "+cssString(err.Error())+"; }\n")
 }
 
 func BlogIndexHandler(w http.ResponseWriter, r *http.Request) {
@@ -277,6 +328,7 @@ func BlogIndexHandler(w http.ResponseWriter, r *http.Request) {
 
 	posts := PagesFromQuery(blog, PAGE_TYPE_POST, FETCH_TITLE, "published!=0", "ORDER BY published DESC LIMIT 10")
 	res.data["posts"] = posts
+	res.etag = posts.ETag()
 
 	res.Output(w, r, posts.LastModified())
 }
@@ -284,8 +336,23 @@ func BlogIndexHandler(w http.ResponseWriter, r *http.Request) {
 func PageViewHandler(w http.ResponseWriter, r *http.Request) {
 	res := NewResponse()
 
-	page := PageFromQuery(blog, PAGE_TYPE_NONE, FETCH_ALL, "name=? AND published!=0", "", mux.Vars(r)["name"])
+	vars := mux.Vars(r)
+	var page *Page
+	if _, ok := vars["parents"]; !ok {
+		page = PageFromQuery(blog, PAGE_TYPE_POST, FETCH_ALL, "name=? AND published!=0", "", vars["name"])
+	}
 	if page == nil {
+		// Static pages are found by their path, as names are only unique
+		// between pages with the same parent. The route of posts may match
+		// the path of a page too, like /notes/{name} and /notes/todo.
+		names := strings.Split(strings.TrimPrefix(r.URL.Path, blog.URLPrefix+"/"), "/")
+		if p := blog.pageTree().lookup(names); p != nil {
+			page = PageFromQuery(blog, PAGE_TYPE_STATIC, FETCH_ALL, "id=? AND published!=0", "", p.Id)
+		}
+	}
+	if page == nil || r.URL.Path != blog.URLPrefix+page.Url() {
+		// Not at this URL, for example a post published again in another
+		// month. The old URL may be a redirect.
 		NotFound(w, r)
 		return
 	}
@@ -301,8 +368,25 @@ func PageViewHandler(w http.ResponseWriter, r *http.Request) {
 
 	res.data["page"] = page
 	res.data["title"] = page.Title
+	res.etag = page.ETag()
+	lastModified := page.LastModified()
+
+	// Posts link to the posts before and after them, to related posts and to
+	// the other parts of their series, so they change with them.
+	if neighbours := page.neighbours(blog); neighbours != nil {
+		res.data["previous"] = neighbours.Previous
+		res.data["next"] = neighbours.Next
+		res.data["related"] = neighbours.Related
+		res.etag = makeETag(false, res.etag, neighbours.etag)
+		lastModified = lastTime(lastModified, neighbours.modified)
+	}
+	if part := page.seriesPart(blog); part != nil {
+		res.data["series"] = part
+		res.etag = makeETag(false, res.etag, part.etag)
+		lastModified = lastTime(lastModified, part.modified)
+	}
 
-	res.Output(w, r, page.LastModified())
+	res.Output(w, r, lastModified)
 }
 
 func ArchiveHandler(w http.ResponseWriter, r *http.Request) {
@@ -311,6 +395,7 @@ func ArchiveHandler(w http.ResponseWriter, r *http.Request) {
 
 	posts := PagesFromQuery(blog, PAGE_TYPE_POST, FETCH_TITLE, "published!=0", "ORDER BY published DESC")
 	res.data["posts"] = posts
+	res.etag = posts.ETag()
 
 	res.Output(w, r, posts.LastModified())
 }
@@ -318,19 +403,21 @@ func ArchiveHandler(w http.ResponseWriter, r *http.Request) {
 func FeedHandler(w http.ResponseWriter, r *http.Request) {
 	h := w.Header()
 	h.Set("Cache-Control", "max-age=60,s-maxage=5")
+	addVary(h, "Accept-Encoding")
 
 	posts := PagesFromQuery(blog, PAGE_TYPE_POST, FETCH_ALL, "published!=0", "ORDER BY published DESC LIMIT 10")
 	lastModified := posts.LastModified()
+	etag := makeETag(true, posts.ETag())
+	h.Set("ETag", etag)
 
 	if !lastModified.IsZero() {
-		if equalLastModified(lastModified, r) {
+		if notModified(r, etag, lastModified) {
 			w.WriteHeader(304) // Not Modified
 			return
 		}
 	}
 
 	h.Set("Content-Type", "application/atom+xml; charset=utf-8")
-	h.Set("Content-Encoding", "gzip")
 	h.Set("Last-Modified", httpLastModified(lastModified))
 
 	tpl := texttemplate.New("feed")
@@ -387,10 +474,116 @@ func FeedHandler(w http.ResponseWriter, r *http.Request) {
 		"icon":     blog.Logo,
 	}
 
-	gz := gzip.NewWriter(w)
-	err = tpl.Execute(gz, data)
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, data)
 	checkError(err, "failed to generate feed XML")
-	gz.Close()
+
+	storeCached(r, &cacheEntry{
+		contentType:  h.Get("Content-Type"),
+		cacheControl: h.Get("Cache-Control"),
+		etag:         etag,
+		lastModified: lastModified,
+	}, buf.Bytes())
+
+	body := writeEncoded(w, r, buf.Bytes())
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
+
+// SitemapHandler lists all public URLs for search engines.
+// See https://www.sitemaps.org/protocol.html
+func SitemapHandler(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "max-age=60,s-maxage=5")
+	addVary(h, "Accept-Encoding")
+
+	pages := PagesFromQuery(blog, PAGE_TYPE_NONE, FETCH_TITLE, "published!=0", "ORDER BY published DESC")
+	posts := PagesFromQuery(blog, PAGE_TYPE_POST, FETCH_TITLE, "published!=0", "")
+	lastModified := pages.LastModified()
+	etags := []string{pages.ETag()}
+	type seriesURL struct {
+		Url          string
+		LastModified time.Time
+	}
+	var series []seriesURL
+	for _, s := range publicSeries(blog) {
+		parts := s.Posts()
+		series = append(series, seriesURL{s.Url(), s.LastModified(parts)})
+		etags = append(etags, s.ETag(parts))
+		lastModified = lastTime(lastModified, s.LastModified(parts))
+	}
+	etag := makeETag(true, etags...)
+	h.Set("ETag", etag)
+
+	if !lastModified.IsZero() {
+		if notModified(r, etag, lastModified) {
+			w.WriteHeader(304) // Not Modified
+			return
+		}
+		h.Set("Last-Modified", httpLastModified(lastModified))
+	}
+
+	h.Set("Content-Type", "application/xml; charset=utf-8")
+
+	tpl := texttemplate.New("sitemap")
+	tpl.Funcs(funcMapText)
+	_, err := tpl.Parse(
+		`<?xml version="1.0" encoding="utf-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+ <url>
+   <loc>{{.indexURL|xmlescape}}</loc>
+   {{if .posts}}<lastmod>{{.posts.LastModified|timestamp|xmlescape}}</lastmod>{{end}}
+ </url>
+ <url>
+   <loc>{{.archiveURL|xmlescape}}</loc>
+   {{if .posts}}<lastmod>{{.posts.LastModified|timestamp|xmlescape}}</lastmod>{{end}}
+ </url>
+ {{range .pages}}
+ <url>
+   <loc>{{$.base|xmlescape}}{{.Url|xmlescape}}</loc>
+   <lastmod>{{.LastModified|timestamp|xmlescape}}</lastmod>
+ </url>
+ {{end}}
+ {{range .series}}
+ <url>
+   <loc>{{$.base|xmlescape}}{{.Url|xmlescape}}</loc>
+   <lastmod>{{.LastModified|timestamp|xmlescape}}</lastmod>
+ </url>
+ {{end}}
+</urlset>
+`)
+	checkError(err, "failed to parse sitemap template")
+
+	indexURL, _ := blog.mux.Get("index").URL()
+	archiveURL, _ := blog.mux.Get("archive").URL()
+
+	data := map[string]interface{}{
+		"base":       blog.Origin + blog.URLPrefix,
+		"indexURL":   blog.Origin + indexURL.Path,
+		"archiveURL": blog.Origin + archiveURL.Path,
+		"pages":      pages,
+		"posts":      posts,
+		"series":     series,
+	}
+
+	var buf bytes.Buffer
+	err = tpl.Execute(&buf, data)
+	checkError(err, "failed to generate sitemap XML")
+
+	if !lastModified.IsZero() {
+		storeCached(r, &cacheEntry{
+			contentType:  h.Get("Content-Type"),
+			cacheControl: h.Get("Cache-Control"),
+			etag:         etag,
+			lastModified: lastModified,
+		}, buf.Bytes())
+	}
+
+	body := writeEncoded(w, r, buf.Bytes())
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
 }
 
 func NewAuthenticatedResponse(w http.ResponseWriter, r *http.Request) *Response {
@@ -425,6 +618,8 @@ func NewAuthenticatedResponse(w http.ResponseWriter, r *http.Request) *Response
 		return nil
 	}
 
+	setRequestUser(r, user)
+
 	view := NewResponse()
 	view.data["user"] = user
 	view.CookieAuthenticated = true
@@ -450,8 +645,11 @@ func AdminHandler(w http.ResponseWriter, r *http.Request) {
 
 	menuUnpublished := PagesFromQuery(blog, PAGE_TYPE_STATIC, FETCH_TITLE, "published == 0", "ORDER BY title DESC")
 	res.data["menuUnpublished"] = menuUnpublished
+	menuPublished := PagesFromQuery(blog, PAGE_TYPE_STATIC, FETCH_TITLE, "published != 0", "ORDER BY title")
+	res.data["menuPublished"] = menuPublished
+	res.etag = makeETag(false, drafts.ETag(), published.ETag(), menuUnpublished.ETag(), menuPublished.ETag())
 
-	res.Output(w, r, lastTime(drafts.LastModified(), published.LastModified(), menuUnpublished.LastModified()))
+	res.Output(w, r, lastTime(drafts.LastModified(), published.LastModified(), menuUnpublished.LastModified(), menuPublished.LastModified()))
 }
 
 func PageEditHandler(w http.ResponseWriter, r *http.Request) {
@@ -479,8 +677,85 @@ func PageEditHandler(w http.ResponseWriter, r *http.Request) {
 		// Page.Id will get set during the update.
 		newPage := page.Id == 0
 
+		// Detect concurrent edits: the page must not have been changed since
+		// it was loaded in the editor. Browsers can't send If-Match from a
+		// form, so the editor sends the entity tag as a form field.
+		ifMatch := r.Header.Get("If-Match")
+		if ifMatch == "" {
+			ifMatch = r.PostFormValue("etag")
+		}
+		if !newPage && ifMatch != "" && !etagMatch(ifMatch, page.ETag(), false) {
+			// Show the submitted text, so it isn't lost. Saving again will
+			// overwrite the other changes.
+			submitted := *page
+			submitted.Name = r.PostFormValue("name")
+			submitted.Title = r.PostFormValue("title")
+			submitted.Summary = r.PostFormValue("summary")
+			submitted.Text = r.PostFormValue("text")
+			submitted.TOC = r.PostFormValue("toc") != ""
+			submitted.Hidden = r.PostFormValue("hidden") != ""
+			if parentId, err := strconv.ParseInt(r.PostFormValue("parent"), 10, 64); err == nil {
+				submitted.ParentId = parentId
+			}
+			if seriesId, err := strconv.ParseInt(r.PostFormValue("series"), 10, 64); err == nil {
+				submitted.SeriesId = seriesId
+			}
+
+			res.tpl = "editpage"
+			res.errorCode = http.StatusPreconditionFailed
+			res.data["page"] = &submitted
+			res.data["etag"] = page.ETag()
+			res.data["conflict"] = true
+			res.data["parents"] = blog.pageTree().parentOptions(page)
+			res.data["allSeries"] = SeriesFromQuery(blog, "")
+			res.data["title"] = page.Title
+			res.Output(w, r, time.Time{})
+			return
+		}
+
+		if r.PostFormValue("delete") != "" && !newPage {
+			if err := page.Delete(blog); err != nil {
+				http.Error(w, "could not delete page: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			admin, _ := blog.mux.Get("admin").URLPath()
+			w.Header().Set("Location", admin.Path)
+			w.WriteHeader(303)
+			return
+		}
+
+		parentId, _ := strconv.ParseInt(r.PostFormValue("parent"), 10, 64)
+		if err := page.checkName(blog, r.PostFormValue("name"), parentId); err != nil {
+			http.Error(w, "could not save page: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		user := res.data["user"].(*User)
-		page.Update(blog, user, r.PostFormValue("name"), r.PostFormValue("title"), r.PostFormValue("summary"), r.PostFormValue("text"))
+		page.Update(blog, user, r.PostFormValue("name"), r.PostFormValue("title"), r.PostFormValue("summary"), r.PostFormValue("text"), r.PostFormValue("toc") != "")
+
+		if page.Type == PAGE_TYPE_STATIC {
+			hidden := r.PostFormValue("hidden") != ""
+			if newPage || parentId != page.ParentId || hidden != page.Hidden {
+				position := -1 // at the end, below a new parent
+				if !newPage && parentId == page.ParentId {
+					position = blog.pageTree().siblingIndex(page)
+				}
+				if err := page.SetMenu(blog, parentId, position, hidden); err != nil {
+					http.Error(w, "could not move page: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		if page.Type == PAGE_TYPE_POST {
+			seriesId, _ := strconv.ParseInt(r.PostFormValue("series"), 10, 64)
+			if seriesId != page.SeriesId {
+				if err := page.SetSeries(blog, seriesId); err != nil {
+					http.Error(w, "could not change series: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
 
 		if r.PostFormValue("publish") != "" {
 			page.Publish(blog)
@@ -500,9 +775,16 @@ func PageEditHandler(w http.ResponseWriter, r *http.Request) {
 	res.tpl = "editpage"
 
 	res.data["page"] = page
+	if page.Type == PAGE_TYPE_STATIC {
+		res.data["parents"] = blog.pageTree().parentOptions(page)
+	} else {
+		res.data["allSeries"] = SeriesFromQuery(blog, "")
+	}
 
 	if page.Id != 0 {
 		res.data["title"] = page.Title
+		res.data["etag"] = page.ETag()
+		res.etag = page.ETag()
 		res.Output(w, r, page.LastModified())
 	} else {
 		res.Output(w, r, time.Time{})
@@ -534,11 +816,17 @@ func PagePreviewHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	res.data["title"] = page.Title
+	res.etag = page.ETag()
 
 	res.Output(w, r, page.LastModified())
 }
 
+// NotFound sends a 404 error, unless there is a redirect for this URL.
 func NotFound(w http.ResponseWriter, r *http.Request) {
+	if blog.serveRedirect(w, r) {
+		return
+	}
+
 	res := NewResponse()
 	res.errorCode = 404
 	res.tpl = "404"